@@ -4,10 +4,13 @@ go 1.24.0
 
 require (
 	github.com/bmatcuk/doublestar/v4 v4.10.0
+	github.com/emicklei/proto v1.14.2
+	github.com/klauspost/compress v1.18.0
 	github.com/magefile/mage v1.15.0
 	github.com/openimsdk/tools v0.0.49
 	github.com/shirou/gopsutil/v4 v4.26.2
 	golang.org/x/sys v0.41.0
+	golang.org/x/tools v0.42.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -21,4 +24,6 @@ require (
 	github.com/tklauser/go-sysconf v0.3.16 // indirect
 	github.com/tklauser/numcpus v0.11.0 // indirect
 	github.com/yusufpapurcu/wmi v1.2.4 // indirect
+	golang.org/x/mod v0.33.0 // indirect
+	golang.org/x/sync v0.19.0 // indirect
 )
@@ -0,0 +1,61 @@
+package limits
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Unlimited is the value of an rlimit without an upper bound.
+const Unlimited = math.MaxUint64
+
+// Limits holds the resource limits of a single process. Nil rlimits are inherited
+// from the parent, empty cgroup values leave the cgroup setting untouched.
+type Limits struct {
+	NoFile *uint64
+	NProc  *uint64
+	Core   *uint64
+
+	// MemoryMax is written to the cgroup v2 memory.max file, e.g. "512M" or "max".
+	MemoryMax string
+	// CPUMax is written to the cgroup v2 cpu.max file, e.g. "50000 100000".
+	CPUMax string
+}
+
+func (l Limits) HasRlimits() bool {
+	return l.NoFile != nil || l.NProc != nil || l.Core != nil
+}
+
+func (l Limits) HasCgroup() bool {
+	return l.MemoryMax != "" || l.CPUMax != ""
+}
+
+func (l Limits) IsZero() bool {
+	return !l.HasRlimits() && !l.HasCgroup()
+}
+
+// ParseRlimit parses a numeric rlimit value or "unlimited". An empty value returns nil.
+func ParseRlimit(raw string) (*uint64, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	if strings.EqualFold(raw, "unlimited") || strings.EqualFold(raw, "infinity") {
+		value := uint64(Unlimited)
+		return &value, nil
+	}
+	value, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rlimit %q: expected a number or \"unlimited\"", raw)
+	}
+	return &value, nil
+}
+
+// FormatRlimit is the inverse of ParseRlimit.
+func FormatRlimit(value uint64) string {
+	if value == Unlimited {
+		return "unlimited"
+	}
+	return strconv.FormatUint(value, 10)
+}
@@ -0,0 +1,164 @@
+//go:build linux
+
+package limits
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Supported reports whether Start applies the limits on this platform.
+const Supported = true
+
+// Start starts cmd with the limits in place before its first instruction runs. With cgroup
+// limits, the process is created inside cgroupDir, which is created below a cgroup v2
+// hierarchy if it does not exist. With rlimits or a setup function, the process stops right
+// after exec until the rlimits are set through prlimit(2) and setup has run, so no thread or
+// child escapes them.
+func Start(cmd *exec.Cmd, cgroupDir string, l Limits, setup func(pid int)) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if l.HasCgroup() {
+		if cgroupDir == "" {
+			return fmt.Errorf("cgroup directory is empty")
+		}
+		fd, err := prepareCgroup(cgroupDir, l)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(fd)
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = fd
+	}
+	if !l.HasRlimits() && setup == nil {
+		return cmd.Start()
+	}
+
+	// The tracer is the thread that started the process, it must also detach it.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	cmd.SysProcAttr.Ptrace = true
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+	var status unix.WaitStatus
+	if _, err := unix.Wait4(pid, &status, 0, nil); err != nil {
+		return abortStart(cmd, fmt.Errorf("failed to wait for process %d to exec: %w", pid, err))
+	}
+	if !status.Stopped() {
+		return fmt.Errorf("process %d exited before its limits were set", pid)
+	}
+	if err := setRlimits(pid, l); err != nil {
+		return abortStart(cmd, err)
+	}
+	if setup != nil {
+		setup(pid)
+	}
+	if err := unix.PtraceDetach(pid); err != nil {
+		return abortStart(cmd, fmt.Errorf("failed to resume process %d: %w", pid, err))
+	}
+	return nil
+}
+
+// abortStart kills a process whose limits could not be applied.
+func abortStart(cmd *exec.Cmd, err error) error {
+	_ = cmd.Process.Kill()
+	_ = cmd.Wait()
+	return err
+}
+
+func setRlimits(pid int, l Limits) error {
+	rlimits := []struct {
+		name     string
+		resource int
+		value    *uint64
+	}{
+		{"nofile", unix.RLIMIT_NOFILE, l.NoFile},
+		{"nproc", unix.RLIMIT_NPROC, l.NProc},
+		{"core", unix.RLIMIT_CORE, l.Core},
+	}
+	for _, r := range rlimits {
+		if r.value == nil {
+			continue
+		}
+		limit := unix.Rlimit{Cur: *r.value, Max: *r.value}
+		if err := unix.Prlimit(pid, r.resource, &limit, nil); err != nil {
+			return fmt.Errorf("failed to set %s limit to %s: %w", r.name, FormatRlimit(*r.value), err)
+		}
+	}
+	return nil
+}
+
+// prepareCgroup creates cgroupDir with the limits and returns a descriptor of it for clone3.
+func prepareCgroup(cgroupDir string, l Limits) (int, error) {
+	var controllers []string
+	if l.MemoryMax != "" {
+		controllers = append(controllers, "memory")
+	}
+	if l.CPUMax != "" {
+		controllers = append(controllers, "cpu")
+	}
+
+	parent := filepath.Dir(cgroupDir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return -1, fmt.Errorf("failed to create cgroup %s: %w", parent, err)
+	}
+	if err := enableControllers(filepath.Dir(parent), controllers); err != nil {
+		return -1, err
+	}
+	if err := enableControllers(parent, controllers); err != nil {
+		return -1, err
+	}
+	if err := os.MkdirAll(cgroupDir, 0755); err != nil {
+		return -1, fmt.Errorf("failed to create cgroup %s: %w", cgroupDir, err)
+	}
+
+	if l.MemoryMax != "" {
+		if err := writeCgroupFile(cgroupDir, "memory.max", l.MemoryMax); err != nil {
+			return -1, err
+		}
+	}
+	if l.CPUMax != "" {
+		if err := writeCgroupFile(cgroupDir, "cpu.max", l.CPUMax); err != nil {
+			return -1, err
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cgroupDir, "cgroup.procs")); errors.Is(err, os.ErrNotExist) {
+		return -1, fmt.Errorf("%s is not a cgroup v2 directory", cgroupDir)
+	}
+	fd, err := unix.Open(cgroupDir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open cgroup %s: %w", cgroupDir, err)
+	}
+	return fd, nil
+}
+
+func enableControllers(dir string, controllers []string) error {
+	if _, err := os.Stat(filepath.Join(dir, "cgroup.subtree_control")); err != nil {
+		// Not part of the cgroup v2 hierarchy, nothing to delegate from here.
+		return nil
+	}
+	enabled := make([]string, 0, len(controllers))
+	for _, c := range controllers {
+		enabled = append(enabled, "+"+c)
+	}
+	return writeCgroupFile(dir, "cgroup.subtree_control", strings.Join(enabled, " "))
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write %q to %s: %w", value, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package limits
+
+import "os/exec"
+
+// Supported reports whether Start applies the limits on this platform.
+const Supported = false
+
+// Start starts cmd without limits, they are only implemented on Linux. The process cannot be
+// stopped before it runs, so setup is called right after it is started.
+func Start(cmd *exec.Cmd, cgroupDir string, l Limits, setup func(pid int)) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if setup != nil {
+		setup(cmd.Process.Pid)
+	}
+	return nil
+}
@@ -1,5 +1,13 @@
 package priority
 
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
 type Level int
 
 const (
@@ -8,3 +16,122 @@ const (
 	Normal
 	High
 )
+
+var ErrUnsupported = errors.New("not supported on this platform")
+
+// MaxCPUs bounds the CPU numbers of an affinity, it is the size of the Linux cpu_set_t.
+const MaxCPUs = 1024
+
+// ParseLevel parses low, belowNormal, normal or high (case-insensitive).
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(strings.TrimSpace(s))) {
+	case "low", "idle":
+		return Low, nil
+	case "belownormal":
+		return BelowNormal, nil
+	case "normal":
+		return Normal, nil
+	case "high":
+		return High, nil
+	default:
+		return Normal, fmt.Errorf("invalid priority %q: expected low, belowNormal, normal or high", s)
+	}
+}
+
+// Nice returns the Unix nice value of the level.
+func Nice(level Level) int {
+	switch level {
+	case Low:
+		return 19
+	case BelowNormal:
+		return 10
+	case High:
+		return -10
+	default:
+		return 0
+	}
+}
+
+type IOClass int
+
+const (
+	IOClassNone IOClass = iota
+	IOClassRealtime
+	IOClassBestEffort
+	IOClassIdle
+)
+
+// IOPriority is a Linux I/O scheduling class with its level (0 is the highest, 7 the lowest).
+type IOPriority struct {
+	Class IOClass
+	Level int
+}
+
+// ParseIOPriority parses "<class>[:<level>]" where class is rt, be or idle,
+// e.g. "be:4" or "idle". The level defaults to 4 and is ignored for idle.
+func ParseIOPriority(s string) (IOPriority, error) {
+	className, levelText, hasLevel := strings.Cut(strings.TrimSpace(s), ":")
+	var p IOPriority
+	switch strings.ToLower(strings.TrimSpace(className)) {
+	case "rt", "realtime":
+		p.Class = IOClassRealtime
+	case "be", "best-effort", "besteffort":
+		p.Class = IOClassBestEffort
+	case "idle":
+		p.Class = IOClassIdle
+	default:
+		return p, fmt.Errorf("invalid io priority %q: expected rt, be or idle", s)
+	}
+
+	p.Level = 4
+	if hasLevel {
+		level, err := strconv.Atoi(strings.TrimSpace(levelText))
+		if err != nil || level < 0 || level > 7 {
+			return p, fmt.Errorf("invalid io priority %q: level must be between 0 and 7", s)
+		}
+		p.Level = level
+	}
+	if p.Class == IOClassIdle {
+		p.Level = 0
+	}
+	return p, nil
+}
+
+// ParseCPUList parses a CPU list such as "0-3,6" into sorted, unique CPU numbers below MaxCPUs.
+func ParseCPUList(s string) ([]int, error) {
+	seen := make(map[int]struct{})
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid cpu list %q: bad cpu %q", s, first)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(strings.TrimSpace(last))
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid cpu list %q: bad range %q", s, part)
+			}
+		}
+		if end >= MaxCPUs {
+			return nil, fmt.Errorf("invalid cpu list %q: cpu %d is out of range, cpus must be below %d", s, end, MaxCPUs)
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			seen[cpu] = struct{}{}
+		}
+	}
+	if len(seen) == 0 {
+		return nil, fmt.Errorf("invalid cpu list %q: no cpus", s)
+	}
+
+	cpus := make([]int, 0, len(seen))
+	for cpu := range seen {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
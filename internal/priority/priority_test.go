@@ -0,0 +1,52 @@
+package priority
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []int
+		wantErr bool
+	}{
+		{input: "0", want: []int{0}},
+		{input: "0-3", want: []int{0, 1, 2, 3}},
+		{input: "0-3,6", want: []int{0, 1, 2, 3, 6}},
+		{input: " 6 , 2-3 ", want: []int{2, 3, 6}},
+		{input: "1,1,0-1", want: []int{0, 1}},
+		{input: "2-2", want: []int{2}},
+		{input: "0,,1", want: []int{0, 1}},
+		{input: "1023", want: []int{1023}},
+		{input: "1020-1023", want: []int{1020, 1021, 1022, 1023}},
+		{input: "", wantErr: true},
+		{input: ",", wantErr: true},
+		{input: "a", wantErr: true},
+		{input: "-1", wantErr: true},
+		{input: "3-1", wantErr: true},
+		{input: "1-", wantErr: true},
+		{input: "1-x", wantErr: true},
+		{input: "1024", wantErr: true},
+		{input: "0-1024", wantErr: true},
+		{input: "0-4000000000", wantErr: true},
+		{input: "99999999999999999999", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseCPUList(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseCPUList(%q) = %v, want an error", tt.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseCPUList(%q) failed: %v", tt.input, err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ParseCPUList(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
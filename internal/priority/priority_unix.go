@@ -1,4 +1,4 @@
-//go:build !windows
+//go:build !windows && !linux
 
 package priority
 
@@ -7,16 +7,5 @@ import (
 )
 
 func Set(pid int, level Level) error {
-	var nice int
-	switch level {
-	case Low:
-		nice = 19
-	case BelowNormal:
-		nice = 10
-	case High:
-		nice = -10
-	default:
-		nice = 0
-	}
-	return syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice)
+	return syscall.Setpriority(syscall.PRIO_PROCESS, pid, Nice(level))
 }
@@ -0,0 +1,64 @@
+//go:build linux
+
+package priority
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// Set sets the nice value of every thread of the process, setpriority(2) only changes one thread on Linux.
+func Set(pid int, level Level) error {
+	return forEachThread(pid, func(tid int) error {
+		return unix.Setpriority(unix.PRIO_PROCESS, tid, Nice(level))
+	})
+}
+
+// SetIOPriority sets the I/O priority of every thread of the process.
+func SetIOPriority(pid int, p IOPriority) error {
+	ioprio := uintptr(p.Class)<<ioprioClassShift | uintptr(p.Level)
+	return forEachThread(pid, func(tid int) error {
+		_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprio)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+}
+
+// SetAffinity pins every thread of the process to the given CPUs.
+func SetAffinity(pid int, cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return forEachThread(pid, func(tid int) error {
+		return unix.SchedSetaffinity(tid, &set)
+	})
+}
+
+// forEachThread applies fn to all threads of pid, since these settings are per thread on Linux.
+func forEachThread(pid int, fn func(tid int) error) error {
+	entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return fn(pid)
+	}
+	for _, entry := range entries {
+		tid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if err := fn(tid); err != nil {
+			return fmt.Errorf("thread %d: %w", tid, err)
+		}
+	}
+	return nil
+}
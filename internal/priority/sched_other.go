@@ -0,0 +1,11 @@
+//go:build !linux
+
+package priority
+
+func SetIOPriority(pid int, p IOPriority) error {
+	return ErrUnsupported
+}
+
+func SetAffinity(pid int, cpus []int) error {
+	return ErrUnsupported
+}
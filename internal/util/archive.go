@@ -0,0 +1,399 @@
+package util
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type ArchiveFormat string
+
+const (
+	FormatTarGz  ArchiveFormat = "tar.gz"
+	FormatTarZst ArchiveFormat = "tar.zst"
+	FormatZip    ArchiveFormat = "zip"
+	// FormatDir writes the entries to a plain directory.
+	FormatDir ArchiveFormat = "dir"
+)
+
+var ArchiveFormats = []ArchiveFormat{FormatTarGz, FormatTarZst, FormatZip, FormatDir}
+
+func ParseArchiveFormat(s string) (ArchiveFormat, error) {
+	format := ArchiveFormat(strings.ToLower(strings.TrimPrefix(strings.TrimSpace(s), ".")))
+	switch format {
+	case FormatTarGz, FormatTarZst, FormatZip, FormatDir:
+		return format, nil
+	case "tgz":
+		return FormatTarGz, nil
+	case "tzst":
+		return FormatTarZst, nil
+	default:
+		return "", fmt.Errorf("invalid archive format %q: expected tar.gz, tar.zst, zip or dir", s)
+	}
+}
+
+// Extension returns the file name suffix of the format, empty for dir.
+func (f ArchiveFormat) Extension() string {
+	if f == FormatDir {
+		return ""
+	}
+	return "." + string(f)
+}
+
+// DetectArchiveFormat returns the format of an existing archive from its name, or dir for a directory.
+func DetectArchiveFormat(archivePath string) (ArchiveFormat, error) {
+	if info, err := os.Stat(archivePath); err == nil && info.IsDir() {
+		return FormatDir, nil
+	}
+	for _, format := range ArchiveFormats {
+		if format != FormatDir && strings.HasSuffix(archivePath, format.Extension()) {
+			return format, nil
+		}
+	}
+	if strings.HasSuffix(archivePath, ".tgz") {
+		return FormatTarGz, nil
+	}
+	return "", fmt.Errorf("unknown archive format of %s", archivePath)
+}
+
+// ArchiveWriter adds entries to an archive of any format.
+type ArchiveWriter interface {
+	// WriteEntry adds a file or directory from disk. The content of files is also written to tee when it is not nil.
+	WriteEntry(entry ArchiveEntry, tee io.Writer) error
+	// WriteFile adds a regular file with the given content.
+	WriteFile(name string, mode os.FileMode, content []byte) error
+	Close() error
+}
+
+// NewArchiveWriter creates archivePath in the format. The compression level is the native level
+// of the format (gzip and zip 1-9, zstd 1-22), 0 selects the best compression. Every entry gets modTime.
+func NewArchiveWriter(archivePath string, format ArchiveFormat, level int, modTime time.Time) (ArchiveWriter, error) {
+	if format == FormatDir {
+		if err := os.RemoveAll(archivePath); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(archivePath, 0755); err != nil {
+			return nil, err
+		}
+		return &dirArchiveWriter{root: archivePath, modTime: modTime}, nil
+	}
+
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatTarGz:
+		if level == 0 {
+			level = gzip.BestCompression
+		}
+		// The gzip header is left without name and time, so it does not depend on the host.
+		compressor, err := gzip.NewWriterLevel(file, level)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("invalid gzip level %d: %v", level, err)
+		}
+		return &tarArchiveWriter{file: file, compressor: compressor, tw: tar.NewWriter(compressor), modTime: modTime}, nil
+	case FormatTarZst:
+		zstdLevel := zstd.SpeedBestCompression
+		if level != 0 {
+			zstdLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		compressor, err := zstd.NewWriter(file, zstd.WithEncoderLevel(zstdLevel), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to create zstd writer: %v", err)
+		}
+		return &tarArchiveWriter{file: file, compressor: compressor, tw: tar.NewWriter(compressor), modTime: modTime}, nil
+	case FormatZip:
+		if level == 0 {
+			level = flate.BestCompression
+		}
+		if level < flate.HuffmanOnly || level > flate.BestCompression {
+			file.Close()
+			return nil, fmt.Errorf("invalid zip level %d", level)
+		}
+		zw := zip.NewWriter(file)
+		zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		})
+		return &zipArchiveWriter{file: file, zw: zw, modTime: modTime}, nil
+	default:
+		file.Close()
+		return nil, fmt.Errorf("unsupported archive format %q", format)
+	}
+}
+
+type tarArchiveWriter struct {
+	file       *os.File
+	compressor io.WriteCloser
+	tw         *tar.Writer
+	modTime    time.Time
+}
+
+func (w *tarArchiveWriter) WriteEntry(entry ArchiveEntry, tee io.Writer) error {
+	return WriteTarEntry(w.tw, entry, w.modTime, tee)
+}
+
+func (w *tarArchiveWriter) WriteFile(name string, mode os.FileMode, content []byte) error {
+	header := &tar.Header{Name: name, Size: int64(len(content)), Mode: int64(mode.Perm()), ModTime: w.modTime, Typeflag: tar.TypeReg}
+	if err := w.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := w.tw.Write(content)
+	return err
+}
+
+func (w *tarArchiveWriter) Close() error {
+	defer w.file.Close()
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	if err := w.compressor.Close(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+type zipArchiveWriter struct {
+	file    *os.File
+	zw      *zip.Writer
+	modTime time.Time
+}
+
+func (w *zipArchiveWriter) header(name string, mode os.FileMode) *zip.FileHeader {
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: w.modTime}
+	header.SetMode(mode)
+	return header
+}
+
+func (w *zipArchiveWriter) WriteEntry(entry ArchiveEntry, tee io.Writer) error {
+	if entry.Dir {
+		header := w.header(entry.Name+"/", entry.Mode|fs.ModeDir)
+		header.Method = zip.Store
+		_, err := w.zw.CreateHeader(header)
+		return err
+	}
+
+	file, err := os.Open(entry.Source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	dst, err := w.zw.CreateHeader(w.header(entry.Name, entry.Mode))
+	if err != nil {
+		return err
+	}
+	if tee != nil {
+		dst = io.MultiWriter(dst, tee)
+	}
+	_, err = io.Copy(dst, file)
+	return err
+}
+
+func (w *zipArchiveWriter) WriteFile(name string, mode os.FileMode, content []byte) error {
+	dst, err := w.zw.CreateHeader(w.header(name, mode))
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(content)
+	return err
+}
+
+func (w *zipArchiveWriter) Close() error {
+	defer w.file.Close()
+	if err := w.zw.Close(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+type dirArchiveWriter struct {
+	root    string
+	modTime time.Time
+	dirs    []string
+}
+
+func (w *dirArchiveWriter) WriteEntry(entry ArchiveEntry, tee io.Writer) error {
+	target := filepath.Join(w.root, filepath.FromSlash(entry.Name))
+	if entry.Dir {
+		if err := os.MkdirAll(target, entry.Mode.Perm()); err != nil {
+			return err
+		}
+		// Directory times change while their content is written, so they are set on Close.
+		w.dirs = append(w.dirs, target)
+		return nil
+	}
+
+	src, err := os.Open(entry.Source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return w.writeFile(target, entry.Mode, func(dst io.Writer) error {
+		if tee != nil {
+			dst = io.MultiWriter(dst, tee)
+		}
+		_, err := io.Copy(dst, src)
+		return err
+	})
+}
+
+func (w *dirArchiveWriter) WriteFile(name string, mode os.FileMode, content []byte) error {
+	return w.writeFile(filepath.Join(w.root, filepath.FromSlash(name)), mode, func(dst io.Writer) error {
+		_, err := dst.Write(content)
+		return err
+	})
+}
+
+func (w *dirArchiveWriter) writeFile(target string, mode os.FileMode, write func(io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(target, mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, w.modTime, w.modTime)
+}
+
+func (w *dirArchiveWriter) Close() error {
+	for i := len(w.dirs) - 1; i >= 0; i-- {
+		if err := os.Chtimes(w.dirs[i], w.modTime, w.modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WalkArchive calls fn for every regular file of an archive written by NewArchiveWriter, with
+// its slash-separated clean name and permission bits.
+func WalkArchive(archivePath string, fn func(name string, mode os.FileMode, r io.Reader) error) error {
+	format, err := DetectArchiveFormat(archivePath)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case FormatDir:
+		return filepath.Walk(archivePath, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(archivePath, filePath)
+			if err != nil {
+				return err
+			}
+			file, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			return fn(filepath.ToSlash(rel), info.Mode().Perm(), file)
+		})
+	case FormatZip:
+		reader, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		for _, file := range reader.File {
+			if !file.Mode().IsRegular() {
+				continue
+			}
+			rc, err := file.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(path.Clean(file.Name), file.Mode().Perm(), rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var decompressed io.Reader
+	if format == FormatTarZst {
+		decoder, err := zstd.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer decoder.Close()
+		decompressed = decoder
+	} else {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		decompressed = gzipReader
+	}
+
+	tarReader := tar.NewReader(decompressed)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(path.Clean(header.Name), fs.FileMode(header.Mode).Perm(), tarReader); err != nil {
+			return err
+		}
+	}
+}
+
+// ExtractArchive writes the regular files of an archive under dir. Entries escaping dir, such as
+// absolute names or names with "..", are rejected.
+func ExtractArchive(archivePath, dir string) error {
+	return WalkArchive(archivePath, func(name string, mode os.FileMode, r io.Reader) error {
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return fmt.Errorf("archive entry %q is outside of the archive", name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, r); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	})
+}
@@ -0,0 +1,131 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name             string
+		oldName, newName string
+		oldText, newText string
+		want             string
+	}{
+		{
+			name:    "equal",
+			oldName: "a/x", newName: "b/x",
+			oldText: "one\ntwo\n", newText: "one\ntwo\n",
+			want: "",
+		},
+		{
+			name:    "new file",
+			oldName: "", newName: "b/x",
+			oldText: "", newText: "one\ntwo\n",
+			want: "--- /dev/null\n+++ b/x\n@@ -0,0 +1,2 @@\n+one\n+two\n",
+		},
+		{
+			name:    "removed file",
+			oldName: "a/x", newName: "",
+			oldText: "one\n", newText: "",
+			want: "--- a/x\n+++ /dev/null\n@@ -1 +0,0 @@\n-one\n",
+		},
+		{
+			name:    "changed line with context",
+			oldName: "a/x", newName: "b/x",
+			oldText: "1\n2\n3\n4\n5\n6\n7\n8\n9\n", newText: "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			want: "--- a/x\n+++ b/x\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			name:    "distant changes are separate hunks",
+			oldName: "a/x", newName: "b/x",
+			oldText: "a\n1\n2\n3\n4\n5\n6\n7\n8\nb\n", newText: "A\n1\n2\n3\n4\n5\n6\n7\n8\nB\n",
+			want: "--- a/x\n+++ b/x\n@@ -1,4 +1,4 @@\n-a\n+A\n 1\n 2\n 3\n@@ -7,4 +7,4 @@\n 6\n 7\n 8\n-b\n+B\n",
+		},
+		{
+			name:    "close changes share a hunk",
+			oldName: "a/x", newName: "b/x",
+			oldText: "a\n1\n2\n3\nb\n", newText: "A\n1\n2\n3\nB\n",
+			want: "--- a/x\n+++ b/x\n@@ -1,5 +1,5 @@\n-a\n+A\n 1\n 2\n 3\n-b\n+B\n",
+		},
+		{
+			name:    "missing newline at end of file",
+			oldName: "a/x", newName: "b/x",
+			oldText: "one\ntwo", newText: "one\ntwo\n",
+			want: "--- a/x\n+++ b/x\n@@ -1,2 +1,2 @@\n one\n-two\n\\ No newline at end of file\n+two\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := UnifiedDiff(tt.oldName, tt.newName, []byte(tt.oldText), []byte(tt.newText))
+			if got != tt.want {
+				t.Errorf("UnifiedDiff() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMyersDiff(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  string
+		edits int
+	}{
+		{name: "empty", a: "", b: "", edits: 0},
+		{name: "insert all", a: "", b: "abc", edits: 3},
+		{name: "delete all", a: "abc", b: "", edits: 3},
+		{name: "equal", a: "abc", b: "abc", edits: 0},
+		{name: "replace middle", a: "abc", b: "axc", edits: 2},
+		{name: "classic example", a: "abcabba", b: "cbabac", edits: 5},
+		{name: "interleaved", a: "xaybzc", b: "abc", edits: 3},
+		{name: "move", a: "abcd", b: "bcda", edits: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := strings.Split(tt.a, ""), strings.Split(tt.b, "")
+			ops := myersDiff(a, b)
+
+			var gotA, gotB []string
+			edits := 0
+			for _, op := range ops {
+				if op.kind != '+' {
+					gotA = append(gotA, op.line)
+				}
+				if op.kind != '-' {
+					gotB = append(gotB, op.line)
+				}
+				if op.kind != ' ' {
+					edits++
+				}
+			}
+			if strings.Join(gotA, "") != tt.a || strings.Join(gotB, "") != tt.b {
+				t.Fatalf("myersDiff(%q, %q) rebuilds %q and %q", tt.a, tt.b, strings.Join(gotA, ""), strings.Join(gotB, ""))
+			}
+			if edits != tt.edits {
+				t.Errorf("myersDiff(%q, %q) has %d edits, want %d", tt.a, tt.b, edits, tt.edits)
+			}
+		})
+	}
+}
+
+func TestMyersDiffFallsBackToReplacement(t *testing.T) {
+	a := make([]string, maxDiffEdits)
+	b := make([]string, maxDiffEdits)
+	for i := range a {
+		a[i] = "a"
+		b[i] = "b"
+	}
+	ops := myersDiff(a, b)
+	if len(ops) != len(a)+len(b) {
+		t.Fatalf("myersDiff() returned %d ops, want %d", len(ops), len(a)+len(b))
+	}
+	for i, op := range ops {
+		want := byte('-')
+		if i >= len(a) {
+			want = '+'
+		}
+		if op.kind != want {
+			t.Fatalf("op %d is %q, want %q", i, op.kind, want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package util
+
+import "strings"
+
+// ClosestMatch returns the candidate closest to name by edit distance, ignoring case,
+// or "" when none is close enough to be a plausible typo.
+func ClosestMatch(name string, candidates []string) string {
+	lower := strings.ToLower(name)
+	best, bestDist := "", -1
+	for _, candidate := range candidates {
+		dist := levenshtein(lower, strings.ToLower(candidate))
+		if bestDist == -1 || dist < bestDist {
+			best, bestDist = candidate, dist
+		}
+	}
+
+	threshold := len(name) / 3
+	if threshold < 2 {
+		threshold = 2
+	}
+	if bestDist == -1 || bestDist > threshold {
+		return ""
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
@@ -2,89 +2,138 @@ package util
 
 import (
 	"archive/tar"
+	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func AddToTar(tarWriter *tar.Writer, filePath, archivePath string) error {
-	info, err := os.Stat(filePath)
-	if err != nil {
-		return err
-	}
-	if info.IsDir() {
-		return addDirToTar(tarWriter, filePath, archivePath)
-	}
-	return addFileToTar(tarWriter, filePath, archivePath)
+// DefaultArchiveTime is the mtime of archive entries when SOURCE_DATE_EPOCH is not set,
+// the earliest time a zip archive can store.
+var DefaultArchiveTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ArchiveEntry is a file or directory added to an archive.
+type ArchiveEntry struct {
+	// Source is the path on disk.
+	Source string
+	// Name is the slash-separated path in the archive, without a trailing slash.
+	Name string
+	Dir  bool
+	Mode os.FileMode
+	Size int64
 }
 
-func addFileToTar(tarWriter *tar.Writer, filePath, archivePath string) error {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return err
+// SourceDateEpoch returns the time in SOURCE_DATE_EPOCH, or DefaultArchiveTime when it is not set.
+func SourceDateEpoch() (time.Time, error) {
+	raw := strings.TrimSpace(os.Getenv("SOURCE_DATE_EPOCH"))
+	if raw == "" {
+		return DefaultArchiveTime, nil
 	}
-	defer file.Close()
-
-	stat, err := file.Stat()
+	seconds, err := strconv.ParseInt(raw, 10, 64)
 	if err != nil {
-		return err
-	}
-
-	header := &tar.Header{
-		Name:    archivePath,
-		Size:    stat.Size(),
-		Mode:    int64(stat.Mode()),
-		ModTime: stat.ModTime(),
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %v", raw, err)
 	}
-
-	if err := tarWriter.WriteHeader(header); err != nil {
-		return err
-	}
-
-	_, err = io.Copy(tarWriter, file)
-	return err
+	return time.Unix(seconds, 0).UTC(), nil
 }
 
-func addDirToTar(tarWriter *tar.Writer, dirPath, archiveDirName string) error {
-	if archiveDirName != "" {
-		rootHeader := &tar.Header{
-			Name:     archiveDirName + "/",
-			Mode:     0755,
-			ModTime:  time.Now(),
-			Typeflag: tar.TypeDir,
-		}
-		if err := tarWriter.WriteHeader(rootHeader); err != nil {
-			return err
-		}
+// NormalizeMode returns 0755 for directories and executable files and 0644 for other files,
+// so archives do not depend on the umask of the host.
+func NormalizeMode(mode os.FileMode) os.FileMode {
+	if mode.IsDir() || mode&0111 != 0 {
+		return 0755
 	}
+	return 0644
+}
 
-	return filepath.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		relPath, err := filepath.Rel(dirPath, filePath)
+// CollectArchiveEntries walks the mapping of source paths to archive paths and returns every
+// directory and file sorted by name, with normalized modes. Symlinks are followed.
+func CollectArchiveEntries(mappingPaths map[string]string) ([]ArchiveEntry, error) {
+	var entries []ArchiveEntry
+	for src, dst := range mappingPaths {
+		dst = strings.Trim(path.Clean(filepath.ToSlash(dst)), "/")
+		err := filepath.Walk(src, func(filePath string, _ os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := os.Stat(filePath)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src, filePath)
+			if err != nil {
+				return err
+			}
+			name := path.Join(dst, filepath.ToSlash(rel))
+			if name == "." || name == "" {
+				return nil
+			}
+			entry := ArchiveEntry{Source: filePath, Name: name, Dir: info.IsDir(), Mode: NormalizeMode(info.Mode())}
+			if !entry.Dir {
+				entry.Size = info.Size()
+			}
+			entries = append(entries, entry)
+			return nil
+		})
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("failed to walk %s: %v", src, err)
 		}
+	}
 
-		if relPath == "." {
-			return nil
+	slices.SortFunc(entries, func(a, b ArchiveEntry) int { return strings.Compare(a.Name, b.Name) })
+	deduped := entries[:0]
+	for i, entry := range entries {
+		if i > 0 && entries[i-1].Name == entry.Name {
+			prev := entries[i-1]
+			if (prev.Dir && entry.Dir) || prev.Source == entry.Source {
+				continue
+			}
+			return nil, fmt.Errorf("%s and %s are both mapped to %s", prev.Source, entry.Source, entry.Name)
 		}
+		deduped = append(deduped, entry)
+	}
+	return deduped, nil
+}
 
-		archivePath := path.Join(archiveDirName, relPath)
+// WriteTarEntry writes an entry with the given mtime, root ownership and no user or group
+// names. The content of files is also written to tee when it is not nil.
+func WriteTarEntry(tarWriter *tar.Writer, entry ArchiveEntry, modTime time.Time, tee io.Writer) error {
+	header := &tar.Header{
+		Name:    entry.Name,
+		Mode:    int64(entry.Mode.Perm()),
+		ModTime: modTime,
+	}
+	if entry.Dir {
+		header.Name += "/"
+		header.Typeflag = tar.TypeDir
+		return tarWriter.WriteHeader(header)
+	}
 
-		if info.IsDir() {
-			header := &tar.Header{
-				Name:     archivePath + "/",
-				Mode:     int64(info.Mode()),
-				Typeflag: tar.TypeDir,
-			}
-			return tarWriter.WriteHeader(header)
-		}
+	file, err := os.Open(entry.Source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-		return addFileToTar(tarWriter, filePath, archivePath)
-	})
+	header.Typeflag = tar.TypeReg
+	header.Size = entry.Size
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	var dst io.Writer = tarWriter
+	if tee != nil {
+		dst = io.MultiWriter(tarWriter, tee)
+	}
+	written, err := io.Copy(dst, file)
+	if err != nil {
+		return err
+	}
+	if written != entry.Size {
+		return fmt.Errorf("%s changed size while archiving", entry.Source)
+	}
+	return nil
 }
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 
@@ -15,6 +16,9 @@ var Default = Build
 var Aliases = map[string]any{
 	"buildcc": BuildWithCustomConfig,
 	"startcc": StartWithCustomConfig,
+
+	"export-procfile": ExportProcfile,
+	"export-compose":  ExportCompose,
 }
 
 var (
@@ -27,28 +31,62 @@ var (
 
 	customExportProjectName = "gomake"
 	customExportBuildOpt    *mageutil.BuildOptions
+
+	// customProtocolOpt configures the proto layout and optional protoc plugins, e.g.
+	// &mageutil.ProtocolOptions{Plugins: map[string][]string{"gateway": {"grpc-gateway"}}}
+	customProtocolOpt *mageutil.ProtocolOptions
+
+	// customK8sOutputDir writes the manifests of `mage k8s` to a committed directory instead of
+	// _output/k8s, e.g. "deploy/k8s". When nil, K8S_OUTPUT_DIR is used.
+	customK8sOutputDir *string
 )
 
+// parseProfile consumes `--profile <name>` after a target without arguments. It reports whether
+// it did, the target must then exit because mage would run the arguments as targets.
+func parseProfile(target string) bool {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		return false
+	}
+	rest := mageutil.ParseProfileArgs(args[1:])
+	if len(rest) == len(args)-1 {
+		return false
+	}
+	if len(rest) != 0 {
+		mageutil.PrintRed("unknown " + target + " argument " + rest[0])
+		os.Exit(1)
+	}
+	return true
+}
+
 // Build support specifical binary build.
 //
 // Example: `mage build openim-api openim-rpc-user seq`
-func Build() {
+//
+// Targets reading start-config.yml accept `--profile <name>` to overlay
+// start-config.<name>.yml, GOMAKE_PROFILE selects it for all targets.
+//
+// Ctrl-C or a mage timeout, e.g. `mage -t 10m build`, kills the compilers and the processes they started.
+func Build(ctx context.Context) {
 	flag.Parse()
 	bin := flag.Args()
 	if len(bin) != 0 {
-		bin = bin[1:]
+		bin = mageutil.ParseProfileArgs(bin[1:])
 	}
 
 	mageutil.WithSpinner("Building binaries...", func() {
-		mageutil.Build(bin, nil, nil)
+		mageutil.BuildContext(ctx, bin, nil, nil)
 	})
+	// The remaining arguments are not mage targets.
+	os.Exit(0)
 }
 
-func BuildWithCustomConfig() {
+func BuildWithCustomConfig(ctx context.Context) {
 	flag.Parse()
 	bin := flag.Args()
 	if len(bin) != 0 {
-		bin = bin[1:]
+		bin = mageutil.ParseProfileArgs(bin[1:])
 	}
 
 	config := &mageutil.PathOptions{
@@ -59,43 +97,47 @@ func BuildWithCustomConfig() {
 	}
 
 	mageutil.WithSpinner("Building binaries with custom config...", func() {
-		mageutil.Build(bin, config, nil)
+		mageutil.BuildContext(ctx, bin, config, nil)
 	})
+	// The remaining arguments are not mage targets.
+	os.Exit(0)
 }
 
-func Start() {
+func Start(ctx context.Context) {
+	flag.Parse()
+	bin := flag.Args()
+	if len(bin) != 0 {
+		bin = mageutil.ParseProfileArgs(bin[1:])
+	}
+
 	mageutil.InitForSSC()
-	err := setMaxOpenFiles()
+	err := mageutil.SetMaxOpenFiles()
 	if err != nil {
 		mageutil.PrintRed("setMaxOpenFiles failed " + err.Error())
 		os.Exit(1)
 	}
 
+	mageutil.WithSpinner("Starting tools and services...", func() {
+		mageutil.StartToolsAndServicesContext(ctx, bin, nil)
+	})
+	// The remaining arguments are not mage targets.
+	os.Exit(0)
+}
+
+func StartWithCustomConfig(ctx context.Context) {
 	flag.Parse()
 	bin := flag.Args()
 	if len(bin) != 0 {
-		bin = bin[1:]
+		bin = mageutil.ParseProfileArgs(bin[1:])
 	}
 
-	mageutil.WithSpinner("Starting tools and services...", func() {
-		mageutil.StartToolsAndServices(bin, nil)
-	})
-}
-
-func StartWithCustomConfig() {
 	mageutil.InitForSSC()
-	err := setMaxOpenFiles()
+	err := mageutil.SetMaxOpenFiles()
 	if err != nil {
 		mageutil.PrintRed("setMaxOpenFiles failed " + err.Error())
 		os.Exit(1)
 	}
 
-	flag.Parse()
-	bin := flag.Args()
-	if len(bin) != 0 {
-		bin = bin[1:]
-	}
-
 	config := &mageutil.PathOptions{
 		RootDir:   &customRootDir,   // default is "."(current directory)
 		OutputDir: &customOutputDir, // default is "_output"
@@ -103,32 +145,252 @@ func StartWithCustomConfig() {
 	}
 
 	mageutil.WithSpinner("Starting tools and services with custom config...", func() {
-		mageutil.StartToolsAndServices(bin, config)
+		mageutil.StartToolsAndServicesContext(ctx, bin, config)
 	})
+	// The remaining arguments are not mage targets.
+	os.Exit(0)
 }
 
 func Stop() {
-	mageutil.WithSpinner("Checking service status...", mageutil.StopAndCheckBinaries)
+	profiled := parseProfile("stop")
+	if err := mageutil.WithSpinnerE("Checking service status...", mageutil.StopAndCheckBinariesE); err != nil {
+		mageutil.PrintRed("stop failed " + err.Error())
+		os.Exit(1)
+	}
+	if profiled {
+		// The remaining arguments are not mage targets.
+		os.Exit(0)
+	}
 }
 
 func Check() {
+	profiled := parseProfile("check")
 	mageutil.WithSpinner("Checking service status...", mageutil.CheckAndReportBinariesStatus)
+	if profiled {
+		// The remaining arguments are not mage targets.
+		os.Exit(0)
+	}
 }
 
-func Protocol() {
-	mageutil.WithSpinnerE("Generating protocol artifacts...", mageutil.Protocol)
+// Protocol generates Go code for the protos under the protocol roots, pkg/protocol by default,
+// with protoc-gen-go and protoc-gen-go-grpc. Unchanged packages are skipped.
+//
+// Example: `mage protocol`, `mage protocol --check` fails when the generated code is out of date,
+// `mage protocol lint`, `mage protocol breaking origin/main` compares the protos with a git ref, HEAD by default.
+func Protocol(ctx context.Context) {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = args[1:]
+	}
+
+	const usage = "usage: mage protocol [--check] | lint | breaking [ref]"
+	command := ""
+	run := func() error { return mageutil.ProtocolContext(ctx, customProtocolOpt) }
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "--check":
+		run = func() error { return mageutil.CheckProtocolContext(ctx, customProtocolOpt) }
+	case len(args) == 1 && args[0] == "lint":
+		command = " lint"
+		run = func() error { return mageutil.LintProtocol(customProtocolOpt) }
+	case len(args) <= 2 && args[0] == "breaking":
+		command = " breaking"
+		ref := "HEAD"
+		if len(args) == 2 {
+			ref = args[1]
+		}
+		run = func() error { return mageutil.CheckProtocolBreakingContext(ctx, customProtocolOpt, ref) }
+	default:
+		mageutil.PrintRed("unknown protocol argument " + args[len(args)-1] + ", " + usage)
+		os.Exit(1)
+	}
+
+	var err error
+	if command == "" {
+		err = mageutil.WithSpinnerE("Generating protocol artifacts...", run)
+	} else {
+		err = run()
+	}
+	if err != nil {
+		mageutil.PrintRed("protocol" + command + " failed " + err.Error())
+		os.Exit(1)
+	}
+	// The remaining arguments are not mage targets.
+	os.Exit(0)
+}
+
+// Config manages start-config.yml.
+//
+// Example: `mage config validate`, `mage config sync`
+func Config() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = mageutil.ParseProfileArgs(args[1:])
+	}
+	if len(args) == 0 {
+		mageutil.PrintRed("missing config command, usage: mage config validate|sync")
+		os.Exit(1)
+	}
+
+	var err error
+	switch args[0] {
+	case "validate":
+		err = mageutil.ValidateStartConfig()
+	case "sync":
+		err = mageutil.SyncStartConfig()
+	default:
+		mageutil.PrintRed("unknown config command " + args[0] + ", usage: mage config validate|sync")
+		os.Exit(1)
+	}
+	if err != nil {
+		mageutil.PrintRed("config " + args[0] + " failed " + err.Error())
+		os.Exit(1)
+	}
+	// The remaining arguments are not mage targets.
+	os.Exit(0)
 }
 
-func Export() {
+func Export(ctx context.Context) {
+	profiled := parseProfile("export")
 	exportOpt := &mageutil.ExportOptions{
 		ProjectName: &customExportProjectName,
 		BuildOpt:    customExportBuildOpt,
 	}
 	err := mageutil.WithSpinnerE("Exporting launcher archive...", func() error {
-		return mageutil.ExportMageLauncherArchived(nil, exportOpt)
+		return mageutil.ExportMageLauncherArchivedContext(ctx, nil, exportOpt)
 	})
 	if err != nil {
 		mageutil.PrintRed("export failed " + err.Error())
 		os.Exit(1)
 	}
+	if profiled {
+		// The remaining arguments are not mage targets.
+		os.Exit(0)
+	}
+}
+
+// Verify checks an export archive against SHA256SUMS, its signature and its MANIFEST. An archive
+// with neither a checksum nor a signature fails unless --manifest-only is passed.
+//
+// Example: `mage verify _output/export/exported_gomake_linux_amd64.tar.gz`
+func Verify() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = args[1:]
+	}
+	manifestOnly := false
+	if len(args) != 0 && args[0] == "--manifest-only" {
+		manifestOnly = true
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		mageutil.PrintRed("missing archive, usage: mage verify [--manifest-only] <archive>")
+		os.Exit(1)
+	}
+	for _, archivePath := range args {
+		if err := mageutil.VerifyArchive(archivePath, manifestOnly); err != nil {
+			mageutil.PrintRed("verify failed " + err.Error())
+			os.Exit(1)
+		}
+	}
+	// The remaining arguments are not mage targets.
+	os.Exit(0)
+}
+
+// K8s generates Kubernetes manifests for the services in start-config.yml.
+func K8s() {
+	profiled := parseProfile("k8s")
+	k8sOpt := &mageutil.K8sOptions{
+		ProjectName: &customExportProjectName,
+		OutputDir:   customK8sOutputDir,
+	}
+	err := mageutil.WithSpinnerE("Generating Kubernetes manifests...", func() error {
+		return mageutil.GenerateK8sManifests(k8sOpt)
+	})
+	if err != nil {
+		mageutil.PrintRed("k8s failed " + err.Error())
+		os.Exit(1)
+	}
+	if profiled {
+		// The remaining arguments are not mage targets.
+		os.Exit(0)
+	}
+}
+
+// Image builds OCI image layout tarballs for the services, without a Docker daemon.
+//
+// Set IMAGE_BUNDLE=true for one image with all binaries and the standalone launcher as entrypoint.
+func Image(ctx context.Context) {
+	profiled := parseProfile("image")
+	imageOpt := &mageutil.ImageOptions{
+		ProjectName: &customExportProjectName,
+		BuildOpt:    customExportBuildOpt,
+	}
+	err := mageutil.WithSpinnerE("Building images...", func() error {
+		return mageutil.BuildImagesContext(ctx, imageOpt)
+	})
+	if err != nil {
+		mageutil.PrintRed("image failed " + err.Error())
+		os.Exit(1)
+	}
+	if profiled {
+		// The remaining arguments are not mage targets.
+		os.Exit(0)
+	}
+}
+
+// Systemd generates systemd units for the services, or runs install, enable, disable, start, stop,
+// restart or status on them, e.g. `mage systemd install`.
+func Systemd(ctx context.Context) {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = mageutil.ParseProfileArgs(args[1:])
+	}
+	action := "generate"
+	if len(args) != 0 {
+		action = args[0]
+	}
+
+	systemdOpt := &mageutil.SystemdOptions{
+		ProjectName: &customExportProjectName,
+	}
+	if err := mageutil.SystemdCommandContext(ctx, action, systemdOpt); err != nil {
+		mageutil.PrintRed("systemd " + action + " failed " + err.Error())
+		os.Exit(1)
+	}
+	// The remaining arguments are not mage targets.
+	os.Exit(0)
+}
+
+// ExportProcfile writes a Procfile for foreman or overmind from start-config.yml.
+func ExportProcfile() {
+	profiled := parseProfile("export-procfile")
+	if err := mageutil.ExportProcfile(); err != nil {
+		mageutil.PrintRed("export-procfile failed " + err.Error())
+		os.Exit(1)
+	}
+	if profiled {
+		// The remaining arguments are not mage targets.
+		os.Exit(0)
+	}
+}
+
+// ExportCompose writes a compose.yaml running the linux binaries from start-config.yml.
+func ExportCompose() {
+	profiled := parseProfile("export-compose")
+	composeOpt := &mageutil.ComposeOptions{
+		ProjectName: &customExportProjectName,
+	}
+	if err := mageutil.ExportCompose(composeOpt); err != nil {
+		mageutil.PrintRed("export-compose failed " + err.Error())
+		os.Exit(1)
+	}
+	if profiled {
+		// The remaining arguments are not mage targets.
+		os.Exit(0)
+	}
 }
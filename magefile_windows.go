@@ -1,10 +0,0 @@
-// Windows
-
-//go:build mage && windows
-// +build mage,windows
-
-package main
-
-func setMaxOpenFiles() error {
-	return nil
-}
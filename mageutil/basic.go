@@ -1,15 +1,20 @@
 package mageutil
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/openimsdk/gomake/internal/util"
 )
 
+const ForegroundEnv = "GOMAKE_FOREGROUND"
+
 func CheckAndReportBinariesStatus() {
 	InitForSSC()
 	err := CheckBinariesRunning()
@@ -18,6 +23,12 @@ func CheckAndReportBinariesStatus() {
 		PrintRedNoTimeStamp(err.Error())
 		os.Exit(1)
 	}
+	err = attemptCheckBinariesPorts()
+	if err != nil {
+		PrintRed("Some services are not listening on the expected ports:")
+		PrintRedNoTimeStamp(err.Error())
+		os.Exit(1)
+	}
 	PrintGreen("All services are running normally.")
 	PrintBlue("Display details of the ports listened to by the service:")
 	time.Sleep(1 * time.Second)
@@ -30,14 +41,20 @@ func CheckAndReportBinariesStatus() {
 }
 
 func StopAndCheckBinaries() {
+	if err := StopAndCheckBinariesE(); err != nil {
+		PrintRed(err.Error())
+	}
+}
+
+// StopAndCheckBinariesE stops the services and fails when some are still running afterwards.
+func StopAndCheckBinariesE() error {
 	InitForSSC()
 	KillExistBinaries()
-	err := attemptCheckBinaries()
-	if err != nil {
-		PrintRed(err.Error())
-		return
+	if err := attemptCheckBinaries(); err != nil {
+		return err
 	}
 	PrintGreen("All services have been stopped")
+	return nil
 }
 
 func attemptCheckBinaries() error {
@@ -57,7 +74,29 @@ func attemptCheckBinaries() error {
 	return fmt.Errorf("already waited for %d seconds, some services have still not stopped", maxAttempts)
 }
 
+// attemptCheckBinariesPorts gives freshly started services some time to bind their ports.
+func attemptCheckBinariesPorts() error {
+	const maxAttempts = 5
+	var err error
+	for i := 0; i < maxAttempts; i++ {
+		err = CheckBinariesPorts()
+		if err == nil {
+			return nil
+		}
+		if i < maxAttempts-1 {
+			time.Sleep(1 * time.Second)
+		}
+	}
+	return err
+}
+
 func StartToolsAndServices(binaries []string, pathOpts *PathOptions) {
+	StartToolsAndServicesContext(context.Background(), binaries, pathOpts)
+}
+
+// StartToolsAndServicesContext is StartToolsAndServices, the tools are killed when ctx is done.
+// The services are not, they keep running after mage exits.
+func StartToolsAndServicesContext(ctx context.Context, binaries []string, pathOpts *PathOptions) {
 	if pathOpts != nil {
 		if err := UpdateGlobalPaths(pathOpts); err != nil {
 			PrintRed("Failed to update paths: " + err.Error())
@@ -95,7 +134,7 @@ func StartToolsAndServices(binaries []string, pathOpts *PathOptions) {
 
 		if len(toolsBinaries) > 0 {
 			PrintBlue("Starting specified tools...")
-			if err := StartTools(toolsBinaries...); err != nil {
+			if err := StartToolsContext(ctx, toolsBinaries...); err != nil {
 				PrintRed("Some specified tools failed to start:")
 				PrintRedNoTimeStamp(err.Error())
 				return
@@ -110,6 +149,11 @@ func StartToolsAndServices(binaries []string, pathOpts *PathOptions) {
 				PrintRed("Some services running, details are as follows, abort start " + err.Error())
 				return
 			}
+			if err := CheckPortsAvailable(resolveBinariesToStart(cmdBinaries...)); err != nil {
+				PrintRed("Some ports required by services are not available, details are as follows, abort start")
+				PrintRedNoTimeStamp(err.Error())
+				return
+			}
 			err = StartBinaries(cmdBinaries...)
 			if err != nil {
 				PrintRed("Failed to start specified binaries:")
@@ -117,12 +161,13 @@ func StartToolsAndServices(binaries []string, pathOpts *PathOptions) {
 				return
 			}
 			CheckAndReportBinariesStatus()
+			waitInForeground()
 		}
 		return
 	}
 
 	PrintBlue("Starting tools primarily involves component verification and other preparatory tasks.")
-	if err := StartTools(); err != nil {
+	if err := StartToolsContext(ctx); err != nil {
 		PrintRed("Some tools failed to start, details are as follows, abort start")
 		PrintRedNoTimeStamp(err.Error())
 		return
@@ -135,6 +180,11 @@ func StartToolsAndServices(binaries []string, pathOpts *PathOptions) {
 		PrintRed("Some services running, details are as follows, abort start " + err.Error())
 		return
 	}
+	if err := CheckPortsAvailable(resolveBinariesToStart()); err != nil {
+		PrintRed("Some ports required by services are not available, details are as follows, abort start")
+		PrintRedNoTimeStamp(err.Error())
+		return
+	}
 	err = StartBinaries()
 	if err != nil {
 		PrintRed("Failed to start all binaries")
@@ -142,6 +192,31 @@ func StartToolsAndServices(binaries []string, pathOpts *PathOptions) {
 		return
 	}
 	CheckAndReportBinariesStatus()
+	waitInForeground()
+}
+
+// waitInForeground keeps the launcher running when GOMAKE_FOREGROUND is set, until it
+// receives SIGINT or SIGTERM and stops the services. This lets it be the main process of a container.
+func waitInForeground() {
+	foreground := util.ResolveEnvOption[bool](ForegroundEnv)
+	if foreground == nil || !*foreground {
+		return
+	}
+
+	StopSpinner()
+	PrintBlue("Running in foreground, waiting for a stop signal...")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	signal.Stop(signals)
+
+	PrintBlue(fmt.Sprintf("Received %s, stopping services...", sig))
+	KillExistBinaries()
+	if err := attemptCheckBinaries(); err != nil {
+		PrintRed(err.Error())
+		return
+	}
+	PrintGreen("All services have been stopped")
 }
 
 func isExecutableFile(filePath string) bool {
@@ -166,12 +241,12 @@ func isExecutableFile(filePath string) bool {
 }
 
 func Build(binaries []string, pathOpts *PathOptions, buildOpt *BuildOptions) {
-	resolvedBuildOpt := ResolveBuildOptions(buildOpt, &BuildOptions{
-		CgoEnabled: util.ResolveEnvOption[string]("CGO_ENABLED"),
-		Release:    util.ResolveEnvOption[bool]("RELEASE"),
-		Compress:   util.ResolveEnvOption[bool]("COMPRESS"),
-		Platforms:  util.ResolveEnvOption[[]string]("PLATFORMS"),
-	})
+	BuildContext(context.Background(), binaries, pathOpts, buildOpt)
+}
+
+// BuildContext is Build, the compilers are killed when ctx is done, e.g. on Ctrl-C or mage -t.
+func BuildContext(ctx context.Context, binaries []string, pathOpts *PathOptions, buildOpt *BuildOptions) {
+	resolvedBuildOpt := resolveBuildOptionsFromEnv(buildOpt)
 
 	if _, err := os.Stat(StartConfigFile); err == nil {
 		InitForSSC()
@@ -184,16 +259,19 @@ func Build(binaries []string, pathOpts *PathOptions, buildOpt *BuildOptions) {
 		}
 	}
 
+	platforms := resolvePlatforms(resolvedBuildOpt)
+	if err := validatePlatforms(ctx, platforms); err != nil {
+		PrintRed(err.Error())
+		os.Exit(1)
+	}
+
 	compileBinaries := getBinaries(binaries)
 	if cgoEnabled := resolvedBuildOpt.GetCgoEnabled(); cgoEnabled != "" {
 		PrintBlue(fmt.Sprintf("CGO_ENABLED %s", cgoEnabled))
 	}
-	platforms := resolvedBuildOpt.GetPlatforms()
-	if len(platforms) == 0 {
-		platforms = []string{DetectPlatform()}
-	}
 	for _, platform := range platforms {
-		CompileForPlatform(resolvedBuildOpt, platform, compileBinaries)
+		CompileForPlatformContext(ctx, resolvedBuildOpt, platform, compileBinaries)
 	}
 	PrintGreen("All specified binaries under cmd and tools were successfully compiled.")
+	refreshDevExports()
 }
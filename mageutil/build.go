@@ -1,11 +1,15 @@
 package mageutil
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 
 	"github.com/openimsdk/gomake/internal/priority"
@@ -15,8 +19,10 @@ import (
 type BuildOptions struct {
 	CgoEnabled *string
 	Release    *bool
-	Compress   *bool
-	Platforms  *[]string
+	// TrimPath builds with -trimpath without the other release flags, export always sets it.
+	TrimPath  *bool
+	Compress  *bool
+	Platforms *[]string
 }
 
 func (opt *BuildOptions) GetCgoEnabled() string {
@@ -27,6 +33,18 @@ func (opt *BuildOptions) GetRelease() bool {
 	return util.NilAsZero(util.NilAsZero(opt).Release)
 }
 
+func (opt *BuildOptions) GetTrimPath() bool {
+	return util.NilAsZero(util.NilAsZero(opt).TrimPath)
+}
+
+// withTrimPath returns a copy of the options that builds with -trimpath, for reproducible exports.
+func withTrimPath(buildOpt *BuildOptions) *BuildOptions {
+	trimmed := util.NilAsZero(buildOpt)
+	trimPath := true
+	trimmed.TrimPath = &trimPath
+	return &trimmed
+}
+
 func (opt *BuildOptions) GetCompress() bool {
 	return util.NilAsZero(util.NilAsZero(opt).Compress)
 }
@@ -36,6 +54,11 @@ func (opt *BuildOptions) GetPlatforms() []string {
 }
 
 func CompileForPlatform(buildOpt *BuildOptions, platform string, compileBinaries []string) {
+	CompileForPlatformContext(context.Background(), buildOpt, platform, compileBinaries)
+}
+
+// CompileForPlatformContext is CompileForPlatform, the compilers are killed when ctx is done.
+func CompileForPlatformContext(ctx context.Context, buildOpt *BuildOptions, platform string, compileBinaries []string) {
 	var cmdBinaries, toolsBinaries []string
 
 	toolsPrefix := Paths.ToolsDir
@@ -77,23 +100,24 @@ func CompileForPlatform(buildOpt *BuildOptions, platform string, compileBinaries
 
 	if len(cmdBinaries) > 0 {
 		PrintBlue(fmt.Sprintf("Compiling cmd binaries for %s...", platform))
-		cmdCompiledDirs = compileDir(buildOpt, filepath.Join(Paths.Root, Paths.SrcDir), Paths.OutputBinPath, platform, cmdBinaries)
+		cmdCompiledDirs = compileDir(ctx, buildOpt, filepath.Join(Paths.Root, Paths.SrcDir), Paths.OutputBinPath, platform, cmdBinaries)
 	}
 
 	if len(toolsBinaries) > 0 {
 		PrintBlue(fmt.Sprintf("Compiling tools binaries for %s...", platform))
-		toolsCompiledDirs = compileDir(buildOpt, filepath.Join(Paths.Root, Paths.ToolsDir), Paths.OutputBinToolPath, platform, toolsBinaries)
+		toolsCompiledDirs = compileDir(ctx, buildOpt, filepath.Join(Paths.Root, Paths.ToolsDir), Paths.OutputBinToolPath, platform, toolsBinaries)
 	}
 
 	createStartConfigYML(cmdCompiledDirs, toolsCompiledDirs)
 }
 
-func compileDir(buildOpt *BuildOptions, sourceDir, outputBase, platform string, compileBinaries []string) []string {
+func compileDir(ctx context.Context, buildOpt *BuildOptions, sourceDir, outputBase, platform string, compileBinaries []string) []string {
 	releaseEnabled := buildOpt.GetRelease()
+	trimPathEnabled := releaseEnabled || buildOpt.GetTrimPath()
 	compressEnabled := buildOpt.GetCompress()
 	cgoEnabled := buildOpt.GetCgoEnabled()
 
-	PrintBlue(fmt.Sprintf("Build flags: RELEASE=%t, COMPRESS=%t", releaseEnabled, compressEnabled))
+	PrintBlue(fmt.Sprintf("Build flags: RELEASE=%t, TRIMPATH=%t, COMPRESS=%t", releaseEnabled, trimPathEnabled, compressEnabled))
 
 	if info, err := os.Stat(sourceDir); err != nil {
 		if os.IsNotExist(err) {
@@ -212,9 +236,12 @@ func compileDir(buildOpt *BuildOptions, sourceDir, outputBase, platform string,
 				PrintBlue(fmt.Sprintf("Compiling dir: %s for platform: %s binary: %s ...", dirName, platform, outputFileName))
 
 				buildArgs := []string{"build", "-o", outputPath}
+				if trimPathEnabled {
+					buildArgs = append(buildArgs, "-trimpath")
+				}
 				if releaseEnabled {
 					PrintBlue("Building in release mode with optimizations...")
-					buildArgs = append(buildArgs, "-trimpath", "-ldflags", "-s -w")
+					buildArgs = append(buildArgs, "-ldflags", "-s -w")
 				}
 				buildArgs = append(buildArgs, buildTarget)
 
@@ -222,7 +249,7 @@ func compileDir(buildOpt *BuildOptions, sourceDir, outputBase, platform string,
 					WithArgs(buildArgs...).
 					WithEnv(env).
 					WithPriority(priority.Low).
-					Run()
+					RunContext(ctx)
 
 				os.Chdir(originalDir)
 
@@ -235,11 +262,11 @@ func compileDir(buildOpt *BuildOptions, sourceDir, outputBase, platform string,
 
 				if compressEnabled {
 					PrintBlue(fmt.Sprintf("Compressing %s with UPX...", outputFileName))
-					if err := NewCmd("upx").WithArgs("--lzma", outputPath).WithPriority(priority.Low).Run(); err != nil {
-						PrintYellow(fmt.Sprintf("UPX compression failed for %s (non-fatal): %v", outputFileName, err))
-					} else {
-						PrintGreen(fmt.Sprintf("Successfully compressed with UPX: %s", outputFileName))
+					if err := NewCmd("upx").WithArgs("--lzma", outputPath).WithPriority(priority.Low).RunContext(ctx); err != nil {
+						PrintRed("Compression aborted. " + fmt.Sprintf("failed to compress %s with UPX: %v", outputFileName, err))
+						os.Exit(1)
 					}
+					PrintGreen(fmt.Sprintf("Successfully compressed with UPX: %s", outputFileName))
 				}
 
 				res <- dirName
@@ -258,7 +285,7 @@ func createStartConfigYML(cmdDirs, toolsDirs []string) {
 	configPath := filepath.Join(Paths.Root, StartConfigFile)
 
 	if _, err := os.Stat(configPath); !os.IsNotExist(err) {
-		PrintBlue("start-config.yml already exists, skipping creation.")
+		PrintBlue("start-config.yml already exists, skipping creation. Run `mage config sync` to add new binaries.")
 		return
 	}
 
@@ -281,6 +308,17 @@ func createStartConfigYML(cmdDirs, toolsDirs []string) {
 	PrintGreen("start-config.yml created successfully.")
 }
 
+// resolveBuildOptionsFromEnv fills the options not set in code from CGO_ENABLED, RELEASE, TRIMPATH, COMPRESS and PLATFORMS.
+func resolveBuildOptionsFromEnv(buildOpt *BuildOptions) *BuildOptions {
+	return ResolveBuildOptions(buildOpt, &BuildOptions{
+		CgoEnabled: util.ResolveEnvOption[string]("CGO_ENABLED"),
+		Release:    util.ResolveEnvOption[bool]("RELEASE"),
+		TrimPath:   util.ResolveEnvOption[bool]("TRIMPATH"),
+		Compress:   util.ResolveEnvOption[bool]("COMPRESS"),
+		Platforms:  util.ResolveEnvOption[[]string]("PLATFORMS"),
+	})
+}
+
 func ResolveBuildOptions(codeOpt *BuildOptions, envOpt *BuildOptions) *BuildOptions {
 	fromCode := BuildOptions{}
 	if codeOpt != nil {
@@ -295,11 +333,62 @@ func ResolveBuildOptions(codeOpt *BuildOptions, envOpt *BuildOptions) *BuildOpti
 	return &BuildOptions{
 		CgoEnabled: util.CoalescePtr(fromCode.CgoEnabled, fromEnv.CgoEnabled),
 		Release:    util.CoalescePtr(fromCode.Release, fromEnv.Release),
+		TrimPath:   util.CoalescePtr(fromCode.TrimPath, fromEnv.TrimPath),
 		Compress:   util.CoalescePtr(fromCode.Compress, fromEnv.Compress),
 		Platforms:  util.CoalescePtr(fromCode.Platforms, fromEnv.Platforms),
 	}
 }
 
+// validatePlatforms checks that every platform is an os_arch pair supported by `go tool dist list`.
+func validatePlatforms(ctx context.Context, platforms []string) error {
+	if len(platforms) == 0 {
+		return fmt.Errorf("no platforms specified")
+	}
+	supported, err := goDistList(ctx)
+	if err != nil {
+		return err
+	}
+	for _, platform := range platforms {
+		targetOS, targetArch, found := strings.Cut(platform, "_")
+		if !found || targetOS == "" || targetArch == "" {
+			return fmt.Errorf("invalid platform %q: expected os_arch, e.g. linux_amd64", platform)
+		}
+		if !slices.Contains(supported, targetOS+"/"+targetArch) {
+			return fmt.Errorf("unsupported platform %q: not listed by `go tool dist list`", platform)
+		}
+	}
+	return nil
+}
+
+var goDistPlatforms struct {
+	sync.Mutex
+	list []string
+}
+
+// goDistList returns the platforms of `go tool dist list`, caching the first successful run.
+func goDistList(ctx context.Context) ([]string, error) {
+	goDistPlatforms.Lock()
+	defer goDistPlatforms.Unlock()
+	if goDistPlatforms.list != nil {
+		return goDistPlatforms.list, nil
+	}
+	var output bytes.Buffer
+	if err := NewCmd("go").WithArgs("tool", "dist", "list").WithStdout(&output).RunContext(ctx); err != nil {
+		return nil, fmt.Errorf("failed to run go tool dist list: %v", err)
+	}
+	goDistPlatforms.list = strings.Fields(output.String())
+	return goDistPlatforms.list, nil
+}
+
+// resolvePlatforms returns the platforms of resolved build options, defaulting to the host.
+func resolvePlatforms(resolvedBuildOpt *BuildOptions) []string {
+	platforms := resolvedBuildOpt.GetPlatforms()
+	if len(platforms) == 0 {
+		platforms = []string{DetectPlatform()}
+	}
+	return platforms
+}
+
 func getBinaries(binaries []string) []string {
 	if len(binaries) > 0 {
 		return resolveRequestedBinaries(binaries)
@@ -1,24 +1,36 @@
 package mageutil
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
+	"github.com/openimsdk/gomake/internal/limits"
 	"github.com/openimsdk/gomake/internal/priority"
 )
 
+// deadlineKillMargin is how long before the deadline of its context RunContext kills a command.
+const deadlineKillMargin = 200 * time.Millisecond
+
 type Cmd struct {
 	name string
 	args []string
 
-	env map[string]string
-	dir string
+	env     map[string]string
+	dir     string
+	timeout time.Duration
+
+	priority    *priority.Level
+	ioPriority  *priority.IOPriority
+	cpuAffinity []int
 
-	priority *priority.Level
+	limits    limits.Limits
+	cgroupDir string
 
 	stdin  io.Reader
 	stdout io.Writer
@@ -52,11 +64,34 @@ func (c *Cmd) WithDir(dir string) *Cmd {
 	return c
 }
 
+// WithTimeout kills the command when it runs longer than timeout, with RunContext.
+func (c *Cmd) WithTimeout(timeout time.Duration) *Cmd {
+	c.timeout = timeout
+	return c
+}
+
+// WithLimits starts the process with the resource limits, in cgroupDir when cgroup limits are set.
+func (c *Cmd) WithLimits(cgroupDir string, l limits.Limits) *Cmd {
+	c.cgroupDir = cgroupDir
+	c.limits = l
+	return c
+}
+
 func (c *Cmd) WithPriority(priority priority.Level) *Cmd {
 	c.priority = &priority
 	return c
 }
 
+func (c *Cmd) WithIOPriority(ioPriority priority.IOPriority) *Cmd {
+	c.ioPriority = &ioPriority
+	return c
+}
+
+func (c *Cmd) WithCPUAffinity(cpus []int) *Cmd {
+	c.cpuAffinity = append([]int(nil), cpus...)
+	return c
+}
+
 func (c *Cmd) WithStdin(stdin io.Reader) *Cmd {
 	c.stdin = stdin
 	return c
@@ -79,9 +114,105 @@ func (c *Cmd) WithStdio(stdin io.Reader, stdout, stderr io.Writer) *Cmd {
 	return c
 }
 
+func (c *Cmd) String() string {
+	return strings.Join(append([]string{c.name}, c.args...), " ")
+}
+
+// Start starts the command with its scheduling settings without waiting for it.
+// The process is not tied to a context, it may outlive mage like the services do.
+func (c *Cmd) Start() (*exec.Cmd, error) {
+	execCmd, err := c.command()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.start(execCmd); err != nil {
+		return nil, err
+	}
+	return execCmd, nil
+}
+
 func (c *Cmd) Run() error {
+	return c.RunContext(context.Background())
+}
+
+// RunContext runs the command in its own process group and waits for it. When ctx is done or the
+// timeout expires, the whole group is killed, so that the processes started by the command do not
+// outlive it. A command that cannot be cancelled stays in the process group of mage, it receives
+// Ctrl-C from the terminal like before.
+func (c *Cmd) RunContext(ctx context.Context) error {
+	// mage exits as soon as the deadline of `mage -t` passes, without waiting for the target, so
+	// the group is killed slightly ahead of the deadline of ctx.
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-deadlineKillMargin))
+		defer cancel()
+	}
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	if ctx.Done() == nil {
+		execCmd, err := c.Start()
+		if err != nil {
+			return err
+		}
+		return execCmd.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s not started: %v", c.name, err)
+	}
+
+	execCmd, err := c.command()
+	if err != nil {
+		return err
+	}
+	setProcessGroup(execCmd)
+	if err := c.start(execCmd); err != nil {
+		return err
+	}
+	group, err := newProcessGroup(execCmd)
+	if err != nil {
+		_ = execCmd.Process.Kill()
+		_ = execCmd.Wait()
+		return fmt.Errorf("failed to create the process group of %s: %v", c.name, err)
+	}
+	defer group.release()
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := group.kill(); err != nil {
+				PrintYellow(fmt.Sprintf("Failed to kill %s: %v", c.name, err))
+			}
+		case <-done:
+		}
+	}()
+	err = execCmd.Wait()
+	close(done)
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%s was killed: %v", c.name, ctx.Err())
+	}
+	return err
+}
+
+// start starts the process with the resource limits and scheduling settings in place. On Linux
+// they are applied while the process is stopped after exec, before it starts threads or children.
+func (c *Cmd) start(execCmd *exec.Cmd) error {
+	if c.limits.IsZero() && !c.hasPriority() {
+		return execCmd.Start()
+	}
+	var setup func(pid int)
+	if c.hasPriority() {
+		setup = c.applyPriority
+	}
+	return limits.Start(execCmd, c.cgroupDir, c.limits, setup)
+}
+
+func (c *Cmd) command() (*exec.Cmd, error) {
 	if strings.TrimSpace(c.name) == "" {
-		return errors.New("command is empty")
+		return nil, errors.New("command is empty")
 	}
 
 	execCmd := exec.Command(c.name, c.args...)
@@ -94,13 +225,7 @@ func (c *Cmd) Run() error {
 	execCmd.Stdin = stdin
 	execCmd.Stdout = stdout
 	execCmd.Stderr = stderr
-
-	if err := execCmd.Start(); err != nil {
-		return err
-	}
-
-	c.applyPriority(execCmd.Process.Pid)
-	return execCmd.Wait()
+	return execCmd, nil
 }
 
 func (c *Cmd) resolveIO() (io.Reader, io.Writer, io.Writer) {
@@ -119,12 +244,25 @@ func (c *Cmd) resolveIO() (io.Reader, io.Writer, io.Writer) {
 	return stdin, stdout, stderr
 }
 
+func (c *Cmd) hasPriority() bool {
+	return c.priority != nil || c.ioPriority != nil || len(c.cpuAffinity) > 0
+}
+
 func (c *Cmd) applyPriority(pid int) {
-	if c.priority == nil {
-		return
+	if c.priority != nil {
+		if err := priority.Set(pid, *c.priority); err != nil {
+			PrintYellow(fmt.Sprintf("Failed to set priority for PID %d: %v", pid, err))
+		}
+	}
+	if c.ioPriority != nil {
+		if err := priority.SetIOPriority(pid, *c.ioPriority); err != nil {
+			PrintYellow(fmt.Sprintf("Failed to set I/O priority for PID %d: %v", pid, err))
+		}
 	}
-	if err := priority.Set(pid, *c.priority); err != nil {
-		PrintYellow(fmt.Sprintf("Failed to set priority for PID %d: %v", pid, err))
+	if len(c.cpuAffinity) > 0 {
+		if err := priority.SetAffinity(pid, c.cpuAffinity); err != nil {
+			PrintYellow(fmt.Sprintf("Failed to set CPU affinity for PID %d: %v", pid, err))
+		}
 	}
 }
 
@@ -0,0 +1,36 @@
+//go:build !windows
+
+package mageutil
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// processGroup is the process group led by a command started with setProcessGroup.
+type processGroup struct {
+	pgid int
+}
+
+// setProcessGroup makes the command the leader of a new process group.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func newProcessGroup(cmd *exec.Cmd) (*processGroup, error) {
+	return &processGroup{pgid: cmd.Process.Pid}, nil
+}
+
+// kill sends SIGKILL to every process of the group.
+func (g *processGroup) kill() error {
+	if err := syscall.Kill(-g.pgid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+	return nil
+}
+
+func (g *processGroup) release() {}
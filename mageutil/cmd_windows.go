@@ -0,0 +1,93 @@
+//go:build windows
+
+package mageutil
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// processGroup is a job object holding a command and the processes it starts.
+type processGroup struct {
+	job windows.Handle
+}
+
+// setProcessGroup starts the command suspended, so that it cannot start a process before it is
+// assigned to the job object.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= windows.CREATE_SUSPENDED
+}
+
+// newProcessGroup assigns the suspended command to a new job object and resumes it.
+func newProcessGroup(cmd *exec.Cmd) (*processGroup, error) {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(cmd.Process.Pid))
+	if err != nil {
+		windows.CloseHandle(job)
+		return nil, err
+	}
+	defer windows.CloseHandle(process)
+	if err := windows.AssignProcessToJobObject(job, process); err != nil {
+		windows.CloseHandle(job)
+		return nil, err
+	}
+	if err := resumeProcess(uint32(cmd.Process.Pid)); err != nil {
+		windows.CloseHandle(job)
+		return nil, err
+	}
+	return &processGroup{job: job}, nil
+}
+
+// resumeProcess resumes the threads of a process started with CREATE_SUSPENDED.
+func resumeProcess(pid uint32) error {
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPTHREAD, 0)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(snapshot)
+
+	resumed := false
+	entry := windows.ThreadEntry32{Size: uint32(unsafe.Sizeof(windows.ThreadEntry32{}))}
+	for err = windows.Thread32First(snapshot, &entry); err == nil; err = windows.Thread32Next(snapshot, &entry) {
+		if entry.OwnerProcessID != pid {
+			continue
+		}
+		thread, err := windows.OpenThread(windows.THREAD_SUSPEND_RESUME, false, entry.ThreadID)
+		if err != nil {
+			return err
+		}
+		_, err = windows.ResumeThread(thread)
+		windows.CloseHandle(thread)
+		if err != nil {
+			return err
+		}
+		resumed = true
+	}
+	if !errors.Is(err, windows.ERROR_NO_MORE_FILES) {
+		return err
+	}
+	if !resumed {
+		return fmt.Errorf("process %d has no thread to resume", pid)
+	}
+	return nil
+}
+
+// kill terminates every process of the job.
+func (g *processGroup) kill() error {
+	return windows.TerminateJobObject(g.job, 1)
+}
+
+func (g *processGroup) release() {
+	windows.CloseHandle(g.job)
+}
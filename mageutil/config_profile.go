@@ -0,0 +1,174 @@
+package mageutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const ProfileEnv = "GOMAKE_PROFILE"
+
+// Profile selects the start config overlay. When empty, GOMAKE_PROFILE is used.
+var Profile string
+
+var envReferencePattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// ActiveProfile returns the selected profile name, or "" for the base config only.
+func ActiveProfile() string {
+	if profile := strings.TrimSpace(Profile); profile != "" {
+		return profile
+	}
+	return strings.TrimSpace(os.Getenv(ProfileEnv))
+}
+
+// ParseProfileArgs extracts "--profile <name>" or "--profile=<name>" from target
+// arguments, sets Profile and returns the remaining arguments.
+func ParseProfileArgs(args []string) []string {
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name := strings.TrimLeft(arg, "-")
+		if !strings.HasPrefix(arg, "-") || !strings.HasPrefix(name, "profile") {
+			rest = append(rest, arg)
+			continue
+		}
+		switch {
+		case name == "profile" && i+1 < len(args):
+			Profile = args[i+1]
+			i++
+		case strings.HasPrefix(name, "profile="):
+			Profile = strings.TrimPrefix(name, "profile=")
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return rest
+}
+
+// ProfileConfigFile returns the overlay file of a profile, e.g. start-config.ci.yml.
+func ProfileConfigFile(baseFile, profile string) string {
+	ext := filepath.Ext(baseFile)
+	return strings.TrimSuffix(baseFile, ext) + "." + profile + ext
+}
+
+func readConfigDocument(path string) (*yaml.Node, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(root.Content) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return root.Content[0], nil
+}
+
+// markConfigSource records the file every node of a document was read from.
+func markConfigSource(node *yaml.Node, file string, sources map[*yaml.Node]string) {
+	sources[node] = file
+	for _, child := range node.Content {
+		markConfigSource(child, file, sources)
+	}
+}
+
+// mergeConfigNodes deep-merges the overlay mapping into base. Mappings are merged key
+// by key, any other value replaces the base value and a null value removes the key.
+// Service entries written as a plain count are expanded so they merge with mappings.
+func mergeConfigNodes(base, overlay *yaml.Node, path string, sources map[*yaml.Node]string) {
+	if base.Kind != yaml.MappingNode || overlay.Kind != yaml.MappingNode {
+		*base = *overlay
+		return
+	}
+
+	for i := 0; i+1 < len(overlay.Content); i += 2 {
+		key, value := overlay.Content[i], overlay.Content[i+1]
+
+		index := -1
+		for j := 0; j+1 < len(base.Content); j += 2 {
+			if base.Content[j].Value == key.Value {
+				index = j
+				break
+			}
+		}
+
+		if value.Kind == yaml.ScalarNode && value.ShortTag() == "!!null" {
+			if index >= 0 {
+				base.Content = append(base.Content[:index], base.Content[index+2:]...)
+			}
+			continue
+		}
+		if index < 0 {
+			base.Content = append(base.Content, key, value)
+			continue
+		}
+
+		current := base.Content[index+1]
+		if path == "serviceBinaries" && current.Kind != value.Kind {
+			expandServiceCount(current, sources)
+			expandServiceCount(value, sources)
+		}
+		if current.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+			mergeConfigNodes(current, value, joinConfigPath(path, key.Value), sources)
+			continue
+		}
+		base.Content[index+1] = value
+	}
+}
+
+// expandServiceCount rewrites a "name: 2" service entry as "name: {count: 2}" in place.
+func expandServiceCount(node *yaml.Node, sources map[*yaml.Node]string) {
+	if node.Kind != yaml.ScalarNode {
+		return
+	}
+	count := *node
+	key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "count", Line: node.Line, Column: node.Column}
+	sources[&count] = sources[node]
+	sources[key] = sources[node]
+	*node = yaml.Node{
+		Kind:    yaml.MappingNode,
+		Tag:     "!!map",
+		Line:    node.Line,
+		Column:  node.Column,
+		Content: []*yaml.Node{key, &count},
+	}
+}
+
+// interpolateEnv replaces ${NAME} and ${NAME:-default} in scalar values.
+func interpolateEnv(node *yaml.Node, issues *[]ConfigIssue) {
+	if node.Kind != yaml.ScalarNode {
+		for _, child := range node.Content {
+			interpolateEnv(child, issues)
+		}
+		return
+	}
+	if !strings.Contains(node.Value, "${") {
+		return
+	}
+
+	node.Value = envReferencePattern.ReplaceAllStringFunc(node.Value, func(ref string) string {
+		match := envReferencePattern.FindStringSubmatch(ref)
+		value, ok := os.LookupEnv(match[1])
+		if ok && value != "" {
+			return value
+		}
+		if match[2] != "" {
+			return match[3]
+		}
+		if !ok {
+			*issues = append(*issues, newConfigIssue(node, false, "environment variable %s is not set", match[1]))
+		}
+		return value
+	})
+	if node.Style == 0 {
+		// Let plain scalars resolve again, so "${COUNT}" can decode as a number.
+		node.Tag = ""
+	}
+}
@@ -0,0 +1,103 @@
+package mageutil
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func testConfigMapping(t *testing.T, source string) *yaml.Node {
+	t.Helper()
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(source), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc.Content[0]
+}
+
+func TestMergeConfigNodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		overlay string
+		want    string
+	}{
+		{
+			name:    "scalar replaces",
+			base:    "maxFileDescriptors: 10000\n",
+			overlay: "maxFileDescriptors: 20000\n",
+			want:    "maxFileDescriptors: 20000\n",
+		},
+		{
+			name:    "new key is appended",
+			base:    "a: 1\n",
+			overlay: "b: 2\n",
+			want:    "a: 1\nb: 2\n",
+		},
+		{
+			name:    "null removes",
+			base:    "a: 1\nb: 2\n",
+			overlay: "a: null\n",
+			want:    "b: 2\n",
+		},
+		{
+			name:    "null of a missing key is ignored",
+			base:    "a: 1\n",
+			overlay: "b: ~\n",
+			want:    "a: 1\n",
+		},
+		{
+			name:    "mappings merge key by key",
+			base:    "serviceBinaries:\n  api:\n    count: 1\n    priority: low\n",
+			overlay: "serviceBinaries:\n  api:\n    count: 3\n",
+			want:    "serviceBinaries:\n  api:\n    count: 3\n    priority: low\n",
+		},
+		{
+			name:    "sequences replace",
+			base:    "toolBinaries:\n  - a\n  - b\n",
+			overlay: "toolBinaries:\n  - c\n",
+			want:    "toolBinaries:\n  - c\n",
+		},
+		{
+			name:    "mapping replaces a scalar outside of services",
+			base:    "limits: none\n",
+			overlay: "limits:\n  nofile: 1024\n",
+			want:    "limits:\n  nofile: 1024\n",
+		},
+		{
+			name:    "service count merges with an overlay mapping",
+			base:    "serviceBinaries:\n  api: 2\n",
+			overlay: "serviceBinaries:\n  api:\n    priority: high\n",
+			want:    "serviceBinaries:\n  api:\n    count: 2\n    priority: high\n",
+		},
+		{
+			name:    "overlay service count merges with a base mapping",
+			base:    "serviceBinaries:\n  api:\n    count: 1\n    priority: high\n",
+			overlay: "serviceBinaries:\n  api: 4\n",
+			want:    "serviceBinaries:\n  api:\n    count: 4\n    priority: high\n",
+		},
+		{
+			name:    "service removed by null",
+			base:    "serviceBinaries:\n  api: 1\n  rpc: 1\n",
+			overlay: "serviceBinaries:\n  rpc: null\n",
+			want:    "serviceBinaries:\n  api: 1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := testConfigMapping(t, tt.base)
+			mergeConfigNodes(base, testConfigMapping(t, tt.overlay), "", make(map[*yaml.Node]string))
+
+			var got strings.Builder
+			encoder := yaml.NewEncoder(&got)
+			encoder.SetIndent(2)
+			if err := encoder.Encode(base); err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("mergeConfigNodes() =\n%s\nwant\n%s", got.String(), tt.want)
+			}
+		})
+	}
+}
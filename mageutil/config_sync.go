@@ -0,0 +1,204 @@
+package mageutil
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SyncStartConfig adds the services and tools found under the cmd and tools directories
+// to start-config.yml and removes entries whose directory no longer exists. Existing
+// counts, settings, comments and ordering are preserved. A section whose source directory
+// is missing, e.g. in an exported archive, is left alone.
+func SyncStartConfig() error {
+	srcDir := filepath.Join(Paths.Root, Paths.SrcDir)
+	services, servicesFound, err := discoverBinaryNames(srcDir)
+	if err != nil {
+		return err
+	}
+	toolsDir := filepath.Join(Paths.Root, Paths.ToolsDir)
+	tools, toolsFound, err := discoverBinaryNames(toolsDir)
+	if err != nil {
+		return err
+	}
+	if !servicesFound && !toolsFound {
+		return fmt.Errorf("neither %s nor %s exists, there is nothing to sync", srcDir, toolsDir)
+	}
+
+	configPath := filepath.Join(Paths.Root, StartConfigFile)
+	content, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		createStartConfigYML(services, tools)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", configPath, err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", configPath, err)
+	}
+	if len(root.Content) == 0 {
+		root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	doc := root.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: top level is not a mapping", configPath)
+	}
+
+	var addedServices, removedServices, addedTools, removedTools []string
+	if servicesFound {
+		servicesNode := ensureMappingValue(doc, "serviceBinaries", yaml.MappingNode)
+		addedServices, removedServices = syncServiceEntries(servicesNode, services)
+	} else {
+		PrintYellow(fmt.Sprintf("%s not found, keeping the services of %s", srcDir, StartConfigFile))
+	}
+	if toolsFound {
+		toolsNode := ensureMappingValue(doc, "toolBinaries", yaml.SequenceNode)
+		addedTools, removedTools = syncToolEntries(toolsNode, tools)
+	} else {
+		PrintYellow(fmt.Sprintf("%s not found, keeping the tools of %s", toolsDir, StartConfigFile))
+	}
+
+	if len(addedServices)+len(removedServices)+len(addedTools)+len(removedTools) == 0 {
+		PrintGreen(fmt.Sprintf("%s is up to date.", StartConfigFile))
+		return nil
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&root); err != nil {
+		return fmt.Errorf("failed to encode %s: %v", configPath, err)
+	}
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("failed to encode %s: %v", configPath, err)
+	}
+	if err := os.WriteFile(configPath, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", configPath, err)
+	}
+
+	for _, name := range addedServices {
+		PrintGreen(fmt.Sprintf("Added service %s with 1 instance", name))
+	}
+	for _, name := range removedServices {
+		PrintYellow(fmt.Sprintf("Removed service %s, no longer found under %s", name, Paths.SrcDir))
+	}
+	for _, name := range addedTools {
+		PrintGreen(fmt.Sprintf("Added tool %s", name))
+	}
+	for _, name := range removedTools {
+		PrintYellow(fmt.Sprintf("Removed tool %s, no longer found under %s", name, Paths.ToolsDir))
+	}
+	PrintGreen(fmt.Sprintf("%s synced successfully.", StartConfigFile))
+	refreshDevExports()
+	return nil
+}
+
+// discoverBinaryNames lists the binary names under dir in sorted order. found is false when
+// the directory does not exist, which is not the same as a directory without binaries.
+func discoverBinaryNames(dir string) (names []string, found bool, err error) {
+	dirs, err := getSubDirectoriesBFS(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to read directory %s: %v", dir, err)
+	}
+	names = make([]string, 0, len(dirs))
+	for _, d := range dirs {
+		names = append(names, filepath.Base(d))
+	}
+	sort.Strings(names)
+	return names, true, nil
+}
+
+// ensureMappingValue returns the value of key in doc, creating it or replacing a null
+// value with an empty node of the given kind.
+func ensureMappingValue(doc *yaml.Node, key string, kind yaml.Kind) *yaml.Node {
+	tag := "!!map"
+	if kind == yaml.SequenceNode {
+		tag = "!!seq"
+	}
+	keyNode, value := mappingEntry(doc, key)
+	if keyNode == nil {
+		value = &yaml.Node{Kind: kind, Tag: tag}
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+		return value
+	}
+	if value.Kind != kind {
+		*value = yaml.Node{Kind: kind, Tag: tag, HeadComment: value.HeadComment, LineComment: value.LineComment}
+	}
+	return value
+}
+
+func syncServiceEntries(node *yaml.Node, discovered []string) (added, removed []string) {
+	known := make(map[string]bool, len(discovered))
+	for _, name := range discovered {
+		known[name] = true
+	}
+
+	present := make(map[string]bool)
+	content := make([]*yaml.Node, 0, len(node.Content))
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name := node.Content[i].Value
+		if !known[name] {
+			removed = append(removed, name)
+			continue
+		}
+		present[name] = true
+		content = append(content, node.Content[i], node.Content[i+1])
+	}
+
+	for _, name := range discovered {
+		if present[name] {
+			continue
+		}
+		added = append(added, name)
+		content = append(content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name},
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: "1"},
+		)
+	}
+	node.Content = content
+	return added, removed
+}
+
+func syncToolEntries(node *yaml.Node, discovered []string) (added, removed []string) {
+	known := make(map[string]bool, len(discovered))
+	for _, name := range discovered {
+		known[name] = true
+	}
+
+	present := make(map[string]bool)
+	content := make([]*yaml.Node, 0, len(node.Content))
+	for _, item := range node.Content {
+		name := item.Value
+		if item.Kind == yaml.MappingNode {
+			if _, value := mappingEntry(item, "name"); value != nil {
+				name = value.Value
+			}
+		}
+		if !known[name] {
+			removed = append(removed, name)
+			continue
+		}
+		present[name] = true
+		content = append(content, item)
+	}
+
+	for _, name := range discovered {
+		if present[name] {
+			continue
+		}
+		added = append(added, name)
+		content = append(content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name})
+	}
+	node.Content = content
+	return added, removed
+}
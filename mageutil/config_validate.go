@@ -0,0 +1,370 @@
+package mageutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/openimsdk/gomake/internal/util"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigIssue is a problem found in start-config.yml. Warnings do not stop
+// InitForSSC, but are still reported by ValidateStartConfig.
+type ConfigIssue struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+	Warning bool
+
+	node *yaml.Node
+}
+
+func (i ConfigIssue) String() string {
+	severity := "error"
+	if i.Warning {
+		severity = "warning"
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", i.File, i.Line, i.Column, severity, i.Message)
+}
+
+func newConfigIssue(node *yaml.Node, warning bool, format string, a ...any) ConfigIssue {
+	return ConfigIssue{Line: node.Line, Column: node.Column, Message: fmt.Sprintf(format, a...), Warning: warning, node: node}
+}
+
+func hasConfigErrors(issues []ConfigIssue) bool {
+	for _, issue := range issues {
+		if !issue.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadStartConfig strictly decodes a start config file, overlaid with the file of the
+// active profile and with environment references expanded. Unknown fields and invalid
+// values are returned as issues; err is only set when a file cannot be read or parsed.
+func LoadStartConfig(path string) (*Config, []ConfigIssue, error) {
+	doc, err := readConfigDocument(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	sources := make(map[*yaml.Node]string)
+	markConfigSource(doc, path, sources)
+
+	if profile := ActiveProfile(); profile != "" {
+		overlayPath := ProfileConfigFile(path, profile)
+		overlay, err := readConfigDocument(overlayPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load profile %q: %v", profile, err)
+		}
+		markConfigSource(overlay, overlayPath, sources)
+		mergeConfigNodes(doc, overlay, "", sources)
+	}
+
+	var issues []ConfigIssue
+	interpolateEnv(doc, &issues)
+	checkKnownFields(doc, reflect.TypeOf(Config{}), "", &issues)
+
+	var config *Config
+	if !hasConfigErrors(issues) {
+		config = &Config{}
+		if err := doc.Decode(config); err != nil {
+			return nil, issues, err
+		}
+		issues = append(issues, validateConfig(doc, config)...)
+	}
+
+	for i := range issues {
+		issues[i].File = path
+		if file, ok := sources[issues[i].node]; ok {
+			issues[i].File = file
+		}
+	}
+	sort.SliceStable(issues, func(i, j int) bool {
+		if issues[i].File != issues[j].File {
+			return issues[i].File < issues[j].File
+		}
+		if issues[i].Line != issues[j].Line {
+			return issues[i].Line < issues[j].Line
+		}
+		return issues[i].Column < issues[j].Column
+	})
+	return config, issues, nil
+}
+
+// ValidateStartConfig checks start-config.yml and prints every issue found.
+func ValidateStartConfig() error {
+	name := StartConfigFile
+	if profile := ActiveProfile(); profile != "" {
+		name += fmt.Sprintf(" (profile %s)", profile)
+	}
+
+	_, issues, err := LoadStartConfig(StartConfigFile)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %v", name, err)
+	}
+	if len(issues) == 0 {
+		PrintGreen(fmt.Sprintf("%s is valid.", name))
+		return nil
+	}
+	printConfigIssues(issues)
+	return fmt.Errorf("%d issue(s) found in %s", len(issues), name)
+}
+
+// loadValidStartConfig loads start-config.yml for the generators and fails when it has errors.
+func loadValidStartConfig() (*Config, error) {
+	config, issues, err := LoadStartConfig(StartConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %v", StartConfigFile, err)
+	}
+	if hasConfigErrors(issues) {
+		printConfigIssues(issues)
+		return nil, fmt.Errorf("%s is invalid", StartConfigFile)
+	}
+	return config, nil
+}
+
+func printConfigIssues(issues []ConfigIssue) {
+	for _, issue := range issues {
+		message := issue.String()
+		if issue.Warning {
+			PrintYellow(message)
+		} else {
+			PrintRedNoTimeStamp(message)
+		}
+	}
+}
+
+// checkKnownFields walks node along the yaml tags of t and reports unknown keys.
+func checkKnownFields(node *yaml.Node, t reflect.Type, path string, issues *[]ConfigIssue) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			// Scalar shorthands are handled by UnmarshalYAML, type errors by the decoder.
+			return
+		}
+		fields := yamlFields(t)
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			fieldType, ok := fields[key.Value]
+			if !ok {
+				where := "at top level"
+				if path != "" {
+					where = "in " + path
+				}
+				message := fmt.Sprintf("unknown field %q %s", key.Value, where)
+				if suggestion := util.ClosestMatch(key.Value, names); suggestion != "" {
+					message += fmt.Sprintf(", did you mean %q?", suggestion)
+				}
+				*issues = append(*issues, newConfigIssue(key, false, "%s", message))
+				continue
+			}
+			checkKnownFields(value, fieldType, joinConfigPath(path, key.Value), issues)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			checkKnownFields(node.Content[i+1], t.Elem(), joinConfigPath(path, node.Content[i].Value), issues)
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, item := range node.Content {
+			checkKnownFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), issues)
+		}
+	}
+}
+
+// yamlFields maps the yaml keys of a struct to their field types, following inline fields.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if strings.Contains(opts, "inline") {
+			for k, v := range yamlFields(field.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// mappingEntry returns the key and value nodes of key in a mapping node.
+func mappingEntry(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// entryNode returns the value node of key, falling back to node itself.
+func entryNode(node *yaml.Node, key string) *yaml.Node {
+	if _, value := mappingEntry(node, key); value != nil {
+		return value
+	}
+	return node
+}
+
+func validateConfig(doc *yaml.Node, config *Config) []ConfigIssue {
+	var issues []ConfigIssue
+
+	knownServices, checkServices := knownBinaryNames(filepath.Join(Paths.Root, Paths.SrcDir), Paths.OutputHostBin)
+	_, servicesNode := mappingEntry(doc, "serviceBinaries")
+	if servicesNode != nil && servicesNode.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(servicesNode.Content); i += 2 {
+			key, value := servicesNode.Content[i], servicesNode.Content[i+1]
+			issues = append(issues, validateService(key, value, config.ServiceBinaries[key.Value], knownServices, checkServices)...)
+		}
+	}
+
+	knownTools, checkTools := knownBinaryNames(filepath.Join(Paths.Root, Paths.ToolsDir), Paths.OutputHostBinTools)
+	_, toolsNode := mappingEntry(doc, "toolBinaries")
+	if toolsNode != nil && toolsNode.Kind == yaml.SequenceNode {
+		seen := make(map[string]bool)
+		for i, item := range toolsNode.Content {
+			if i >= len(config.ToolBinaries) {
+				break
+			}
+			tool := config.ToolBinaries[i]
+			switch {
+			case strings.TrimSpace(tool.Name) == "":
+				issues = append(issues, newConfigIssue(item, false, "tool name is empty"))
+				continue
+			case seen[tool.Name]:
+				issues = append(issues, newConfigIssue(item, false, "tool %q is listed more than once", tool.Name))
+			}
+			seen[tool.Name] = true
+			if checkTools && !knownTools[tool.Name] {
+				issues = append(issues, unknownBinaryIssue(item, "tool", tool.Name, Paths.ToolsDir, knownTools))
+			}
+			if err := tool.SchedulingConfig.validate(); err != nil {
+				issues = append(issues, newConfigIssue(item, false, "tool %q: %v", tool.Name, err))
+			}
+		}
+	}
+
+	// Without maxFileDescriptors the open file limit is left as is, like before it was validated.
+	key, value := mappingEntry(doc, "maxFileDescriptors")
+	switch {
+	case key == nil:
+		issues = append(issues, newConfigIssue(doc, true, "maxFileDescriptors is not set, the open file limit of the services is left unchanged"))
+	case config.MaxFileDescriptors < 0:
+		issues = append(issues, newConfigIssue(value, false, "maxFileDescriptors must not be negative, got %d", config.MaxFileDescriptors))
+	case config.MaxFileDescriptors == 0:
+		issues = append(issues, newConfigIssue(value, true, "maxFileDescriptors is 0, the open file limit of the services is left unchanged"))
+	}
+
+	return issues
+}
+
+func validateService(key, value *yaml.Node, service ServiceConfig, known map[string]bool, checkKnown bool) []ConfigIssue {
+	var issues []ConfigIssue
+	name := key.Value
+
+	if checkKnown && !known[name] {
+		issues = append(issues, unknownBinaryIssue(key, "service", name, Paths.SrcDir, known))
+	}
+	if service.Count < 0 {
+		issues = append(issues, newConfigIssue(entryNode(value, "count"), false, "service %q: instance count must not be negative, got %d", name, service.Count))
+	}
+	for i := 0; i < max(service.Count, 1); i++ {
+		if _, err := service.ResolvePorts(i); err != nil {
+			issues = append(issues, newConfigIssue(entryNode(value, "ports"), false, "service %q: %v", name, err))
+			break
+		}
+	}
+	if _, err := service.Limits.Parse(); err != nil {
+		issues = append(issues, newConfigIssue(entryNode(value, "limits"), false, "service %q: limits %v", name, err))
+	}
+	if err := service.SchedulingConfig.validate(); err != nil {
+		issues = append(issues, newConfigIssue(value, false, "service %q: %v", name, err))
+	}
+	if probe := service.Kubernetes.Probe; probe != nil {
+		switch strings.ToLower(probe.Type) {
+		case "", "tcp", "http", "grpc":
+		default:
+			issues = append(issues, newConfigIssue(entryNode(entryNode(value, "kubernetes"), "probe"), false, "service %q: invalid probe type %q, expected tcp, http or grpc", name, probe.Type))
+		}
+	}
+	return issues
+}
+
+func unknownBinaryIssue(node *yaml.Node, kind, name, dir string, known map[string]bool) ConfigIssue {
+	candidates := make([]string, 0, len(known))
+	for k := range known {
+		candidates = append(candidates, k)
+	}
+	sort.Strings(candidates)
+
+	message := fmt.Sprintf("%s %q does not match any directory under %s", kind, name, dir)
+	if suggestion := util.ClosestMatch(name, candidates); suggestion != "" {
+		message += fmt.Sprintf(", did you mean %q?", suggestion)
+	}
+	return newConfigIssue(node, true, "%s", message)
+}
+
+// knownBinaryNames lists the binaries that can be referenced by name. The source directory
+// is preferred; exported bundles without sources fall back to the built binaries.
+func knownBinaryNames(srcDir, binDir string) (map[string]bool, bool) {
+	names := make(map[string]bool)
+	if dirs, err := getSubDirectoriesBFS(srcDir); err == nil {
+		for _, dir := range dirs {
+			names[filepath.Base(dir)] = true
+		}
+		return names, true
+	}
+
+	entries, err := os.ReadDir(binDir)
+	if err != nil || len(entries) == 0 {
+		return nil, false
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		names[strings.TrimSuffix(entry.Name(), ".exe")] = true
+	}
+	return names, true
+}
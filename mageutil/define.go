@@ -13,46 +13,138 @@ const (
 
 var (
 	serviceBinaries    map[string]int
+	serviceConfigs     map[string]ServiceConfig
 	toolBinaries       []string
+	toolConfigs        map[string]ToolConfig
 	MaxFileDescriptors int
 )
 
 type Config struct {
-	ServiceBinaries    map[string]int `yaml:"serviceBinaries"`
-	ToolBinaries       []string       `yaml:"toolBinaries"`
-	MaxFileDescriptors int            `yaml:"maxFileDescriptors"`
+	ServiceBinaries    map[string]ServiceConfig `yaml:"serviceBinaries"`
+	ToolBinaries       []ToolConfig             `yaml:"toolBinaries"`
+	MaxFileDescriptors int                      `yaml:"maxFileDescriptors"`
 }
 
-func InitForSSC() {
-	yamlFile, err := os.ReadFile(StartConfigFile)
-	if err != nil {
-		PrintRed("error reading YAML file: " + err.Error())
-		os.Exit(1)
+// ServiceConfig describes a service entry under serviceBinaries. It can be written
+// either as a plain instance count or as a mapping with additional settings.
+type ServiceConfig struct {
+	Count int `yaml:"count"`
+	// Ports lists the ports each instance is expected to use. Entries may be
+	// templated by instance index, e.g. "{{add 10110 .Index}}".
+	Ports []string `yaml:"ports"`
+	// Limits are applied to every instance by limits.Start before it runs its first instruction.
+	Limits ResourceLimits `yaml:"limits"`
+
+	SchedulingConfig `yaml:",inline"`
+
+	// Kubernetes holds hints for the manifests generated by `mage k8s`.
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+}
+
+type KubernetesConfig struct {
+	// Image overrides the default <registry>/<service>:<tag> image.
+	Image     string               `yaml:"image"`
+	Probe     *ProbeConfig         `yaml:"probe"`
+	Resources ResourceRequirements `yaml:"resources"`
+}
+
+type ProbeConfig struct {
+	// Type is tcp, http or grpc.
+	Type string `yaml:"type"`
+	// Port defaults to the first declared tcp port of instance 0.
+	Port                int    `yaml:"port"`
+	Path                string `yaml:"path"`
+	InitialDelaySeconds int    `yaml:"initialDelaySeconds"`
+	PeriodSeconds       int    `yaml:"periodSeconds"`
+}
+
+// ResourceRequirements uses the Kubernetes quantity format, e.g. cpu: 500m, memory: 512Mi.
+type ResourceRequirements struct {
+	Requests map[string]string `yaml:"requests"`
+	Limits   map[string]string `yaml:"limits"`
+}
+
+// ResourceLimits are the per-instance limits of a service. Rlimits accept a number or
+// "unlimited", memoryMax and cpuMax use the cgroup v2 file formats and are Linux only.
+type ResourceLimits struct {
+	NoFile    string `yaml:"nofile"`
+	NProc     string `yaml:"nproc"`
+	Core      string `yaml:"core"`
+	MemoryMax string `yaml:"memoryMax"`
+	CPUMax    string `yaml:"cpuMax"`
+}
+
+func (s *ServiceConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&s.Count)
 	}
+	type plain ServiceConfig
+	return value.Decode((*plain)(s))
+}
 
-	var config Config
-	err = yaml.Unmarshal(yamlFile, &config)
+// ToolConfig describes an entry under toolBinaries. It can be written either as the
+// plain tool name or as a mapping with a name and scheduling settings.
+type ToolConfig struct {
+	Name string `yaml:"name"`
+
+	SchedulingConfig `yaml:",inline"`
+}
+
+func (t *ToolConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&t.Name)
+	}
+	type plain ToolConfig
+	return value.Decode((*plain)(t))
+}
+
+// SchedulingConfig controls how the OS schedules a started service or tool.
+type SchedulingConfig struct {
+	// Priority is one of low, belowNormal, normal or high.
+	Priority string `yaml:"priority"`
+	// IOPriority is "<rt|be|idle>[:<0-7>]", Linux only.
+	IOPriority string `yaml:"ioPriority"`
+	// CPUAffinity is a CPU list such as "0-3,6", Linux only.
+	CPUAffinity string `yaml:"cpuAffinity"`
+}
+
+func InitForSSC() {
+	config, issues, err := LoadStartConfig(StartConfigFile)
 	if err != nil {
-		PrintRed("error unmarshalling YAML: " + err.Error())
+		PrintRed("error loading " + StartConfigFile + ": " + err.Error())
 		os.Exit(1)
 	}
+	if len(issues) > 0 {
+		printConfigIssues(issues)
+		if hasConfigErrors(issues) {
+			PrintRed(StartConfigFile + " is invalid, aborting")
+			os.Exit(1)
+		}
+	}
 
 	adjustedBinaries := make(map[string]int)
-	for binary, count := range config.ServiceBinaries {
+	adjustedConfigs := make(map[string]ServiceConfig)
+	for binary, service := range config.ServiceBinaries {
 		if runtime.GOOS == "windows" {
 			binary += ".exe"
 		}
-		adjustedBinaries[binary] = count
+		adjustedBinaries[binary] = service.Count
+		adjustedConfigs[binary] = service
 	}
 
 	var adjustedToolsBinaries []string
+	adjustedToolConfigs := make(map[string]ToolConfig)
 	for _, tool := range config.ToolBinaries {
+		name := tool.Name
 		if runtime.GOOS == "windows" {
-			tool += ".exe"
+			name += ".exe"
 		}
-		adjustedToolsBinaries = append(adjustedToolsBinaries, tool)
+		adjustedToolsBinaries = append(adjustedToolsBinaries, name)
+		adjustedToolConfigs[name] = tool
 	}
 	serviceBinaries = adjustedBinaries
+	serviceConfigs = adjustedConfigs
 	toolBinaries = adjustedToolsBinaries
+	toolConfigs = adjustedToolConfigs
 	MaxFileDescriptors = config.MaxFileDescriptors
 }
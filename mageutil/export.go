@@ -1,13 +1,18 @@
 package mageutil
 
 import (
-	"archive/tar"
-	"compress/gzip"
-	"errors"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/fs"
+	"maps"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
 
 	"github.com/openimsdk/gomake/internal/util"
@@ -17,6 +22,43 @@ import (
 type ExportOptions struct {
 	ProjectName *string
 	BuildOpt    *BuildOptions
+
+	// Format is tar.gz, tar.zst, zip or dir. By default windows platforms are exported as zip, others as tar.gz.
+	Format *string
+	// CompressionLevel is the native level of the format, 0 selects the best compression.
+	CompressionLevel *int
+
+	// Include adds the files under the root matching these globs, e.g. "scripts/*.sh".
+	Include *[]string
+	// Exclude drops the archive entries matching these globs, e.g. "config/*.local.yml".
+	Exclude *[]string
+	// IncludeConfig adds the config directory, default is true.
+	IncludeConfig *bool
+	// SourceTree adds every file tracked by git.
+	SourceTree *bool
+
+	// Launcher is standalone, a launcher built from mageutil with go build, or mage, the magefile
+	// compiled with `mage -compile`. Default is standalone.
+	Launcher *string
+	// Version is printed by the standalone launcher, default is `git describe --tags --always --dirty`.
+	Version *string
+}
+
+// ResolveExportOptions fills the options not set in code from the EXPORT_* environment variables.
+func ResolveExportOptions(codeOpt *ExportOptions) *ExportOptions {
+	fromCode := util.NilAsZero(codeOpt)
+	return &ExportOptions{
+		ProjectName:      fromCode.ProjectName,
+		BuildOpt:         fromCode.BuildOpt,
+		Format:           util.CoalescePtr(fromCode.Format, util.ResolveEnvOption[string]("EXPORT_FORMAT")),
+		CompressionLevel: util.CoalescePtr(fromCode.CompressionLevel, util.ResolveEnvOption[int]("EXPORT_COMPRESSION_LEVEL")),
+		Include:          util.CoalescePtr(fromCode.Include, util.ResolveEnvOption[[]string]("EXPORT_INCLUDE")),
+		Exclude:          util.CoalescePtr(fromCode.Exclude, util.ResolveEnvOption[[]string]("EXPORT_EXCLUDE")),
+		IncludeConfig:    util.CoalescePtr(fromCode.IncludeConfig, util.ResolveEnvOption[bool]("EXPORT_INCLUDE_CONFIG")),
+		SourceTree:       util.CoalescePtr(fromCode.SourceTree, util.ResolveEnvOption[bool]("EXPORT_SOURCE_TREE")),
+		Launcher:         util.CoalescePtr(fromCode.Launcher, util.ResolveEnvOption[string]("EXPORT_LAUNCHER")),
+		Version:          util.CoalescePtr(fromCode.Version, util.ResolveEnvOption[string]("EXPORT_VERSION")),
+	}
 }
 
 func (opt *ExportOptions) GetProjectName() string {
@@ -31,10 +73,76 @@ func (opt *ExportOptions) GetBuildOpt() *BuildOptions {
 	return util.NilAsZero(opt).BuildOpt
 }
 
-func ExportMageLauncherArchived(overrideMappingPaths map[string]string, exportOpt *ExportOptions) error {
+// GetFormat returns the archive format for a target OS.
+func (opt *ExportOptions) GetFormat(targetOS string) (util.ArchiveFormat, error) {
+	if format := strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).Format)); format != "" {
+		return util.ParseArchiveFormat(format)
+	}
+	if targetOS == "windows" {
+		return util.FormatZip, nil
+	}
+	return util.FormatTarGz, nil
+}
+
+func (opt *ExportOptions) GetCompressionLevel() int {
+	return util.NilAsZero(util.NilAsZero(opt).CompressionLevel)
+}
+
+func (opt *ExportOptions) GetInclude() []string {
+	return util.NilAsZero(util.NilAsZero(opt).Include)
+}
+
+func (opt *ExportOptions) GetExclude() []string {
+	return util.NilAsZero(util.NilAsZero(opt).Exclude)
+}
+
+func (opt *ExportOptions) GetIncludeConfig() bool {
+	if includeConfig := util.NilAsZero(opt).IncludeConfig; includeConfig != nil {
+		return *includeConfig
+	}
+	return true
+}
+
+func (opt *ExportOptions) GetSourceTree() bool {
+	return util.NilAsZero(util.NilAsZero(opt).SourceTree)
+}
+
+func (opt *ExportOptions) GetLauncher() (string, error) {
+	switch launcher := strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).Launcher)); launcher {
+	case "", LauncherStandalone:
+		return LauncherStandalone, nil
+	case LauncherMage:
+		return LauncherMage, nil
+	default:
+		return "", fmt.Errorf("invalid launcher %q: expected %s or %s", launcher, LauncherStandalone, LauncherMage)
+	}
+}
+
+// GetVersion returns the configured version, "" means it comes from git describe.
+func (opt *ExportOptions) GetVersion() string {
+	return strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).Version))
+}
+
+func ExportMageLauncherArchived(overrideMappingPaths map[string]string, codeExportOpt *ExportOptions) error {
+	return ExportMageLauncherArchivedContext(context.Background(), overrideMappingPaths, codeExportOpt)
+}
+
+// ExportMageLauncherArchivedContext is ExportMageLauncherArchived, the compilers are killed when ctx is done.
+func ExportMageLauncherArchivedContext(ctx context.Context, overrideMappingPaths map[string]string, codeExportOpt *ExportOptions) error {
+	exportOpt := ResolveExportOptions(codeExportOpt)
 	PrintBlue("Preparing launcher archive export...")
+	launcher, err := exportOpt.GetLauncher()
+	if err != nil {
+		return err
+	}
+	// Archive the same platforms Build compiles for.
+	platforms := resolvePlatforms(resolveBuildOptionsFromEnv(exportOpt.GetBuildOpt()))
+	if err := validatePlatforms(ctx, platforms); err != nil {
+		return err
+	}
 	PrintBlue("Building binaries before export...")
-	Build(nil, nil, exportOpt.GetBuildOpt())
+	// The exported binaries must not depend on the checkout path, like the launcher.
+	BuildContext(ctx, nil, nil, withTrimPath(exportOpt.GetBuildOpt()))
 
 	tmpDir := Paths.OutputTmp
 	exportDir := Paths.OutputExport
@@ -47,67 +155,264 @@ func ExportMageLauncherArchived(overrideMappingPaths map[string]string, exportOp
 		return fmt.Errorf("failed to create export directory %s: %v", exportDir, err)
 	}
 
-	platforms := os.Getenv("PLATFORMS")
-	if platforms == "" {
-		platforms = DetectPlatform()
-	}
-
-	platformList := strings.Fields(platforms)
-	if len(platformList) == 0 {
-		return fmt.Errorf("no platforms specified for export")
+	signingKey, err := resolveSigningKey()
+	if err != nil {
+		return fmt.Errorf("failed to load signing key: %v", err)
 	}
 
-	for _, platform := range platformList {
+	var archives []string
+	var exported []exportedArchive
+	for _, platform := range platforms {
 		PrintBlue(fmt.Sprintf("Target platform: %s", platform))
-		platformParts := strings.SplitN(platform, "_", 2)
-		if len(platformParts) != 2 {
-			return fmt.Errorf("invalid platform format: %s", platform)
-		}
-		targetOS, targetArch := platformParts[0], platformParts[1]
-
-		mageBinaryPath := filepath.Join(tmpDir, fmt.Sprintf("mage_%s", platform))
-		if targetOS == "windows" {
-			mageBinaryPath += ".exe"
-		}
-		PrintBlue(fmt.Sprintf("Compiling mage binary for %s: mage -compile %s", platform, mageBinaryPath))
-		cmd := exec.Command("mage", "-compile", mageBinaryPath, "-goos", targetOS, "-goarch", targetArch, "-ldflags", "-s -w")
-		cmd.Dir = Paths.Root
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to compile mage for %s: %v", platform, err)
-		}
-		PrintGreen(fmt.Sprintf("Mage binary compiled: %s", mageBinaryPath))
-
-		mappingPaths, err := EnsureRootRelPaths(
-			filepath.Join(Paths.OutputBinPath, targetOS, targetArch),
-			filepath.Join(Paths.OutputBinToolPath, targetOS, targetArch),
-			filepath.Join(Paths.Root, StartConfigFile),
-		)
+		targetOS, targetArch, _ := strings.Cut(platform, "_")
+
+		var launcherPath string
+		if launcher == LauncherMage {
+			launcherPath, err = compileMageLauncher(ctx, platform)
+		} else {
+			version := exportOpt.GetVersion()
+			if version == "" {
+				version = gitDescribe(ctx)
+			}
+			launcherPath, err = buildStandaloneLauncher(ctx, platform, LauncherInfo{Project: exportOpt.GetProjectName(), Version: version})
+		}
 		if err != nil {
 			return err
 		}
 
-		mageInPath := mageBinaryPath
-		mageOutPath := "mage"
-		if targetOS == "windows" {
-			mageOutPath = "mage.exe"
+		mappingPaths, err := exportMappingPaths(ctx, targetOS, targetArch, launcherPath, exportOpt)
+		if err != nil {
+			return err
 		}
-
-		mappingPaths[mageInPath] = mageOutPath
 		for k, v := range overrideMappingPaths {
 			mappingPaths[k] = v
 		}
 
+		format, err := exportOpt.GetFormat(targetOS)
+		if err != nil {
+			return err
+		}
 		archiveName := exportArchiveBaseName(platform, exportOpt)
-		err = archive(filepath.Join(exportDir, archiveName), mappingPaths)
+		archivePath, err := archive(filepath.Join(exportDir, archiveName), format, exportOpt.GetCompressionLevel(), mappingPaths, exportOpt.GetExclude())
 		if err != nil {
 			return err
 		}
+		exported = append(exported, exportedArchive{platform: platform, format: format, path: archivePath})
+		if format == util.FormatDir {
+			// A directory has no single digest to list or sign.
+			continue
+		}
+		if signingKey != nil {
+			if err := signArchive(archivePath, signingKey); err != nil {
+				return err
+			}
+		} else if err := os.Remove(archivePath + SignatureSuffix); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale signature: %v", err)
+		}
+		archives = append(archives, archivePath)
+		exported[len(exported)-1].signed = signingKey != nil
+	}
+	if err := updateChecksums(exportDir, archives); err != nil {
+		return err
 	}
+	reportExportedArchives(exported)
 	return nil
 }
 
+type exportedArchive struct {
+	platform string
+	format   util.ArchiveFormat
+	path     string
+	signed   bool
+}
+
+// reportExportedArchives prints the platform, format, size and digest of every archive produced.
+func reportExportedArchives(exported []exportedArchive) {
+	PrintGreen(fmt.Sprintf("Exported %d archive(s):", len(exported)))
+	for _, archive := range exported {
+		name := archive.path
+		if rel, err := filepath.Rel(Paths.Root, archive.path); err == nil {
+			name = rel
+		}
+		size, digest := "-", "-"
+		if archive.format != util.FormatDir {
+			if info, err := os.Stat(archive.path); err == nil {
+				size = util.FormatBytes(uint64(info.Size()))
+			}
+			if sum, err := fileSHA256(archive.path); err == nil {
+				digest = "sha256:" + sum[:16]
+			}
+		}
+		signed := ""
+		if archive.signed {
+			signed = "  signed"
+		}
+		PrintGreen(fmt.Sprintf("  %-16s %-8s %-10s %s  %s%s", archive.platform, archive.format, size, digest, name, signed))
+	}
+}
+
+// exportMappingPaths returns the files of a platform archive: the binaries, start-config.yml, the
+// launcher and, depending on the options, the config directory, the git-tracked files and
+// the files matching the include globs.
+func exportMappingPaths(ctx context.Context, targetOS, targetArch, launcherPath string, exportOpt *ExportOptions) (map[string]string, error) {
+	paths := []string{
+		filepath.Join(Paths.OutputBinPath, targetOS, targetArch),
+		filepath.Join(Paths.OutputBinToolPath, targetOS, targetArch),
+		filepath.Join(Paths.Root, StartConfigFile),
+	}
+	if exportOpt.GetIncludeConfig() {
+		if _, err := os.Stat(Paths.Config); err == nil {
+			paths = append(paths, Paths.Config)
+		}
+	}
+	mappingPaths, err := EnsureRootRelPaths(paths...)
+	if err != nil {
+		return nil, err
+	}
+
+	if exportOpt.GetSourceTree() {
+		PrintBlue("Adding the files tracked by git")
+		sourcePaths, err := GetDefaultExportMappingPathsContext(ctx, exportOpt.GetExclude())
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(mappingPaths, sourcePaths)
+	}
+
+	if include := exportOpt.GetInclude(); len(include) > 0 {
+		includePaths, err := getRootFilesMatching(include)
+		if err != nil {
+			return nil, err
+		}
+		if len(includePaths) == 0 {
+			PrintYellow(fmt.Sprintf("No files match the include globs %s", strings.Join(include, " ")))
+		}
+		maps.Copy(mappingPaths, includePaths)
+	}
+
+	mageOutPath := "mage"
+	if targetOS == "windows" {
+		mageOutPath = "mage.exe"
+	}
+	mappingPaths[launcherPath] = mageOutPath
+	return mappingPaths, nil
+}
+
+// getRootFilesMatching returns the files under the root matching the globs, outside of the output
+// directory and hidden directories.
+func getRootFilesMatching(patterns []string) (map[string]string, error) {
+	output := filepath.Clean(Paths.Output)
+	var files []string
+	err := filepath.WalkDir(Paths.Root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if filePath != filepath.Clean(Paths.Root) && (filePath == output || strings.HasPrefix(d.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(Paths.Root, filePath)
+		if err != nil {
+			return err
+		}
+		if util.MatchAnyFilepathGlob(rel, patterns) {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk %s: %v", Paths.Root, err)
+	}
+	return EnsureRootRelPaths(files...)
+}
+
+// compileMageLauncher compiles the magefile into a standalone binary for the platform.
+func compileMageLauncher(ctx context.Context, platform string) (string, error) {
+	targetOS, targetArch, found := strings.Cut(platform, "_")
+	if !found {
+		return "", fmt.Errorf("invalid platform format: %s", platform)
+	}
+
+	mageBinaryPath := filepath.Join(Paths.OutputTmp, fmt.Sprintf("mage_%s", platform))
+	if targetOS == "windows" {
+		mageBinaryPath += ".exe"
+	}
+	PrintBlue(fmt.Sprintf("Compiling mage binary for %s: mage -compile %s", platform, mageBinaryPath))
+	// -trimpath keeps the launcher identical across checkouts, for reproducible exports.
+	err := NewCmd("mage").
+		WithArgs("-compile", mageBinaryPath, "-goos", targetOS, "-goarch", targetArch, "-ldflags", "-s -w").
+		WithDir(Paths.Root).
+		WithEnv(map[string]string{"GOFLAGS": strings.TrimSpace(os.Getenv("GOFLAGS") + " -trimpath")}).
+		RunContext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to compile mage for %s: %v", platform, err)
+	}
+	PrintGreen(fmt.Sprintf("Mage binary compiled: %s", mageBinaryPath))
+	return mageBinaryPath, nil
+}
+
+// buildStandaloneLauncher generates a main package running RunLauncher and builds it for the
+// platform with go build, so neither mage nor Go is needed where the archive is unpacked.
+func buildStandaloneLauncher(ctx context.Context, platform string, info LauncherInfo) (string, error) {
+	targetOS, targetArch, found := strings.Cut(platform, "_")
+	if !found {
+		return "", fmt.Errorf("invalid platform format: %s", platform)
+	}
+
+	sourceDir := filepath.Join(Paths.OutputTmp, "launcher")
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory %s: %v", sourceDir, err)
+	}
+	source := fmt.Sprintf(launcherMainTemplate, reflect.TypeFor[LauncherInfo]().PkgPath(), info.Project, info.Version)
+	if err := os.WriteFile(filepath.Join(sourceDir, "main.go"), []byte(source), 0644); err != nil {
+		return "", fmt.Errorf("failed to write launcher source: %v", err)
+	}
+
+	launcherPath := filepath.Join(Paths.OutputTmp, fmt.Sprintf("launcher_%s", platform))
+	if targetOS == "windows" {
+		launcherPath += ".exe"
+	}
+	PrintBlue(fmt.Sprintf("Building launcher %s for %s", info.Version, platform))
+	// -trimpath keeps the launcher identical across checkouts, for reproducible exports.
+	err := NewCmd("go").
+		WithArgs("build", "-trimpath", "-ldflags", "-s -w", "-o", launcherPath, sourceDir).
+		WithDir(Paths.Root).
+		WithEnv(map[string]string{"GOOS": targetOS, "GOARCH": targetArch, "CGO_ENABLED": "0"}).
+		RunContext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to build launcher for %s: %v", platform, err)
+	}
+	PrintGreen(fmt.Sprintf("Launcher built: %s", launcherPath))
+	return launcherPath, nil
+}
+
+const launcherMainTemplate = `// Code generated by mage export. DO NOT EDIT.
+
+package main
+
+import (
+	"os"
+
+	"%s"
+)
+
+func main() {
+	os.Exit(mageutil.RunLauncher(mageutil.LauncherInfo{Project: %q, Version: %q}, os.Args[1:]))
+}
+`
+
+// gitDescribe returns the version of the checkout, or "dev" outside of git.
+func gitDescribe(ctx context.Context) string {
+	var output bytes.Buffer
+	err := NewCmd("git").WithArgs("describe", "--tags", "--always", "--dirty").WithDir(Paths.Root).WithStdout(&output).WithStderr(io.Discard).RunContext(ctx)
+	if err != nil || strings.TrimSpace(output.String()) == "" {
+		return "dev"
+	}
+	return strings.TrimSpace(output.String())
+}
+
 func exportArchiveBaseName(platform string, exportOpt *ExportOptions) string {
 	projectName := exportOpt.GetProjectName()
 	if projectName == "" {
@@ -116,36 +421,59 @@ func exportArchiveBaseName(platform string, exportOpt *ExportOptions) string {
 	return fmt.Sprintf("exported_%s_%s", projectName, platform)
 }
 
-func archive(archivePath string, mappingPaths map[string]string) error {
-	archivePath = fmt.Sprintf("%s.tar.gz", archivePath)
+// archive writes <archivePath> in the format with the mapped files except the excluded ones and a
+// MANIFEST of their hashes, and returns its path including the extension. The archive is reproducible: entries are sorted,
+// use the SOURCE_DATE_EPOCH mtime, root ownership and normalized modes, and the compression
+// headers carry no name or time.
+func archive(archivePath string, format util.ArchiveFormat, level int, mappingPaths map[string]string, exclude []string) (string, error) {
+	archivePath += format.Extension()
 	PrintBlue(fmt.Sprintf("Creating archive: %s", archivePath))
-	archiveFile, err := os.Create(archivePath)
+	modTime, err := util.SourceDateEpoch()
 	if err != nil {
-		return fmt.Errorf("failed to create archive file %s: %v", archivePath, err)
+		return "", err
 	}
-	defer archiveFile.Close()
-	gzipWriter, err := gzip.NewWriterLevel(archiveFile, gzip.BestCompression)
+	for _, in := range slices.Sorted(maps.Keys(mappingPaths)) {
+		if err := util.CheckExist(in); err != nil {
+			return "", err
+		}
+	}
+	entries, err := util.CollectArchiveEntries(mappingPaths)
 	if err != nil {
-		return fmt.Errorf("failed to create gzip writer: %v", err)
+		return "", err
+	}
+	if len(exclude) > 0 {
+		entries = slices.DeleteFunc(entries, func(entry util.ArchiveEntry) bool {
+			return util.MatchAnyFilepathGlob(entry.Name, exclude)
+		})
 	}
-	defer gzipWriter.Close()
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer tarWriter.Close()
 
-	for in, out := range mappingPaths {
-		err := util.CheckExist(in)
-		if err != nil {
-			return err
-		}
+	PrintBlue(fmt.Sprintf("Adding %d entries from %d paths to archive", len(entries), len(mappingPaths)))
 
-		PrintBlue(fmt.Sprintf("Adding %s to archive", in))
-		if err := util.AddToTar(tarWriter, in, out); err != nil {
-			return fmt.Errorf("failed to add %s to archive: %v", in, err)
+	writer, err := util.NewArchiveWriter(archivePath, format, level, modTime)
+	if err != nil {
+		return "", fmt.Errorf("failed to create archive %s: %v", archivePath, err)
+	}
+	var manifest []manifestEntry
+	for _, entry := range entries {
+		hash := sha256.New()
+		if err := writer.WriteEntry(entry, hash); err != nil {
+			writer.Close()
+			return "", fmt.Errorf("failed to add %s to archive: %v", entry.Source, err)
+		}
+		if !entry.Dir {
+			manifest = append(manifest, manifestEntry{Path: entry.Name, Mode: entry.Mode, SHA256: hex.EncodeToString(hash.Sum(nil))})
 		}
 	}
+	if err := writer.WriteFile(ArchiveManifestName, 0644, formatArchiveManifest(manifest)); err != nil {
+		writer.Close()
+		return "", fmt.Errorf("failed to add %s to archive: %v", ArchiveManifestName, err)
+	}
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("failed to write archive %s: %v", archivePath, err)
+	}
 
 	PrintGreen(fmt.Sprintf("Archive created successfully: %s", archivePath))
-	return nil
+	return archivePath, nil
 }
 
 func EnsureRootRelPaths(paths ...string) (map[string]string, error) {
@@ -172,25 +500,27 @@ func EnsureRootRelPaths(paths ...string) (map[string]string, error) {
 }
 
 func GetAllRootFilesExcludeIgnore() ([]string, error) {
+	return GetAllRootFilesExcludeIgnoreContext(context.Background())
+}
+
+// GetAllRootFilesExcludeIgnoreContext is GetAllRootFilesExcludeIgnore, git is killed when ctx is done.
+func GetAllRootFilesExcludeIgnoreContext(ctx context.Context) ([]string, error) {
 	root := Paths.Root
 	if root == "" {
 		return nil, fmt.Errorf("root path is empty")
 	}
 
-	cmd := exec.Command("git", "ls-files", "-c", "--exclude-standard", "-z")
-	cmd.Dir = root
-
-	output, err := cmd.Output()
+	var output, stderr bytes.Buffer
+	err := NewCmd("git").WithArgs("ls-files", "-c", "--exclude-standard", "-z").WithDir(root).WithStdout(&output).WithStderr(&stderr).RunContext(ctx)
 	if err != nil {
-		var exitErr *exec.ExitError
-		if errors.As(err, &exitErr) {
-			return nil, fmt.Errorf("failed to list root files via git ls-files: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("failed to list root files via git ls-files: %s", message)
 		}
 		return nil, fmt.Errorf("failed to list root files via git ls-files: %v", err)
 	}
 
 	relPaths := make([]string, 0)
-	for _, relPath := range strings.Split(string(output), "\x00") {
+	for _, relPath := range strings.Split(output.String(), "\x00") {
 		if relPath == "" {
 			continue
 		}
@@ -223,7 +553,12 @@ func GetAllRootFilesExcludeIgnore() ([]string, error) {
 }
 
 func GetDefaultExportMappingPaths(exclude []string) (map[string]string, error) {
-	allFiles, err := GetAllRootFilesExcludeIgnore()
+	return GetDefaultExportMappingPathsContext(context.Background(), exclude)
+}
+
+// GetDefaultExportMappingPathsContext is GetDefaultExportMappingPaths, git is killed when ctx is done.
+func GetDefaultExportMappingPathsContext(ctx context.Context, exclude []string) (map[string]string, error) {
+	allFiles, err := GetAllRootFilesExcludeIgnoreContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,368 @@
+package mageutil
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/openimsdk/gomake/internal/limits"
+	"github.com/openimsdk/gomake/internal/util"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ProcfileName    = "Procfile"
+	ComposeFileName = "compose.yaml"
+
+	defaultComposeImage = "debian:bookworm-slim"
+	composeBinDir       = "/app/bin"
+	composeToolsDir     = "/app/tools"
+
+	// devExportHeader marks the files generated from start-config.yml, which are
+	// regenerated by `mage build` and `mage config sync`.
+	devExportHeader = "# Code generated from start-config.yml by mage %s. DO NOT EDIT.\n"
+)
+
+type ComposeOptions struct {
+	ProjectName *string
+	// Image runs the binaries, which are mounted from _output, default is debian:bookworm-slim.
+	Image *string
+	// Arch selects the linux binaries to mount, default is the host architecture.
+	Arch *string
+}
+
+func (opt *ComposeOptions) GetProjectName() string {
+	return k8sName(util.NilAsZero(util.NilAsZero(opt).ProjectName))
+}
+
+func (opt *ComposeOptions) GetImage() string {
+	if image := strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).Image)); image != "" {
+		return image
+	}
+	return defaultComposeImage
+}
+
+func (opt *ComposeOptions) GetArch() string {
+	if arch := strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).Arch)); arch != "" {
+		return arch
+	}
+	return runtime.GOARCH
+}
+
+// ResolveComposeOptions fills the options not set in code from COMPOSE_IMAGE and COMPOSE_ARCH.
+func ResolveComposeOptions(codeOpt *ComposeOptions) *ComposeOptions {
+	fromCode := util.NilAsZero(codeOpt)
+	return &ComposeOptions{
+		ProjectName: fromCode.ProjectName,
+		Image:       util.CoalescePtr(fromCode.Image, util.ResolveEnvOption[string]("COMPOSE_IMAGE")),
+		Arch:        util.CoalescePtr(fromCode.Arch, util.ResolveEnvOption[string]("COMPOSE_ARCH")),
+	}
+}
+
+// ExportProcfile writes a Procfile for foreman or overmind with one process per service instance.
+// Tools run once in an init process, and the services wait until it has finished.
+func ExportProcfile() error {
+	config, err := loadValidStartConfig()
+	if err != nil {
+		return err
+	}
+	content, err := buildProcfile(config)
+	if err != nil {
+		return err
+	}
+	return writeDevExport(filepath.Join(Paths.Root, ProcfileName), content)
+}
+
+// ExportCompose writes a compose.yaml with one service per service instance, running the linux
+// binaries from _output. Tools become one-shot services the instances depend on.
+func ExportCompose(composeOpt *ComposeOptions) error {
+	opt := ResolveComposeOptions(composeOpt)
+	config, err := loadValidStartConfig()
+	if err != nil {
+		return err
+	}
+	content, err := buildCompose(opt, config)
+	if err != nil {
+		return err
+	}
+	return writeDevExport(filepath.Join(Paths.Root, ComposeFileName), content)
+}
+
+// refreshDevExports regenerates the Procfile and compose.yaml previously generated from
+// start-config.yml, so they stay in sync with it. Files edited by hand are left alone.
+func refreshDevExports() {
+	exports := map[string]func(content []byte) error{
+		ProcfileName: func([]byte) error { return ExportProcfile() },
+		ComposeFileName: func(content []byte) error {
+			return ExportCompose(existingComposeOptions(content))
+		},
+	}
+	for _, name := range slices.Sorted(maps.Keys(exports)) {
+		content, err := os.ReadFile(filepath.Join(Paths.Root, name))
+		if err != nil || !isDevExport(content) {
+			continue
+		}
+		if err := exports[name](content); err != nil {
+			PrintYellow(fmt.Sprintf("Failed to refresh %s: %v", name, err))
+		}
+	}
+}
+
+// existingComposeOptions keeps the project name and image of a generated compose.yaml.
+func existingComposeOptions(content []byte) *ComposeOptions {
+	var existing composeFile
+	if err := yaml.Unmarshal(content, &existing); err != nil {
+		return nil
+	}
+	opt := &ComposeOptions{}
+	if existing.Name != "" {
+		opt.ProjectName = &existing.Name
+	}
+	for _, name := range slices.Sorted(maps.Keys(existing.Services)) {
+		if image := existing.Services[name].Image; image != "" {
+			opt.Image = &image
+			break
+		}
+	}
+	return opt
+}
+
+func isDevExport(content []byte) bool {
+	prefix, _, _ := strings.Cut(devExportHeader, "%s")
+	return bytes.HasPrefix(content, []byte(prefix))
+}
+
+func writeDevExport(path string, content []byte) error {
+	if existing, err := os.ReadFile(path); err == nil {
+		if bytes.Equal(existing, content) {
+			PrintBlue(fmt.Sprintf("%s is up to date", path))
+			return nil
+		}
+		if !isDevExport(existing) {
+			return fmt.Errorf("%s exists and was not generated by mage, remove it first", path)
+		}
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	PrintGreen(fmt.Sprintf("Generated %s", path))
+	return nil
+}
+
+// procfileInitMarker holds the PID of the init process once the tools have finished.
+var procfileInitMarker = path.Join(OutputDir, TmpDir, "procfile-init.pid")
+
+func buildProcfile(config *Config) ([]byte, error) {
+	binDir, err := rootRelSlash(Paths.OutputHostBin)
+	if err != nil {
+		return nil, err
+	}
+	toolsDir, err := rootRelSlash(Paths.OutputHostBinTools)
+	if err != nil {
+		return nil, err
+	}
+	configDir, err := rootRelSlash(Paths.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, devExportHeader, "export-procfile")
+
+	wait := ""
+	if len(config.ToolBinaries) > 0 {
+		// foreman stops every process when one exits, so init keeps running after the tools
+		// and the services wait for its PID instead of its exit.
+		steps := make([]string, 0, len(config.ToolBinaries)+2)
+		for _, tool := range config.ToolBinaries {
+			steps = append(steps, fmt.Sprintf("%s -c %s", path.Join(toolsDir, tool.Name), configDir))
+		}
+		steps = append(steps, "echo $$ > "+procfileInitMarker)
+		steps = append(steps, "exec sh -c 'while :; do sleep 3600; done'")
+		fmt.Fprintf(&b, "init: rm -f %s && %s\n", procfileInitMarker, strings.Join(steps, " && "))
+		wait = fmt.Sprintf(`until [ -f %[1]s ] && kill -0 "$(cat %[1]s)" 2>/dev/null; do sleep 1; done; `, procfileInitMarker)
+	}
+
+	for _, service := range slices.Sorted(maps.Keys(config.ServiceBinaries)) {
+		for i := 0; i < config.ServiceBinaries[service].Count; i++ {
+			fmt.Fprintf(&b, "%s-%d: %sexec %s -i %d -c %s\n", service, i, wait, path.Join(binDir, service), i, configDir)
+		}
+	}
+	return []byte(b.String()), nil
+}
+
+type composeFile struct {
+	Name     string                    `yaml:"name,omitempty"`
+	Services map[string]composeService `yaml:"services"`
+}
+
+type composeService struct {
+	Image      string                       `yaml:"image"`
+	Command    []string                     `yaml:"command,flow"`
+	WorkingDir string                       `yaml:"working_dir"`
+	Volumes    []string                     `yaml:"volumes"`
+	Ports      []composePort                `yaml:"ports,omitempty"`
+	DependsOn  map[string]composeDependency `yaml:"depends_on,omitempty"`
+	Restart    string                       `yaml:"restart"`
+	Ulimits    map[string]composeUlimit     `yaml:"ulimits,omitempty"`
+	MemLimit   string                       `yaml:"mem_limit,omitempty"`
+	CPUs       string                       `yaml:"cpus,omitempty"`
+	CPUSet     string                       `yaml:"cpuset,omitempty"`
+}
+
+// composePort is always quoted, as YAML 1.1 parsers read short "a:b" values as base 60 numbers.
+type composePort string
+
+func (p composePort) MarshalYAML() (any, error) {
+	return &yaml.Node{Kind: yaml.ScalarNode, Style: yaml.DoubleQuotedStyle, Value: string(p)}, nil
+}
+
+type composeDependency struct {
+	Condition string `yaml:"condition"`
+}
+
+type composeUlimit struct {
+	Soft int64 `yaml:"soft"`
+	Hard int64 `yaml:"hard"`
+}
+
+// newComposeUlimit sets both limits, -1 is unlimited.
+func newComposeUlimit(value uint64) composeUlimit {
+	if value == limits.Unlimited || value > math.MaxInt64 {
+		return composeUlimit{Soft: -1, Hard: -1}
+	}
+	return composeUlimit{Soft: int64(value), Hard: int64(value)}
+}
+
+func buildCompose(opt *ComposeOptions, config *Config) ([]byte, error) {
+	platform := "linux_" + opt.GetArch()
+	binDir, err := rootRelSlash(filepath.Join(Paths.OutputBinPath, "linux", opt.GetArch()))
+	if err != nil {
+		return nil, err
+	}
+	toolsDir, err := rootRelSlash(filepath.Join(Paths.OutputBinToolPath, "linux", opt.GetArch()))
+	if err != nil {
+		return nil, err
+	}
+	configDir, err := rootRelSlash(Paths.Config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(Paths.OutputBinPath, "linux", opt.GetArch())); err != nil {
+		PrintYellow(fmt.Sprintf("No %s binaries found, build them with PLATFORMS=%s mage build", platform, platform))
+	}
+	configVolume := "./" + configDir + ":" + k8sConfigMountPath + ":ro"
+
+	file := composeFile{Name: opt.GetProjectName(), Services: make(map[string]composeService)}
+	dependsOn := make(map[string]composeDependency)
+	for _, tool := range config.ToolBinaries {
+		name := k8sName(tool.Name)
+		file.Services[name] = composeService{
+			Image:      opt.GetImage(),
+			Command:    []string{path.Join(composeToolsDir, tool.Name), "-c", k8sConfigMountPath},
+			WorkingDir: composeToolsDir,
+			Volumes:    []string{"./" + toolsDir + ":" + composeToolsDir + ":ro", configVolume},
+			Restart:    "no",
+			CPUSet:     tool.CPUAffinity,
+		}
+		dependsOn[name] = composeDependency{Condition: "service_completed_successfully"}
+	}
+	if len(dependsOn) == 0 {
+		dependsOn = nil
+	}
+
+	for _, service := range slices.Sorted(maps.Keys(config.ServiceBinaries)) {
+		cfg := config.ServiceBinaries[service]
+		template := composeService{
+			Image:      opt.GetImage(),
+			WorkingDir: composeBinDir,
+			Volumes:    []string{"./" + binDir + ":" + composeBinDir + ":ro", configVolume},
+			DependsOn:  dependsOn,
+			Restart:    "unless-stopped",
+			CPUSet:     cfg.CPUAffinity,
+		}
+		if err := applyComposeLimits(&template, cfg.Limits, config.MaxFileDescriptors); err != nil {
+			return nil, fmt.Errorf("service %s: %v", service, err)
+		}
+		for i := 0; i < cfg.Count; i++ {
+			instance := template
+			instance.Command = []string{path.Join(composeBinDir, service), "-i", strconv.Itoa(i), "-c", k8sConfigMountPath}
+			bindings, err := cfg.ResolvePorts(i)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %v", service, err)
+			}
+			for _, binding := range bindings {
+				port := fmt.Sprintf("%d:%d", binding.Port, binding.Port)
+				if binding.Protocol == ProtocolUDP {
+					port += "/udp"
+				}
+				instance.Ports = append(instance.Ports, composePort(port))
+			}
+			file.Services[fmt.Sprintf("%s-%d", k8sName(service), i)] = instance
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, devExportHeader, "export-compose")
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(file); err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %v", ComposeFileName, err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %v", ComposeFileName, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// applyComposeLimits translates the resource limits, using maxFileDescriptors when nofile is not set.
+func applyComposeLimits(service *composeService, resourceLimits ResourceLimits, maxFileDescriptors int) error {
+	parsed, err := resourceLimits.Parse()
+	if err != nil {
+		return err
+	}
+	ulimits := make(map[string]composeUlimit)
+	if parsed.NoFile != nil {
+		ulimits["nofile"] = newComposeUlimit(*parsed.NoFile)
+	} else if maxFileDescriptors > 0 {
+		ulimits["nofile"] = newComposeUlimit(uint64(maxFileDescriptors))
+	}
+	if parsed.NProc != nil {
+		ulimits["nproc"] = newComposeUlimit(*parsed.NProc)
+	}
+	if parsed.Core != nil {
+		ulimits["core"] = newComposeUlimit(*parsed.Core)
+	}
+	if len(ulimits) > 0 {
+		service.Ulimits = ulimits
+	}
+
+	if parsed.MemoryMax != "" && parsed.MemoryMax != "max" {
+		service.MemLimit = strings.ToLower(parsed.MemoryMax)
+	}
+	quota, period, err := parseCgroupCPUMax(parsed.CPUMax)
+	if err != nil {
+		return err
+	}
+	if quota > 0 {
+		service.CPUs = strconv.FormatFloat(float64(quota)/float64(period), 'f', -1, 64)
+	}
+	return nil
+}
+
+// rootRelSlash returns the slash-separated path of a path under the project root.
+func rootRelSlash(localPath string) (string, error) {
+	rel, err := filepath.Rel(Paths.Root, localPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s relative to %s: %v", localPath, Paths.Root, err)
+	}
+	return filepath.ToSlash(rel), nil
+}
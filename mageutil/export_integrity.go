@@ -0,0 +1,406 @@
+package mageutil
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/openimsdk/gomake/internal/util"
+)
+
+const (
+	// ArchiveManifestName is the file inside every export archive listing the hash and mode of the other files.
+	ArchiveManifestName = "MANIFEST"
+	// ChecksumsFileName lists the SHA-256 of every export archive next to them.
+	ChecksumsFileName = "SHA256SUMS"
+	// SignatureSuffix is appended to an archive name for its detached signature.
+	SignatureSuffix = ".sig"
+
+	SigningKeyEnv     = "GOMAKE_SIGNING_KEY"
+	SigningKeyFileEnv = "GOMAKE_SIGNING_KEY_FILE"
+	VerifyKeyEnv      = "GOMAKE_VERIFY_KEY"
+	VerifyKeyFileEnv  = "GOMAKE_VERIFY_KEY_FILE"
+)
+
+// manifestEntry is a regular file of an archive.
+type manifestEntry struct {
+	Path   string
+	Mode   fs.FileMode
+	SHA256 string
+}
+
+// String formats the entry as "<sha256>  <mode>  <path>".
+func (e manifestEntry) String() string {
+	return fmt.Sprintf("%s  %04o  %s", e.SHA256, e.Mode.Perm(), e.Path)
+}
+
+// formatArchiveManifest lists the entries, which are sorted by path, one per line.
+func formatArchiveManifest(entries []manifestEntry) []byte {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		buf.WriteString(entry.String() + "\n")
+	}
+	return buf.Bytes()
+}
+
+func parseArchiveManifest(content []byte) (map[string]manifestEntry, error) {
+	entries := make(map[string]manifestEntry)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.SplitN(scanner.Text(), "  ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s line %d: expected \"<sha256>  <mode>  <path>\"", ArchiveManifestName, line)
+		}
+		mode, err := strconv.ParseUint(fields[1], 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid mode %q", ArchiveManifestName, line, fields[1])
+		}
+		entries[fields[2]] = manifestEntry{Path: fields[2], Mode: fs.FileMode(mode), SHA256: fields[0]}
+	}
+	return entries, scanner.Err()
+}
+
+func fileSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// updateChecksums records the SHA-256 of the archives in the SHA256SUMS file of their directory,
+// keeping the entries of other archives that still exist.
+func updateChecksums(dir string, archives []string) error {
+	sumsPath := filepath.Join(dir, ChecksumsFileName)
+	sums, err := readChecksums(sumsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for name := range sums {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			delete(sums, name)
+		}
+	}
+	for _, archivePath := range archives {
+		sum, err := fileSHA256(archivePath)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s: %v", archivePath, err)
+		}
+		sums[filepath.Base(archivePath)] = sum
+	}
+
+	if err := writeChecksums(sumsPath, sums); err != nil {
+		return err
+	}
+	PrintGreen(fmt.Sprintf("Checksums written to %s", sumsPath))
+	return nil
+}
+
+// writeChecksums writes name -> hex digest as a sha256sum compatible file sorted by name.
+func writeChecksums(sumsPath string, sums map[string]string) error {
+	var buf bytes.Buffer
+	for _, name := range slices.Sorted(maps.Keys(sums)) {
+		fmt.Fprintf(&buf, "%s  %s\n", sums[name], name)
+	}
+	if err := os.WriteFile(sumsPath, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", sumsPath, err)
+	}
+	return nil
+}
+
+// readChecksums parses a sha256sum compatible file into archive name -> hex digest.
+func readChecksums(sumsPath string) (map[string]string, error) {
+	sums := make(map[string]string)
+	content, err := os.ReadFile(sumsPath)
+	if err != nil {
+		return sums, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		sum, name, found := strings.Cut(strings.TrimSpace(line), " ")
+		if !found {
+			continue
+		}
+		sums[strings.TrimPrefix(strings.TrimSpace(name), "*")] = sum
+	}
+	return sums, nil
+}
+
+// resolveSigningKey loads the ed25519 private key from GOMAKE_SIGNING_KEY_FILE or GOMAKE_SIGNING_KEY,
+// or returns nil when signing is not configured.
+func resolveSigningKey() (ed25519.PrivateKey, error) {
+	raw, source, err := resolveKeyMaterial(SigningKeyFileEnv, SigningKeyEnv)
+	if raw == nil || err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(raw); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+		privateKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an ed25519 private key", source)
+		}
+		return privateKey, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: expected a PEM or base64 ed25519 key: %v", source, err)
+	}
+	switch len(decoded) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(decoded), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(decoded), nil
+	default:
+		return nil, fmt.Errorf("%s: ed25519 private key must be a %d byte seed or %d byte key", source, ed25519.SeedSize, ed25519.PrivateKeySize)
+	}
+}
+
+// resolveVerifyKey loads the ed25519 public key from GOMAKE_VERIFY_KEY_FILE or GOMAKE_VERIFY_KEY,
+// or returns nil when none is configured.
+func resolveVerifyKey() (ed25519.PublicKey, error) {
+	raw, source, err := resolveKeyMaterial(VerifyKeyFileEnv, VerifyKeyEnv)
+	if raw == nil || err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(raw); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+		publicKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an ed25519 public key", source)
+		}
+		return publicKey, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(decoded) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s: expected a PEM or base64 %d byte ed25519 public key", source, ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(decoded), nil
+}
+
+// resolveKeyMaterial reads the key file named by fileEnv, falling back to the inline key in keyEnv.
+func resolveKeyMaterial(fileEnv, keyEnv string) ([]byte, string, error) {
+	if file := util.ResolveEnvOption[string](fileEnv); file != nil && *file != "" {
+		raw, err := os.ReadFile(*file)
+		if err != nil {
+			return nil, fileEnv, fmt.Errorf("failed to read %s: %v", *file, err)
+		}
+		return raw, *file, nil
+	}
+	if key := util.ResolveEnvOption[string](keyEnv); key != nil && *key != "" {
+		return []byte(*key), keyEnv, nil
+	}
+	return nil, "", nil
+}
+
+// signArchive writes <archive>.sig, a base64 ed25519 signature of the archive's SHA-256 digest.
+func signArchive(archivePath string, key ed25519.PrivateKey) error {
+	digest, err := fileDigest(archivePath)
+	if err != nil {
+		return err
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, digest))
+	sigPath := archivePath + SignatureSuffix
+	if err := os.WriteFile(sigPath, []byte(signature+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", sigPath, err)
+	}
+	PrintGreen(fmt.Sprintf("Signature written to %s", sigPath))
+	return nil
+}
+
+func fileDigest(filePath string) ([]byte, error) {
+	sum, err := fileSHA256(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash %s: %v", filePath, err)
+	}
+	return hex.DecodeString(sum)
+}
+
+// VerifyArchive checks an export archive before deployment:
+//   - its digest against SHA256SUMS when the file exists next to it,
+//   - its detached signature when it is signed or a verify key is configured,
+//   - every file against the MANIFEST inside it.
+//
+// At least the checksum or the signature must be checked, unless manifestOnly is set.
+func VerifyArchive(archivePath string, manifestOnly bool) error {
+	if err := verifyArchive(archivePath, !manifestOnly); err != nil {
+		if !manifestOnly {
+			return fmt.Errorf("%v, pass --manifest-only to check the manifest only", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// verifyArchive is VerifyArchive, requireDigest fails when neither a checksum nor a signature
+// was checked, since the MANIFEST alone does not prove where the archive comes from.
+func verifyArchive(archivePath string, requireDigest bool) error {
+	format, err := util.DetectArchiveFormat(archivePath)
+	if err != nil {
+		return err
+	}
+	PrintBlue(fmt.Sprintf("Verifying %s", archivePath))
+
+	verified := false
+	if format == util.FormatDir {
+		if requireDigest {
+			return fmt.Errorf("%s is a directory export, which has no checksum or signature", archivePath)
+		}
+		PrintYellow("Directory exports have no checksum or signature, checking the manifest only")
+	} else if verified, err = verifyArchiveDigest(archivePath); err != nil {
+		return err
+	}
+	if requireDigest && !verified {
+		return fmt.Errorf("%s has neither a %s entry nor a signature", archivePath, ChecksumsFileName)
+	}
+
+	if err := verifyArchiveManifest(archivePath); err != nil {
+		return err
+	}
+	if !verified {
+		PrintYellow(fmt.Sprintf("%s matches its MANIFEST, but neither a checksum nor a signature proves its origin", archivePath))
+		return nil
+	}
+	PrintGreen(fmt.Sprintf("%s verified successfully", archivePath))
+	return nil
+}
+
+// verifyArchiveDigest checks the checksum and the signature of an archive and reports whether
+// at least one of them was present.
+func verifyArchiveDigest(archivePath string) (bool, error) {
+	digest, err := fileDigest(archivePath)
+	if err != nil {
+		return false, err
+	}
+	verified := false
+	sums, err := readChecksums(filepath.Join(filepath.Dir(archivePath), ChecksumsFileName))
+	switch {
+	case os.IsNotExist(err):
+		PrintYellow(fmt.Sprintf("No %s found next to the archive, skipping the checksum", ChecksumsFileName))
+	case err != nil:
+		return false, err
+	default:
+		expected, ok := sums[filepath.Base(archivePath)]
+		if !ok {
+			return false, fmt.Errorf("%s has no entry for %s", ChecksumsFileName, filepath.Base(archivePath))
+		}
+		if expected != hex.EncodeToString(digest) {
+			return false, fmt.Errorf("checksum mismatch: %s lists %s, archive is %s", ChecksumsFileName, expected, hex.EncodeToString(digest))
+		}
+		PrintGreen("Checksum OK")
+		verified = true
+	}
+	signed, err := verifyArchiveSignature(archivePath, digest)
+	return verified || signed, err
+}
+
+// verifyArchiveSignature checks the detached signature and reports whether the archive is signed.
+func verifyArchiveSignature(archivePath string, digest []byte) (bool, error) {
+	publicKey, err := resolveVerifyKey()
+	if err != nil {
+		return false, err
+	}
+	sigPath := archivePath + SignatureSuffix
+	raw, err := os.ReadFile(sigPath)
+	switch {
+	case os.IsNotExist(err) && publicKey == nil:
+		PrintYellow("Archive is not signed, skipping the signature")
+		return false, nil
+	case os.IsNotExist(err):
+		return false, fmt.Errorf("%s not found, but a verify key is configured", sigPath)
+	case err != nil:
+		return false, fmt.Errorf("failed to read %s: %v", sigPath, err)
+	case publicKey == nil:
+		return false, fmt.Errorf("archive is signed, set %s or %s to verify it", VerifyKeyFileEnv, VerifyKeyEnv)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return false, fmt.Errorf("invalid signature in %s: %v", sigPath, err)
+	}
+	if !ed25519.Verify(publicKey, digest, signature) {
+		return false, errors.New("signature verification failed")
+	}
+	PrintGreen("Signature OK")
+	return true, nil
+}
+
+// verifyArchiveManifest compares the files of the archive with its MANIFEST.
+func verifyArchiveManifest(archivePath string) error {
+	var manifest []byte
+	actual := make(map[string]manifestEntry)
+	err := util.WalkArchive(archivePath, func(name string, mode os.FileMode, r io.Reader) error {
+		if name == ArchiveManifestName {
+			var err error
+			manifest, err = io.ReadAll(r)
+			return err
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(hash, r); err != nil {
+			return fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		actual[name] = manifestEntry{Path: name, Mode: mode, SHA256: hex.EncodeToString(hash.Sum(nil))}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", archivePath, err)
+	}
+	if manifest == nil {
+		return fmt.Errorf("archive has no %s", ArchiveManifestName)
+	}
+	expected, err := parseArchiveManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	for _, name := range slices.Sorted(maps.Keys(expected)) {
+		want := expected[name]
+		got, ok := actual[name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: missing", name))
+		case got.SHA256 != want.SHA256:
+			problems = append(problems, fmt.Sprintf("%s: sha256 %s, expected %s", name, got.SHA256, want.SHA256))
+		case got.Mode != want.Mode.Perm():
+			problems = append(problems, fmt.Sprintf("%s: mode %04o, expected %04o", name, got.Mode, want.Mode.Perm()))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(actual)) {
+		if _, ok := expected[name]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: not listed in %s", name, ArchiveManifestName))
+		}
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			PrintRedNoTimeStamp(problem)
+		}
+		return fmt.Errorf("%d file(s) do not match %s", len(problems), ArchiveManifestName)
+	}
+	PrintGreen(fmt.Sprintf("%d file(s) match %s", len(expected), ArchiveManifestName))
+	return nil
+}
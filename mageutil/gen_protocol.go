@@ -1,247 +1,564 @@
 package mageutil
 
 import (
-	"archive/zip"
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/magefile/mage/sh"
-	"io"
-	"net/http"
+	"io/fs"
+	"maps"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
 	"strings"
+
+	"github.com/openimsdk/gomake/internal/util"
 )
 
-func ensureToolsInstalled() error {
-	tools := map[string]string{
-		"protoc-gen-go": "github.com/golang/protobuf/protoc-gen-go@latest",
+// ProtocPlugin is a protoc plugin installed with go install at a pinned version.
+type ProtocPlugin struct {
+	// Name is the suffix of the protoc-gen-<name> executable and of the --<name>_out flag.
+	Name    string
+	Package string
+	Version string
+	// Opts are passed as --<name>_opt besides the module mapping.
+	Opts []string
+}
+
+// defaultProtocPlugins generate the messages and gRPC services of every proto directory.
+var defaultProtocPlugins = []ProtocPlugin{
+	{Name: "go", Package: "google.golang.org/protobuf/cmd/protoc-gen-go", Version: "v1.36.11"},
+	{Name: "go-grpc", Package: "google.golang.org/grpc/cmd/protoc-gen-go-grpc", Version: "v1.5.1"},
+}
+
+// OptionalProtocPlugins can be enabled for proto directories with ProtocolOptions.Plugins.
+var OptionalProtocPlugins = map[string]ProtocPlugin{
+	"grpc-gateway": {Name: "grpc-gateway", Package: "github.com/grpc-ecosystem/grpc-gateway/v2/protoc-gen-grpc-gateway", Version: "v2.29.0"},
+	"validate":     {Name: "validate", Package: "github.com/envoyproxy/protoc-gen-validate", Version: "v1.3.3", Opts: []string{"lang=go"}},
+	"connect":      {Name: "connect-go", Package: "connectrpc.com/connect/cmd/protoc-gen-connect-go", Version: "v1.19.1"},
+}
+
+type ProtocolOptions struct {
+	// Roots are the directories searched for .proto files, default is pkg/protocol.
+	Roots *[]string
+	// Includes are extra import paths such as third_party. The roots and the well-known types
+	// shipped with protoc are always included.
+	Includes *[]string
+	// OutputDir receives the generated code, laid out by import path below Module. Default is the project root.
+	OutputDir *string
+	// Module is the import path of OutputDir, default is the module in go.mod.
+	Module *string
+	// GoPackages maps proto files or directories relative to their root to a Go import path, for
+	// protos without a go_package option, e.g. {"common": "github.com/x/y/pkg/protocol/common"}.
+	GoPackages map[string]string
+	// Plugins enables optional plugins for the proto directories relative to their root matching a
+	// glob, e.g. {"gateway/**": {"grpc-gateway", "validate"}, "**": {"connect"}}. See OptionalProtocPlugins.
+	Plugins map[string][]string
+}
+
+// ResolveProtocolOptions fills the options not set in code from PROTOCOL_ROOTS, PROTOCOL_INCLUDES,
+// PROTOCOL_OUTPUT_DIR and PROTOCOL_MODULE.
+func ResolveProtocolOptions(codeOpt *ProtocolOptions) *ProtocolOptions {
+	fromCode := util.NilAsZero(codeOpt)
+	return &ProtocolOptions{
+		Roots:      util.CoalescePtr(fromCode.Roots, util.ResolveEnvOption[[]string]("PROTOCOL_ROOTS")),
+		Includes:   util.CoalescePtr(fromCode.Includes, util.ResolveEnvOption[[]string]("PROTOCOL_INCLUDES")),
+		OutputDir:  util.CoalescePtr(fromCode.OutputDir, util.ResolveEnvOption[string]("PROTOCOL_OUTPUT_DIR")),
+		Module:     util.CoalescePtr(fromCode.Module, util.ResolveEnvOption[string]("PROTOCOL_MODULE")),
+		GoPackages: fromCode.GoPackages,
+		Plugins:    fromCode.Plugins,
 	}
+}
 
-	// Setting GOBIN based on OS, Windows needs a different default path
-	var targetDir string
-	if runtime.GOOS == "windows" {
-		targetDir = filepath.Join(os.Getenv("USERPROFILE"), "go", "bin")
-	} else {
-		targetDir = "/usr/local/bin"
+func (opt *ProtocolOptions) GetRoots() []string {
+	if roots := util.NilAsZero(util.NilAsZero(opt).Roots); len(roots) > 0 {
+		return roots
 	}
+	return []string{filepath.Join("pkg", "protocol")}
+}
 
-	os.Setenv("GOBIN", targetDir)
+func (opt *ProtocolOptions) GetIncludes() []string {
+	return util.NilAsZero(util.NilAsZero(opt).Includes)
+}
 
-	for tool, path := range tools {
-		if _, err := exec.LookPath(filepath.Join(targetDir, tool)); err != nil {
-			PrintBlue(fmt.Sprintf("Installing %s to %s...", tool, targetDir))
-			if err := sh.Run("go", "install", path); err != nil {
-				return fmt.Errorf("failed to install %s: %s", tool, err)
+func (opt *ProtocolOptions) GetOutputDir() string {
+	if outputDir := strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).OutputDir)); outputDir != "" {
+		return outputDir
+	}
+	return "."
+}
+
+// GetModule returns the import path of the output directory.
+func (opt *ProtocolOptions) GetModule() (string, error) {
+	if module := strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).Module)); module != "" {
+		return strings.TrimSuffix(module, "/"), nil
+	}
+	module, err := getModuleNameFromGoMod()
+	if err != nil {
+		return "", fmt.Errorf("error fetching module name from go.mod: %v", err)
+	}
+	return module, nil
+}
+
+// GetGoPackage returns the import path mapped to a proto file relative to its root, by the file
+// itself or its closest mapped directory.
+func (opt *ProtocolOptions) GetGoPackage(file string) (string, bool) {
+	goPackages := util.NilAsZero(opt).GoPackages
+	for name := file; name != "."; name = path.Dir(name) {
+		if goPackage, ok := goPackages[name]; ok {
+			return goPackage, true
+		}
+	}
+	return "", false
+}
+
+// GetPlugins returns the plugins generating a proto directory relative to its root, the defaults first.
+func (opt *ProtocolOptions) GetPlugins(dir string) ([]ProtocPlugin, error) {
+	plugins := slices.Clone(defaultProtocPlugins)
+	for _, pattern := range slices.Sorted(maps.Keys(util.NilAsZero(opt).Plugins)) {
+		if !util.MatchAnyFilepathGlob(dir, []string{pattern}) {
+			continue
+		}
+		for _, name := range opt.Plugins[pattern] {
+			plugin, ok := OptionalProtocPlugins[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown protoc plugin %q for %s, expected one of %s", name, pattern, strings.Join(slices.Sorted(maps.Keys(OptionalProtocPlugins)), ", "))
+			}
+			if !slices.ContainsFunc(plugins, func(p ProtocPlugin) bool { return p.Name == plugin.Name }) {
+				plugins = append(plugins, plugin)
 			}
-		} else {
-			PrintGreen(fmt.Sprintf("%s is already installed in %s.", tool, targetDir))
 		}
 	}
+	return plugins, nil
+}
 
-	if _, err := exec.LookPath(filepath.Join(targetDir, "protoc")); err == nil {
-		PrintGreen("protoc is already installed.")
-		return nil
+// ensureProtocPlugin installs a plugin into _output/tools/protoc-gen-<name>/<version> and returns
+// the path of its executable.
+func ensureProtocPlugin(ctx context.Context, plugin ProtocPlugin) (string, error) {
+	binDir := filepath.Join(Paths.OutputTools, "protoc-gen-"+plugin.Name, plugin.Version)
+	binPath := filepath.Join(binDir, filepath.Base(plugin.Package))
+	if runtime.GOOS == "windows" {
+		binPath += ".exe"
 	}
+	if isExecutableFile(binPath) {
+		return binPath, nil
+	}
+
+	PrintBlue(fmt.Sprintf("Installing %s@%s to %s...", plugin.Package, plugin.Version, binDir))
+	cmd := NewCmd("go").WithArgs("install", plugin.Package+"@"+plugin.Version).WithEnv(map[string]string{"GOBIN": binDir})
+	if err := cmd.RunContext(ctx); err != nil {
+		return "", fmt.Errorf("failed to install %s@%s: %v", plugin.Package, plugin.Version, err)
+	}
+	return binPath, nil
+}
+
+// protoFile is a .proto file found under a root.
+type protoFile struct {
+	root string
+	// name is the slash-separated path relative to the root, as used by imports.
+	name string
+	// mapped is set when the Go package comes from ProtocolOptions.GoPackages.
+	mapped bool
+}
 
-	PrintBlue("Installing protoc...")
-	return installProtoc(targetDir)
+func (f protoFile) path() string {
+	return filepath.Join(f.root, filepath.FromSlash(f.name))
 }
 
-func installProtoc(installDir string) error {
-	version := "26.1"
-	baseURL := "https://github.com/protocolbuffers/protobuf/releases/download/v" + version
-	archMap := map[string]string{
-		"amd64": "x86_64",
-		"386":   "x86",
-		"arm64": "aarch64",
+// protoPackage is the set of proto files generating one Go package.
+type protoPackage struct {
+	goPackage string
+	// dir is the directory of the files relative to their root.
+	dir   string
+	files []protoFile
+}
+
+var goPackageOptionPattern = regexp.MustCompile(`(?m)^\s*option\s+go_package\s*=\s*"([^"]*)"\s*;`)
+
+// discoverProtoPackages finds every .proto file under the roots and groups them by Go package.
+func discoverProtoPackages(opt *ProtocolOptions) ([]*protoPackage, error) {
+	packages := make(map[string]*protoPackage)
+	roots := make(map[string]string)
+	for _, root := range opt.GetRoots() {
+		err := filepath.WalkDir(root, func(filePath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if filePath != root && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if filepath.Ext(filePath) != ".proto" {
+				return nil
+			}
+			rel, err := filepath.Rel(root, filePath)
+			if err != nil {
+				return err
+			}
+			file := protoFile{root: root, name: filepath.ToSlash(rel)}
+			if other, ok := roots[file.name]; ok {
+				return fmt.Errorf("%s is found in both %s and %s", file.name, other, root)
+			}
+			roots[file.name] = root
+
+			content, err := os.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+			var goPackage string
+			if match := goPackageOptionPattern.FindSubmatch(content); match != nil {
+				// "path;name" sets the package name besides the import path.
+				goPackage, _, _ = strings.Cut(string(match[1]), ";")
+			} else if goPackage, file.mapped = opt.GetGoPackage(file.name); !file.mapped {
+				return fmt.Errorf("%s has no go_package option and no ProtocolOptions.GoPackages entry", filePath)
+			}
+
+			// The plugins are chosen by the directory, so a Go package is generated from one directory.
+			pkg, ok := packages[goPackage]
+			if !ok {
+				pkg = &protoPackage{goPackage: goPackage, dir: path.Dir(file.name)}
+				packages[goPackage] = pkg
+			} else if first := pkg.files[0]; first.root != file.root || pkg.dir != path.Dir(file.name) {
+				return fmt.Errorf("go_package %s of %s is also used in %s, a Go package is generated from one directory",
+					goPackage, filePath, filepath.Dir(first.path()))
+			}
+			pkg.files = append(pkg.files, file)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover protos in %s: %v", root, err)
+		}
 	}
-	protocFile := "protoc-%s-%s.zip"
 
-	osArch := runtime.GOOS + "-" + getProtocArch(archMap, runtime.GOARCH)
-	if runtime.GOOS == "windows" {
-		osArch = "win64" // assuming 64-bit, for 32-bit use "win32"
+	result := make([]*protoPackage, 0, len(packages))
+	for _, goPackage := range slices.Sorted(maps.Keys(packages)) {
+		pkg := packages[goPackage]
+		slices.SortFunc(pkg.files, func(a, b protoFile) int { return strings.Compare(a.name, b.name) })
+		result = append(result, pkg)
 	}
-	fileName := fmt.Sprintf(protocFile, version, osArch)
-	url := baseURL + "/" + fileName
+	return result, nil
+}
 
-	PrintBlue(fmt.Sprintf("URL: %s", url))
+// protocolRun is what the generation of every proto package shares.
+type protocolRun struct {
+	opt           *ProtocolOptions
+	protocPath    string
+	protocVersion string
+	module        string
+	// mappings are the M options of the files without go_package, passed to every plugin.
+	mappings []string
+	packages []*protoPackage
+}
 
-	resp, err := http.Get(url)
+// prepareProtocol installs protoc and discovers the proto packages, it returns nil without any proto.
+func prepareProtocol(ctx context.Context, codeOpt *ProtocolOptions) (*protocolRun, error) {
+	opt := ResolveProtocolOptions(codeOpt)
+	protocPath, err := ensureProtoc(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	// Create a temporary file
-	tmpFile, err := os.CreateTemp("", "protoc-*.zip")
+	var version bytes.Buffer
+	if err := NewCmd(protocPath).WithArgs("--version").WithStdout(&version).RunContext(ctx); err != nil {
+		return nil, fmt.Errorf("failed to run %s --version: %v", protocPath, err)
+	}
+	module, err := opt.GetModule()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer tmpFile.Close()
 
-	_, err = io.Copy(tmpFile, resp.Body)
+	packages, err := discoverProtoPackages(opt)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if len(packages) == 0 {
+		PrintYellow(fmt.Sprintf("No .proto files found in %s", strings.Join(opt.GetRoots(), ", ")))
+		return nil, nil
+	}
+
+	run := &protocolRun{
+		opt:           opt,
+		protocPath:    protocPath,
+		protocVersion: strings.TrimSpace(version.String()),
+		module:        module,
+		packages:      packages,
+	}
+	for _, pkg := range packages {
+		if pkg.goPackage != module && !strings.HasPrefix(pkg.goPackage, module+"/") {
+			return nil, fmt.Errorf("go_package %s of %s is outside of module %s", pkg.goPackage, pkg.files[0].path(), module)
+		}
+		for _, file := range pkg.files {
+			if file.mapped {
+				run.mappings = append(run.mappings, "M"+file.name+"="+pkg.goPackage)
+			}
+		}
 	}
-	PrintBlue(fmt.Sprintf("tmp %s install %s", tmpFile.Name(), installDir))
-	return unzip(tmpFile.Name(), installDir)
+	return run, nil
 }
 
-func unzip(src, dest string) error {
-	r, err := zip.OpenReader(src)
+// Protocol generates Go code for every proto package under the roots, with one protoc run per package.
+// A package is skipped when its inputs and generated files are unchanged since the last run.
+func Protocol(codeOpt *ProtocolOptions) error {
+	return ProtocolContext(context.Background(), codeOpt)
+}
+
+// ProtocolContext is Protocol, protoc and the plugin installs are killed when ctx is done.
+func ProtocolContext(ctx context.Context, codeOpt *ProtocolOptions) error {
+	run, err := prepareProtocol(ctx, codeOpt)
+	if err != nil || run == nil {
+		return err
+	}
+	state, err := loadProtocolState()
 	if err != nil {
 		return err
 	}
-	defer r.Close()
+	outputDir := run.opt.GetOutputDir()
 
-	for _, f := range r.File {
-		fpath := filepath.Join(dest, f.Name)
-		if f.FileInfo().IsDir() {
-			os.MkdirAll(fpath, os.ModePerm)
+	generatedPackages := make(map[string]bool, len(run.packages))
+	for _, pkg := range run.packages {
+		generatedPackages[pkg.goPackage] = true
+		plugins, err := run.opt.GetPlugins(pkg.dir)
+		if err != nil {
+			return err
+		}
+		inputs, err := run.inputHash(pkg, plugins)
+		if err != nil {
+			return err
+		}
+		previous := state[pkg.goPackage]
+		if previous.upToDate(inputs, outputDir) {
+			PrintBlue(fmt.Sprintf("%s is up to date", pkg.goPackage))
 			continue
 		}
 
-		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+		generated, err := run.generate(ctx, pkg, plugins)
 		if err != nil {
 			return err
 		}
-
-		rc, err := f.Open()
+		outputs, err := writeGeneratedFiles(outputDir, generated, previous.Outputs)
 		if err != nil {
-			outFile.Close()
 			return err
 		}
+		state[pkg.goPackage] = protocolPackageState{Inputs: inputs, Outputs: outputs}
+		// Saved after every package, so a failure does not regenerate the finished ones.
+		if err := state.save(); err != nil {
+			return err
+		}
+	}
 
-		_, err = io.Copy(outFile, rc)
-		outFile.Close()
-		rc.Close()
-		if err != nil {
+	// The code of packages whose protos were removed is removed as well.
+	for _, goPackage := range slices.Sorted(maps.Keys(state)) {
+		if generatedPackages[goPackage] {
+			continue
+		}
+		if _, err := writeGeneratedFiles(outputDir, nil, state[goPackage].Outputs); err != nil {
 			return err
 		}
+		delete(state, goPackage)
 	}
-	return nil
+	return state.save()
 }
 
-func getProtocArch(archMap map[string]string, goArch string) string {
-	if arch, ok := archMap[goArch]; ok {
-		return arch
-	}
-	return goArch
+// CheckProtocol generates the code of every proto package into a temporary directory and fails with
+// a unified diff when it differs from the files in the output directory, or when the output
+// directory holds generated files that protocol would remove.
+func CheckProtocol(codeOpt *ProtocolOptions) error {
+	return CheckProtocolContext(context.Background(), codeOpt)
 }
 
-func Protocol() error {
-	if err := ensureToolsInstalled(); err != nil {
-		PrintRed("error " + err.Error())
-		os.Exit(1)
+// CheckProtocolContext is CheckProtocol, protoc and the plugin installs are killed when ctx is done.
+func CheckProtocolContext(ctx context.Context, codeOpt *ProtocolOptions) error {
+	run, err := prepareProtocol(ctx, codeOpt)
+	if err != nil || run == nil {
+		return err
 	}
+	outputDir := run.opt.GetOutputDir()
 
-	moduleName, err := getModuleNameFromGoMod()
-	if err != nil {
-		PrintRed("error fetching module name from go.mod: " + err.Error())
-		os.Exit(1)
+	var stale []string
+	generatedNames := make(map[string]bool)
+	for _, pkg := range run.packages {
+		plugins, err := run.opt.GetPlugins(pkg.dir)
+		if err != nil {
+			return err
+		}
+		generated, err := run.generate(ctx, pkg, plugins)
+		if err != nil {
+			return err
+		}
+		for _, name := range slices.Sorted(maps.Keys(generated)) {
+			generatedNames[name] = true
+			target := filepath.Join(outputDir, filepath.FromSlash(name))
+			current, err := os.ReadFile(target)
+			oldName := "a/" + name
+			if errors.Is(err, os.ErrNotExist) {
+				oldName = ""
+			} else if err != nil {
+				return err
+			}
+			if diff := util.UnifiedDiff(oldName, "b/"+name, current, generated[name]); diff != "" {
+				fmt.Print(diff)
+				stale = append(stale, target)
+			}
+		}
 	}
 
-	protoPath := "./pkg/protocol"
-	dirs, err := os.ReadDir(protoPath)
+	orphans, err := orphanedGeneratedFiles(outputDir, generatedNames)
 	if err != nil {
-		PrintRed("error " + err.Error())
-		os.Exit(1)
+		return err
 	}
-
-	for _, dir := range dirs {
-		if dir.IsDir() {
-			if err := compileProtoFiles(protoPath, dir.Name(), moduleName); err != nil {
-				PrintRed("error " + err.Error())
-				os.Exit(1)
-			}
+	var orphanPaths []string
+	for _, name := range orphans {
+		target := filepath.Join(outputDir, filepath.FromSlash(name))
+		current, err := os.ReadFile(target)
+		if err != nil {
+			return err
 		}
+		fmt.Print(util.UnifiedDiff("a/"+name, "", current, nil))
+		orphanPaths = append(orphanPaths, target)
 	}
+	var errorMessages []string
+	if len(stale) > 0 {
+		errorMessages = append(errorMessages, fmt.Sprintf("generated code is out of date in %d file(s): %s", len(stale), strings.Join(stale, ", ")))
+	}
+	if len(orphanPaths) > 0 {
+		errorMessages = append(errorMessages, fmt.Sprintf("%d generated file(s) no longer have a proto and must be removed: %s", len(orphanPaths), strings.Join(orphanPaths, ", ")))
+	}
+	if len(errorMessages) > 0 {
+		return fmt.Errorf("%s, run `mage protocol`", strings.Join(errorMessages, "; "))
+	}
+	PrintGreen(fmt.Sprintf("Generated code of %d proto package(s) is up to date", len(run.packages)))
 	return nil
 }
 
-func compileProtoFiles(basePath, dirName, moduleName string) error {
-	protoFile := filepath.Join(basePath, dirName, dirName+".proto")
-	outputDir := filepath.Join(basePath, dirName)
-	module := moduleName + "/pkg/protocol/" + dirName
+// generatedFilePatterns match the files of protoc-gen-go, protoc-gen-go-grpc and plugins such as
+// grpc-gateway, which produce *.pb.gw.go.
+var generatedFilePatterns = []string{"*.pb.go", "*.pb.*.go"}
 
-	// Include the base path and potentially other necessary paths
-	includePaths := []string{
-		basePath, // Current proto files directory
+// orphanedGeneratedFiles returns the files relative to the output directory that protocol would
+// remove: those recorded by the last generation and the *.pb.go files next to the generated code
+// that are no longer generated.
+func orphanedGeneratedFiles(outputDir string, generated map[string]bool) ([]string, error) {
+	candidates := make(map[string]bool)
+	state, err := loadProtocolState()
+	if err != nil {
+		return nil, err
 	}
-
-	// Build the args for the protoc command
-	args := []string{
-		"--proto_path=" + strings.Join(includePaths, ":"), // Setting multiple proto paths
-		"--go_out=plugins=grpc:" + outputDir,              // Output directory
-		"--go_opt=module=" + module,                       // Module name
-		protoFile,                                         // Proto file to compile
+	for _, pkgState := range state {
+		for name := range pkgState.Outputs {
+			candidates[name] = true
+		}
 	}
-
-	// Print which file is being compiled for clarity
-	PrintBlue(fmt.Sprintf("Compiling %s...", protoFile))
-
-	// Execute the protoc command
-	if err := sh.Run("protoc", args...); err != nil {
-		return fmt.Errorf("failed to compile %s: %s", protoFile, err)
+	dirs := make(map[string]bool)
+	for name := range generated {
+		dirs[path.Dir(name)] = true
+	}
+	for dir := range dirs {
+		for _, pattern := range generatedFilePatterns {
+			matches, err := filepath.Glob(filepath.Join(outputDir, filepath.FromSlash(dir), pattern))
+			if err != nil {
+				return nil, err
+			}
+			for _, match := range matches {
+				candidates[path.Join(dir, filepath.Base(match))] = true
+			}
+		}
 	}
 
-	// Attempt to fix 'omitempty' in all generated .pb.go files within the directory
-	return fixOmitemptyInDirectory(outputDir)
+	var orphans []string
+	for _, name := range slices.Sorted(maps.Keys(candidates)) {
+		if generated[name] {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(outputDir, filepath.FromSlash(name))); errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, name)
+	}
+	return orphans, nil
 }
 
-func fixOmitemptyInDirectory(dir string) error {
-	files, err := filepath.Glob(filepath.Join(dir, "*.pb.go"))
-	if err != nil {
-		return fmt.Errorf("failed to list .pb.go files in %s: %s", dir, err)
+// protoIncludePaths returns the roots, the configured includes and the well-known types of protoc.
+func protoIncludePaths(opt *ProtocolOptions, protocPath string) []string {
+	includes := append(slices.Clone(opt.GetRoots()), opt.GetIncludes()...)
+	wellKnown := filepath.Join(filepath.Dir(filepath.Dir(protocPath)), "include")
+	if _, err := os.Stat(filepath.Join(wellKnown, "google", "protobuf", "descriptor.proto")); err == nil {
+		includes = append(includes, wellKnown)
 	}
-	PrintBlue(fmt.Sprintf("Fixing omitempty in dir %s...", dir))
-	for _, file := range files {
-		PrintBlue(fmt.Sprintf("Fixing omitempty in %s...", file))
-		if err := RemoveOmitemptyFromFile(file); err != nil {
-			return fmt.Errorf("failed to replace omitempty in %s: %s", file, err)
-		}
-	}
-	return nil
+	return includes
 }
 
-func RemoveOmitemptyFromFile(filePath string) error {
-	file, err := os.Open(filePath)
+// generate runs protoc with every plugin on the files of one Go package in a temporary directory,
+// applies ProtoPostProcessors to the Go files and returns the files by slash-separated path
+// relative to the output directory.
+func (run *protocolRun) generate(ctx context.Context, pkg *protoPackage, plugins []ProtocPlugin) (map[string][]byte, error) {
+	if err := os.MkdirAll(Paths.OutputTmp, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %v", Paths.OutputTmp, err)
+	}
+	tmpDir, err := os.MkdirTemp(Paths.OutputTmp, "protocol-")
 	if err != nil {
-		return fmt.Errorf("error opening file: %s", err)
+		return nil, err
 	}
-	defer file.Close()
+	defer os.RemoveAll(tmpDir)
 
-	var lines []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		line = strings.ReplaceAll(line, ",omitempty", "")
-		lines = append(lines, line)
+	var args []string
+	for _, include := range protoIncludePaths(run.opt, run.protocPath) {
+		args = append(args, "--proto_path="+include)
 	}
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading file: %s", err)
+	for _, plugin := range plugins {
+		pluginPath, err := ensureProtocPlugin(ctx, plugin)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args,
+			"--plugin=protoc-gen-"+plugin.Name+"="+pluginPath,
+			"--"+plugin.Name+"_out="+tmpDir,
+			"--"+plugin.Name+"_opt=module="+run.module,
+		)
+		for _, pluginOpt := range append(slices.Clone(plugin.Opts), run.mappings...) {
+			args = append(args, "--"+plugin.Name+"_opt="+pluginOpt)
+		}
+	}
+	for _, file := range pkg.files {
+		args = append(args, file.path())
 	}
 
-	return writeLines(lines, filePath)
-}
-
-// writeLines writes the lines to the given file.
-func writeLines(lines []string, path string) error {
-	file, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("error creating file: %s", err)
+	PrintBlue(fmt.Sprintf("Compiling %s (%d files)...", pkg.goPackage, len(pkg.files)))
+	if err := NewCmd(run.protocPath).WithArgs(args...).RunContext(ctx); err != nil {
+		return nil, fmt.Errorf("failed to compile %s: %v", pkg.goPackage, err)
 	}
-	defer file.Close()
 
-	w := bufio.NewWriter(file)
-	for _, line := range lines {
-		if _, err := fmt.Fprintln(w, line); err != nil {
-			return fmt.Errorf("error writing to file: %s", err)
+	generated := make(map[string][]byte)
+	err = filepath.WalkDir(tmpDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(tmpDir, filePath)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
 		}
+		if filepath.Ext(filePath) == ".go" {
+			if content, err = postProcessGoSource(filePath, content, ProtoPostProcessors); err != nil {
+				return fmt.Errorf("failed to post-process %s: %v", filepath.ToSlash(rel), err)
+			}
+		}
+		generated[filepath.ToSlash(rel)] = content
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect the code generated for %s: %v", pkg.goPackage, err)
 	}
-	return w.Flush()
+	return generated, nil
 }
 
 // getModuleNameFromGoMod extracts the module name from go.mod file.
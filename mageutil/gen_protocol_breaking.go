@@ -0,0 +1,418 @@
+package mageutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/scanner"
+
+	"github.com/emicklei/proto"
+)
+
+// protoMaxFieldNumber is the field number of `reserved N to max`.
+const protoMaxFieldNumber = 536870911
+
+// protoSchema is the wire contract of a set of proto files, by fully qualified name.
+type protoSchema struct {
+	packages map[string]bool
+	messages map[string]*protoMessageSchema
+	enums    map[string]*protoEnumSchema
+	services map[string]*protoServiceSchema
+}
+
+type protoReserved struct {
+	ranges []proto.Range
+	names  []string
+}
+
+func (r *protoReserved) add(reserved *proto.Reserved) {
+	r.ranges = append(r.ranges, reserved.Ranges...)
+	r.names = append(r.names, reserved.FieldNames...)
+}
+
+// covers reports whether a number or a name is reserved.
+func (r protoReserved) covers(number int, name string) bool {
+	for _, reserved := range r.ranges {
+		to := reserved.To
+		if reserved.Max {
+			to = protoMaxFieldNumber
+		}
+		if number >= reserved.From && number <= to {
+			return true
+		}
+	}
+	return slices.Contains(r.names, name)
+}
+
+type protoMessageSchema struct {
+	pos      scanner.Position
+	fields   map[int]*protoFieldSchema
+	reserved protoReserved
+}
+
+type protoFieldSchema struct {
+	pos    scanner.Position
+	name   string
+	number int
+	// label is repeated, optional, required, map<key> or empty.
+	label string
+	// oneof is the name of the oneof the field belongs to, if any.
+	oneof string
+	// ref is the type as written, typ is its fully qualified name once resolved in scope.
+	scope string
+	ref   string
+	typ   string
+}
+
+func (f *protoFieldSchema) String() string {
+	return strings.TrimSpace(f.label + " " + f.typ)
+}
+
+type protoEnumSchema struct {
+	pos      scanner.Position
+	values   map[int]*proto.EnumField
+	reserved protoReserved
+}
+
+type protoServiceSchema struct {
+	pos  scanner.Position
+	rpcs map[string]*protoRPCSchema
+}
+
+// protoRPCSchema is an rpc with its request and response types resolved in the package.
+type protoRPCSchema struct {
+	*proto.RPC
+	scope   string
+	request string
+	returns string
+}
+
+func newProtoSchema() *protoSchema {
+	return &protoSchema{
+		packages: make(map[string]bool),
+		messages: make(map[string]*protoMessageSchema),
+		enums:    make(map[string]*protoEnumSchema),
+		services: make(map[string]*protoServiceSchema),
+	}
+}
+
+// protoQualifiedName prefixes a name with the package and the messages it is nested in.
+func protoQualifiedName(pkg string, parent proto.Visitee, name string) string {
+	for {
+		message, ok := parent.(*proto.Message)
+		if !ok {
+			break
+		}
+		name = message.Name + "." + name
+		parent = message.Parent
+	}
+	if pkg == "" {
+		return name
+	}
+	return pkg + "." + name
+}
+
+// add records the messages, enums and services of a parsed file.
+func (s *protoSchema) add(definition *proto.Proto) {
+	pkg := protoPackageName(definition)
+	s.packages[pkg] = true
+	proto.Walk(definition,
+		proto.WithMessage(func(m *proto.Message) {
+			if m.IsExtend {
+				return
+			}
+			name := protoQualifiedName(pkg, m.Parent, m.Name)
+			message := &protoMessageSchema{pos: m.Position, fields: make(map[int]*protoFieldSchema)}
+			oneof := ""
+			addField := func(field *proto.Field, label string) {
+				message.fields[field.Sequence] = &protoFieldSchema{
+					pos: field.Position, name: field.Name, number: field.Sequence, label: label, oneof: oneof, scope: name, ref: field.Type,
+				}
+			}
+			var addElements func(elements []proto.Visitee)
+			addElements = func(elements []proto.Visitee) {
+				for _, element := range elements {
+					switch element := element.(type) {
+					case *proto.NormalField:
+						label := ""
+						switch {
+						case element.Repeated:
+							label = "repeated"
+						case element.Optional:
+							label = "optional"
+						case element.Required:
+							label = "required"
+						}
+						addField(element.Field, label)
+					case *proto.MapField:
+						addField(element.Field, "map<"+element.KeyType+">")
+					case *proto.OneOfField:
+						addField(element.Field, "")
+					case *proto.Oneof:
+						oneof = element.Name
+						addElements(element.Elements)
+						oneof = ""
+					case *proto.Reserved:
+						message.reserved.add(element)
+					}
+				}
+			}
+			addElements(m.Elements)
+			s.messages[name] = message
+		}),
+		proto.WithEnum(func(e *proto.Enum) {
+			enum := &protoEnumSchema{pos: e.Position, values: make(map[int]*proto.EnumField)}
+			for _, element := range e.Elements {
+				switch element := element.(type) {
+				case *proto.EnumField:
+					enum.values[element.Integer] = element
+				case *proto.Reserved:
+					enum.reserved.add(element)
+				}
+			}
+			s.enums[protoQualifiedName(pkg, e.Parent, e.Name)] = enum
+		}),
+		proto.WithService(func(sv *proto.Service) {
+			service := &protoServiceSchema{pos: sv.Position, rpcs: make(map[string]*protoRPCSchema)}
+			for _, element := range sv.Elements {
+				if rpc, ok := element.(*proto.RPC); ok {
+					service.rpcs[rpc.Name] = &protoRPCSchema{RPC: rpc, scope: pkg}
+				}
+			}
+			s.services[protoQualifiedName(pkg, nil, sv.Name)] = service
+		}),
+	)
+}
+
+var protoScalarTypes = []string{
+	"double", "float", "int32", "int64", "uint32", "uint64", "sint32", "sint64",
+	"fixed32", "fixed64", "sfixed32", "sfixed64", "bool", "string", "bytes",
+}
+
+// resolve qualifies the field and rpc types once every file is added.
+func (s *protoSchema) resolve() {
+	for _, message := range s.messages {
+		for _, field := range message.fields {
+			field.typ = s.resolveType(field.scope, field.ref)
+		}
+	}
+	for _, service := range s.services {
+		for _, rpc := range service.rpcs {
+			rpc.request = s.resolveType(rpc.scope, rpc.RequestType)
+			rpc.returns = s.resolveType(rpc.scope, rpc.ReturnsType)
+		}
+	}
+}
+
+// resolveType returns the fully qualified name of a type reference like protoc does: the first
+// component is looked up from the innermost scope outwards. References to types outside of the
+// schema, such as the well-known types, are returned as written.
+func (s *protoSchema) resolveType(scope, ref string) string {
+	if slices.Contains(protoScalarTypes, ref) {
+		return ref
+	}
+	if qualified, ok := strings.CutPrefix(ref, "."); ok {
+		return qualified
+	}
+	first, _, _ := strings.Cut(ref, ".")
+	for {
+		if s.declares(protoJoinName(scope, first)) {
+			return protoJoinName(scope, ref)
+		}
+		if scope == "" {
+			return ref
+		}
+		scope = protoParentScope(scope)
+	}
+}
+
+// declares reports whether a fully qualified name is a message, an enum or a package prefix.
+func (s *protoSchema) declares(name string) bool {
+	if _, ok := s.messages[name]; ok {
+		return true
+	}
+	if _, ok := s.enums[name]; ok {
+		return true
+	}
+	for pkg := range s.packages {
+		if pkg == name || strings.HasPrefix(pkg, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func protoJoinName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+func protoParentScope(scope string) string {
+	index := strings.LastIndex(scope, ".")
+	if index < 0 {
+		return ""
+	}
+	return scope[:index]
+}
+
+func protoRPCSignature(rpc *protoRPCSchema) string {
+	request, response := rpc.request, rpc.returns
+	if rpc.StreamsRequest {
+		request = "stream " + request
+	}
+	if rpc.StreamsReturns {
+		response = "stream " + response
+	}
+	return "(" + request + ") returns (" + response + ")"
+}
+
+// compareProtoSchemas returns the changes from previous to current that break existing clients.
+func compareProtoSchemas(previous, current *protoSchema) []protoIssue {
+	var issues []protoIssue
+	report := func(pos scanner.Position, format string, args ...any) {
+		issues = append(issues, protoIssue{pos, fmt.Sprintf(format, args...)})
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(previous.messages)) {
+		old := previous.messages[name]
+		message, ok := current.messages[name]
+		if !ok {
+			report(old.pos, "message %s was removed", name)
+			continue
+		}
+		byName := make(map[string]*protoFieldSchema, len(message.fields))
+		for _, field := range message.fields {
+			byName[field.name] = field
+		}
+		for _, number := range slices.Sorted(maps.Keys(old.fields)) {
+			oldField := old.fields[number]
+			if field, ok := message.fields[number]; ok {
+				if field.label != oldField.label || field.typ != oldField.typ {
+					report(field.pos, "field %s.%s (%d) changed type from %s to %s", name, field.name, number, oldField, field)
+				}
+				switch {
+				case field.oneof == oldField.oneof:
+				case oldField.oneof == "":
+					report(field.pos, "field %s.%s (%d) moved into oneof %s", name, field.name, number, field.oneof)
+				case field.oneof == "":
+					report(field.pos, "field %s.%s (%d) moved out of oneof %s", name, field.name, number, oldField.oneof)
+				default:
+					report(field.pos, "field %s.%s (%d) moved from oneof %s to oneof %s", name, field.name, number, oldField.oneof, field.oneof)
+				}
+				continue
+			}
+			if field, ok := byName[oldField.name]; ok {
+				report(field.pos, "field %s.%s changed number from %d to %d", name, field.name, number, field.number)
+			} else if !message.reserved.covers(number, oldField.name) {
+				report(message.pos, "field %s.%s (%d) was removed without reserving its number", name, oldField.name, number)
+			}
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(previous.enums)) {
+		old := previous.enums[name]
+		enum, ok := current.enums[name]
+		if !ok {
+			report(old.pos, "enum %s was removed", name)
+			continue
+		}
+		for _, number := range slices.Sorted(maps.Keys(old.values)) {
+			oldValue := old.values[number]
+			if _, ok := enum.values[number]; ok || enum.reserved.covers(number, oldValue.Name) {
+				continue
+			}
+			report(enum.pos, "enum value %s.%s (%d) was removed without reserving its number", name, oldValue.Name, number)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(previous.services)) {
+		old := previous.services[name]
+		service, ok := current.services[name]
+		if !ok {
+			report(old.pos, "service %s was removed", name)
+			continue
+		}
+		for _, rpcName := range slices.Sorted(maps.Keys(old.rpcs)) {
+			rpc, ok := service.rpcs[rpcName]
+			if !ok {
+				report(service.pos, "rpc %s.%s was removed", name, rpcName)
+				continue
+			}
+			oldRPC := old.rpcs[rpcName]
+			if rpc.StreamsRequest != oldRPC.StreamsRequest || rpc.StreamsReturns != oldRPC.StreamsReturns ||
+				rpc.request != oldRPC.request || rpc.returns != oldRPC.returns {
+				report(rpc.Position, "rpc %s.%s changed from %s to %s", name, rpcName, protoRPCSignature(oldRPC), protoRPCSignature(rpc))
+			}
+		}
+	}
+	return issues
+}
+
+// CheckProtocolBreaking compares the protos under the roots with those at a git ref and fails on
+// removed messages, fields, enum values, services or rpcs and on changed field numbers or types.
+// Removing a field or an enum value is allowed when its number or name is reserved.
+func CheckProtocolBreaking(codeOpt *ProtocolOptions, ref string) error {
+	return CheckProtocolBreakingContext(context.Background(), codeOpt, ref)
+}
+
+// CheckProtocolBreakingContext is CheckProtocolBreaking, git is killed when ctx is done.
+func CheckProtocolBreakingContext(ctx context.Context, codeOpt *ProtocolOptions, ref string) error {
+	opt := ResolveProtocolOptions(codeOpt)
+	packages, err := discoverProtoPackages(opt)
+	if err != nil {
+		return err
+	}
+	current := newProtoSchema()
+	for _, pkg := range packages {
+		for _, file := range pkg.files {
+			content, err := os.ReadFile(file.path())
+			if err != nil {
+				return err
+			}
+			definition, err := parseProtoSource(file.path(), content)
+			if err != nil {
+				return err
+			}
+			current.add(definition)
+		}
+	}
+	current.resolve()
+
+	previous := newProtoSchema()
+	files := 0
+	for _, root := range opt.GetRoots() {
+		var list bytes.Buffer
+		if err := NewCmd("git").WithArgs("ls-tree", "-r", "-z", "--name-only", ref, "--", root).WithStdout(&list).RunContext(ctx); err != nil {
+			return fmt.Errorf("failed to list the protos of %s at %s: %v", root, ref, err)
+		}
+		for _, name := range strings.Split(list.String(), "\x00") {
+			if path.Ext(name) != ".proto" || slices.ContainsFunc(strings.Split(name, "/"), func(elem string) bool { return strings.HasPrefix(elem, ".") }) {
+				continue
+			}
+			var content bytes.Buffer
+			if err := NewCmd("git").WithArgs("show", ref+":./"+name).WithStdout(&content).RunContext(ctx); err != nil {
+				return fmt.Errorf("failed to read %s at %s: %v", name, ref, err)
+			}
+			definition, err := parseProtoSource(ref+":"+name, content.Bytes())
+			if err != nil {
+				return err
+			}
+			previous.add(definition)
+			files++
+		}
+	}
+	previous.resolve()
+
+	if err := reportProtoIssues(compareProtoSchemas(previous, current), "breaking change(s) since "+ref); err != nil {
+		return err
+	}
+	PrintGreen(fmt.Sprintf("No breaking changes since %s in %d proto file(s)", ref, files))
+	return nil
+}
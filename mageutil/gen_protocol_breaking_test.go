@@ -0,0 +1,164 @@
+package mageutil
+
+import (
+	"slices"
+	"testing"
+)
+
+func testProtoSchema(t *testing.T, source string) *protoSchema {
+	t.Helper()
+	definition, err := parseProtoSource("test.proto", []byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := newProtoSchema()
+	schema.add(definition)
+	schema.resolve()
+	return schema
+}
+
+func TestCompareProtoSchemas(t *testing.T) {
+	const header = "syntax = \"proto3\";\npackage demo.v1;\n"
+	tests := []struct {
+		name              string
+		previous, current string
+		want              []string
+	}{
+		{
+			name:     "unchanged",
+			previous: "message A { string id = 1; }",
+			current:  "message A { string id = 1; }",
+		},
+		{
+			name:     "added field",
+			previous: "message A { string id = 1; }",
+			current:  "message A { string id = 1; int64 seq = 2; }",
+		},
+		{
+			name:     "removed message",
+			previous: "message A {} message B {}",
+			current:  "message A {}",
+			want:     []string{"message demo.v1.B was removed"},
+		},
+		{
+			name:     "removed field",
+			previous: "message A { string id = 1; string name = 2; }",
+			current:  "message A { string id = 1; }",
+			want:     []string{"field demo.v1.A.name (2) was removed without reserving its number"},
+		},
+		{
+			name:     "removed field with reserved number",
+			previous: "message A { string id = 1; string name = 2; }",
+			current:  "message A { reserved 2; string id = 1; }",
+		},
+		{
+			name:     "removed field with reserved name",
+			previous: "message A { string id = 1; string name = 2; }",
+			current:  "message A { reserved \"name\"; string id = 1; }",
+		},
+		{
+			name:     "renumbered field",
+			previous: "message A { string id = 1; }",
+			current:  "message A { string id = 2; }",
+			want:     []string{"field demo.v1.A.id changed number from 1 to 2"},
+		},
+		{
+			name:     "changed scalar type",
+			previous: "message A { int32 id = 1; }",
+			current:  "message A { int64 id = 1; }",
+			want:     []string{"field demo.v1.A.id (1) changed type from int32 to int64"},
+		},
+		{
+			name:     "changed label",
+			previous: "message A { string id = 1; }",
+			current:  "message A { repeated string id = 1; }",
+			want:     []string{"field demo.v1.A.id (1) changed type from string to repeated string"},
+		},
+		{
+			name:     "qualified reference to the same type",
+			previous: "message Foo {} message A { Foo foo = 1; }",
+			current:  "message Foo {} message A { .demo.v1.Foo foo = 1; }",
+		},
+		{
+			name:     "package relative reference to the same type",
+			previous: "message Foo {} message A { Foo foo = 1; }",
+			current:  "message Foo {} message A { v1.Foo foo = 1; }",
+		},
+		{
+			name:     "reference to a nested type with the same name",
+			previous: "message Foo {} message Bar { message Foo {} } message A { Foo foo = 1; }",
+			current:  "message Foo {} message Bar { message Foo {} } message A { Bar.Foo foo = 1; }",
+			want:     []string{"field demo.v1.A.foo (1) changed type from demo.v1.Foo to demo.v1.Bar.Foo"},
+		},
+		{
+			name:     "nested type shadows the package type",
+			previous: "message Foo {} message A { Foo foo = 1; }",
+			current:  "message Foo {} message A { message Foo {} Foo foo = 1; }",
+			want:     []string{"field demo.v1.A.foo (1) changed type from demo.v1.Foo to demo.v1.A.Foo"},
+		},
+		{
+			name:     "map value type",
+			previous: "message A { map<string, int32> m = 1; }",
+			current:  "message A { map<string, int64> m = 1; }",
+			want:     []string{"field demo.v1.A.m (1) changed type from map<string> int32 to map<string> int64"},
+		},
+		{
+			name:     "field moved into a oneof",
+			previous: "message A { string id = 1; }",
+			current:  "message A { oneof key { string id = 1; } }",
+			want:     []string{"field demo.v1.A.id (1) moved into oneof key"},
+		},
+		{
+			name:     "field moved out of a oneof",
+			previous: "message A { oneof key { string id = 1; } }",
+			current:  "message A { string id = 1; }",
+			want:     []string{"field demo.v1.A.id (1) moved out of oneof key"},
+		},
+		{
+			name:     "field moved between oneofs",
+			previous: "message A { oneof key { string id = 1; } }",
+			current:  "message A { oneof ref { string id = 1; } }",
+			want:     []string{"field demo.v1.A.id (1) moved from oneof key to oneof ref"},
+		},
+		{
+			name:     "removed enum value",
+			previous: "enum E { E_UNSPECIFIED = 0; E_ONE = 1; }",
+			current:  "enum E { E_UNSPECIFIED = 0; }",
+			want:     []string{"enum value demo.v1.E.E_ONE (1) was removed without reserving its number"},
+		},
+		{
+			name:     "removed enum value with reserved number",
+			previous: "enum E { E_UNSPECIFIED = 0; E_ONE = 1; }",
+			current:  "enum E { reserved 1; E_UNSPECIFIED = 0; }",
+		},
+		{
+			name:     "removed rpc",
+			previous: "message M {} service S { rpc Get(M) returns (M); rpc Put(M) returns (M); }",
+			current:  "message M {} service S { rpc Get(M) returns (M); }",
+			want:     []string{"rpc demo.v1.S.Put was removed"},
+		},
+		{
+			name:     "streaming rpc",
+			previous: "message M {} service S { rpc Get(M) returns (M); }",
+			current:  "message M {} service S { rpc Get(M) returns (stream M); }",
+			want:     []string{"rpc demo.v1.S.Get changed from (demo.v1.M) returns (demo.v1.M) to (demo.v1.M) returns (stream demo.v1.M)"},
+		},
+		{
+			name:     "rpc with a qualified request",
+			previous: "message M {} service S { rpc Get(M) returns (M); }",
+			current:  "message M {} service S { rpc Get(.demo.v1.M) returns (M); }",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issues := compareProtoSchemas(testProtoSchema(t, header+tt.previous), testProtoSchema(t, header+tt.current))
+			got := make([]string, 0, len(issues))
+			for _, issue := range issues {
+				got = append(got, issue.text)
+			}
+			if !slices.Equal(got, tt.want) && len(got)+len(tt.want) > 0 {
+				t.Errorf("compareProtoSchemas() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
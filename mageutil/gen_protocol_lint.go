@@ -0,0 +1,180 @@
+package mageutil
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/scanner"
+
+	"github.com/emicklei/proto"
+)
+
+var (
+	protoPackageNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*(\.[a-z][a-z0-9_]*)*$`)
+	protoUpperCamelPattern  = regexp.MustCompile(`^[A-Z][A-Za-z0-9]*$`)
+	protoLowerSnakePattern  = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	protoUpperSnakePattern  = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+)
+
+// protoIssue is a lint or breaking change finding at a position of a proto file.
+type protoIssue struct {
+	pos  scanner.Position
+	text string
+}
+
+func (i protoIssue) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s", i.pos.Filename, i.pos.Line, i.pos.Column, i.text)
+}
+
+// reportProtoIssues prints the issues sorted by position and returns an error when there is any.
+func reportProtoIssues(issues []protoIssue, what string) error {
+	slices.SortFunc(issues, func(a, b protoIssue) int {
+		return cmp.Or(strings.Compare(a.pos.Filename, b.pos.Filename), cmp.Compare(a.pos.Line, b.pos.Line), cmp.Compare(a.pos.Column, b.pos.Column))
+	})
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("found %d %s", len(issues), what)
+	}
+	return nil
+}
+
+// parseProtoSource parses a proto file, filename is only used in positions.
+func parseProtoSource(filename string, content []byte) (*proto.Proto, error) {
+	parser := proto.NewParser(bytes.NewReader(content))
+	parser.Filename(filename)
+	definition, err := parser.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", filename, err)
+	}
+	return definition, nil
+}
+
+// protoPackageName returns the package declared by a proto file, or "".
+func protoPackageName(definition *proto.Proto) string {
+	for _, element := range definition.Elements {
+		if pkg, ok := element.(*proto.Package); ok {
+			return pkg.Name
+		}
+	}
+	return ""
+}
+
+// LintProtocol checks the naming of the protos under the roots, that every file declares a package
+// and that the files of a directory share their package and go_package, inside the module.
+func LintProtocol(codeOpt *ProtocolOptions) error {
+	opt := ResolveProtocolOptions(codeOpt)
+	module, err := opt.GetModule()
+	if err != nil {
+		return err
+	}
+	packages, err := discoverProtoPackages(opt)
+	if err != nil {
+		return err
+	}
+
+	var issues []protoIssue
+	// dirPackages is the package and go_package of the first file of a directory.
+	type dirPackages struct {
+		file, protoPkg, goPkg string
+	}
+	dirs := make(map[string]*dirPackages)
+	files := 0
+	for _, pkg := range packages {
+		for _, file := range pkg.files {
+			files++
+			content, err := os.ReadFile(file.path())
+			if err != nil {
+				return err
+			}
+			definition, err := parseProtoSource(file.path(), content)
+			if err != nil {
+				return err
+			}
+			issues = append(issues, lintProtoFile(definition)...)
+
+			start := scanner.Position{Filename: file.path(), Line: 1, Column: 1}
+			if pkg.goPackage != module && !strings.HasPrefix(pkg.goPackage, module+"/") {
+				issues = append(issues, protoIssue{start, fmt.Sprintf("go_package %s is outside of module %s", pkg.goPackage, module)})
+			}
+			dir := filepath.Dir(file.path())
+
+			protoPkg := protoPackageName(definition)
+			seen, ok := dirs[dir]
+			if !ok {
+				dirs[dir] = &dirPackages{file: file.path(), protoPkg: protoPkg, goPkg: pkg.goPackage}
+				continue
+			}
+			if protoPkg != seen.protoPkg {
+				issues = append(issues, protoIssue{start, fmt.Sprintf("package %q differs from package %q of %s in the same directory", protoPkg, seen.protoPkg, seen.file)})
+			}
+			if pkg.goPackage != seen.goPkg {
+				issues = append(issues, protoIssue{start, fmt.Sprintf("go_package %s differs from go_package %s of %s in the same directory", pkg.goPackage, seen.goPkg, seen.file)})
+			}
+		}
+	}
+
+	if err := reportProtoIssues(issues, "proto lint issue(s)"); err != nil {
+		return err
+	}
+	PrintGreen(fmt.Sprintf("Linted %d proto file(s), no issues found", files))
+	return nil
+}
+
+// lintProtoFile checks the package declaration and the naming of the definitions of a file.
+func lintProtoFile(definition *proto.Proto) []protoIssue {
+	var issues []protoIssue
+	check := func(pos scanner.Position, kind, name string, pattern *regexp.Regexp, style string) {
+		if !pattern.MatchString(name) {
+			issues = append(issues, protoIssue{pos, fmt.Sprintf("%s name %q should be %s", kind, name, style)})
+		}
+	}
+
+	hasPackage := false
+	proto.Walk(definition,
+		proto.WithPackage(func(p *proto.Package) {
+			hasPackage = true
+			check(p.Position, "package", p.Name, protoPackageNamePattern, "lower_snake_case separated by dots")
+		}),
+		proto.WithMessage(func(m *proto.Message) {
+			if !m.IsExtend {
+				check(m.Position, "message", m.Name, protoUpperCamelPattern, "UpperCamelCase")
+			}
+		}),
+		proto.WithNormalField(func(f *proto.NormalField) {
+			check(f.Position, "field", f.Name, protoLowerSnakePattern, "lower_snake_case")
+		}),
+		func(v proto.Visitee) {
+			switch element := v.(type) {
+			case *proto.MapField:
+				check(element.Position, "field", element.Name, protoLowerSnakePattern, "lower_snake_case")
+			case *proto.OneOfField:
+				check(element.Position, "field", element.Name, protoLowerSnakePattern, "lower_snake_case")
+			case *proto.EnumField:
+				check(element.Position, "enum value", element.Name, protoUpperSnakePattern, "UPPER_SNAKE_CASE")
+			}
+		},
+		proto.WithOneof(func(o *proto.Oneof) {
+			check(o.Position, "oneof", o.Name, protoLowerSnakePattern, "lower_snake_case")
+		}),
+		proto.WithEnum(func(e *proto.Enum) {
+			check(e.Position, "enum", e.Name, protoUpperCamelPattern, "UpperCamelCase")
+		}),
+		proto.WithService(func(s *proto.Service) {
+			check(s.Position, "service", s.Name, protoUpperCamelPattern, "UpperCamelCase")
+		}),
+		proto.WithRPC(func(r *proto.RPC) {
+			check(r.Position, "rpc", r.Name, protoUpperCamelPattern, "UpperCamelCase")
+		}),
+	)
+	if !hasPackage {
+		issues = append(issues, protoIssue{scanner.Position{Filename: definition.Filename, Line: 1, Column: 1}, "missing package declaration"})
+	}
+	return issues
+}
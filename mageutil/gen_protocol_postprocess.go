@@ -0,0 +1,249 @@
+package mageutil
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/imports"
+)
+
+// ProtoPostProcessor is a step applied to the syntax tree of every generated Go file.
+type ProtoPostProcessor struct {
+	// Name identifies the step in errors and in the inputs of incremental generation, rename it when
+	// its behavior changes so that the code is regenerated.
+	Name string
+	// Process edits the file in place.
+	Process func(fset *token.FileSet, file *ast.File) error
+}
+
+// ProtoPostProcessors run in order on the generated code, which is then formatted with goimports.
+// Magefiles add their own steps with RegisterProtoPostProcessor.
+var ProtoPostProcessors = []ProtoPostProcessor{StripJSONOmitempty()}
+
+// RegisterProtoPostProcessor appends a step to ProtoPostProcessors, e.g. from an init function of the magefile.
+func RegisterProtoPostProcessor(step ProtoPostProcessor) {
+	ProtoPostProcessors = append(ProtoPostProcessors, step)
+}
+
+// protoPostProcessingNames lists the steps applied to the generated code, for the input hash.
+func protoPostProcessingNames() string {
+	names := make([]string, 0, len(ProtoPostProcessors)+1)
+	for _, step := range ProtoPostProcessors {
+		names = append(names, step.Name)
+	}
+	return strings.Join(append(names, "goimports"), ",")
+}
+
+// postProcessGoSource parses a generated file, applies the steps and formats it with goimports.
+func postProcessGoSource(filename string, src []byte, steps []ProtoPostProcessor) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range steps {
+		if err := step.Process(fset, file); err != nil {
+			return nil, fmt.Errorf("%s: %v", step.Name, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	config := printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+	if err := config.Fprint(&buf, fset, file); err != nil {
+		return nil, err
+	}
+	formatted, err := imports.Process(filename, buf.Bytes(), &imports.Options{Comments: true, TabIndent: true, TabWidth: 8})
+	if err != nil {
+		return nil, fmt.Errorf("goimports: %v", err)
+	}
+	return formatted, nil
+}
+
+// StripJSONOmitempty removes the omitempty option of json struct tags, so that zero values are
+// serialized. Other tags and strings are left alone.
+func StripJSONOmitempty() ProtoPostProcessor {
+	return ProtoPostProcessor{
+		Name: "strip-json-omitempty",
+		Process: func(_ *token.FileSet, file *ast.File) error {
+			return rewriteStructTags(file, func(field *ast.Field, tags []structTag) []structTag {
+				for i, tag := range tags {
+					if tag.key != "json" {
+						continue
+					}
+					// The first element is the name, which may be "omitempty" itself.
+					options := strings.Split(tag.value, ",")
+					tags[i].value = strings.Join(append(options[:1], slices.DeleteFunc(options[1:], func(o string) bool { return o == "omitempty" })...), ",")
+				}
+				return tags
+			})
+		},
+	}
+}
+
+// AddStructTags adds a tag for each key with the name of the json tag to the fields of the generated
+// structs, e.g. AddStructTags("bson") adds bson:"user_id" next to json:"user_id". Tags written in a
+// proto comment as `@gotags: key:"value"` are set on their field as well, and win over the added ones.
+func AddStructTags(keys ...string) ProtoPostProcessor {
+	return ProtoPostProcessor{
+		Name: "struct-tags:" + strings.Join(keys, ","),
+		Process: func(_ *token.FileSet, file *ast.File) error {
+			return rewriteStructTags(file, func(field *ast.Field, tags []structTag) []structTag {
+				name := ""
+				for _, tag := range tags {
+					if tag.key == "json" {
+						name, _, _ = strings.Cut(tag.value, ",")
+					}
+				}
+				if name == "" || name == "-" {
+					return tags
+				}
+				for _, key := range keys {
+					tags = setStructTag(tags, structTag{key: key, value: name}, false)
+				}
+				for _, group := range []*ast.CommentGroup{field.Doc, field.Comment} {
+					if group == nil {
+						continue
+					}
+					for _, comment := range group.List {
+						_, injected, ok := strings.Cut(comment.Text, "@gotags:")
+						if !ok {
+							continue
+						}
+						injectedTags, ok := parseStructTag(strings.TrimSpace(injected))
+						if !ok {
+							continue
+						}
+						for _, tag := range injectedTags {
+							tags = setStructTag(tags, tag, true)
+						}
+					}
+				}
+				return tags
+			})
+		},
+	}
+}
+
+// RemoveOmitemptyFromFile strips the omitempty option of the json tags of a Go file, keeping its permissions.
+func RemoveOmitemptyFromFile(filePath string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return fmt.Errorf("error opening file: %s", err)
+	}
+	src, err := os.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("error reading file: %s", err)
+	}
+	processed, err := postProcessGoSource(filePath, src, []ProtoPostProcessor{StripJSONOmitempty()})
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(processed, src) {
+		return nil
+	}
+	return os.WriteFile(filePath, processed, info.Mode().Perm())
+}
+
+type structTag struct {
+	key   string
+	value string
+}
+
+// rewriteStructTags calls rewrite with the parsed tags of every tagged struct field and replaces the
+// tag when the result differs. Tags not in the key:"value" convention are left alone.
+func rewriteStructTags(file *ast.File, rewrite func(field *ast.Field, tags []structTag) []structTag) error {
+	var err error
+	ast.Inspect(file, func(node ast.Node) bool {
+		structType, ok := node.(*ast.StructType)
+		if !ok || err != nil {
+			return err == nil
+		}
+		for _, field := range structType.Fields.List {
+			if field.Tag == nil {
+				continue
+			}
+			var raw string
+			if raw, err = strconv.Unquote(field.Tag.Value); err != nil {
+				err = fmt.Errorf("invalid struct tag %s: %v", field.Tag.Value, err)
+				return false
+			}
+			tags, ok := parseStructTag(raw)
+			if !ok {
+				continue
+			}
+			before := formatStructTag(tags)
+			tag := formatStructTag(rewrite(field, tags))
+			if tag == before {
+				continue
+			}
+			if strings.Contains(tag, "`") {
+				field.Tag.Value = strconv.Quote(tag)
+			} else {
+				field.Tag.Value = "`" + tag + "`"
+			}
+		}
+		return true
+	})
+	return err
+}
+
+// parseStructTag splits a tag into its key:"value" pairs, in order. It fails when the tag does not
+// follow the convention.
+func parseStructTag(tag string) ([]structTag, bool) {
+	var tags []structTag
+	for {
+		tag = strings.TrimLeft(tag, " ")
+		if tag == "" {
+			return tags, true
+		}
+		key, rest, ok := strings.Cut(tag, ":")
+		if !ok || key == "" || strings.ContainsAny(key, " \"\t") || !strings.HasPrefix(rest, `"`) {
+			return nil, false
+		}
+		end := 1
+		for end < len(rest) && rest[end] != '"' {
+			if rest[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(rest) {
+			return nil, false
+		}
+		value, err := strconv.Unquote(rest[:end+1])
+		if err != nil {
+			return nil, false
+		}
+		tags = append(tags, structTag{key: key, value: value})
+		tag = rest[end+1:]
+	}
+}
+
+func formatStructTag(tags []structTag) string {
+	parts := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		parts = append(parts, tag.key+":"+strconv.Quote(tag.value))
+	}
+	return strings.Join(parts, " ")
+}
+
+// setStructTag adds a tag, or replaces the value of an existing key when override is set.
+func setStructTag(tags []structTag, tag structTag, override bool) []structTag {
+	for i := range tags {
+		if tags[i].key == tag.key {
+			if override {
+				tags[i].value = tag.value
+			}
+			return tags
+		}
+	}
+	return append(tags, tag)
+}
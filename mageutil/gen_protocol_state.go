@@ -0,0 +1,181 @@
+package mageutil
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// protocolStateFile records the inputs and outputs of the last generation of every proto package.
+const protocolStateFile = "protocol-state.json"
+
+var protoImportPattern = regexp.MustCompile(`(?m)^\s*import\s+(?:public\s+|weak\s+)?"([^"]+)"\s*;`)
+
+// protocolState maps a Go package to the state of its last generation.
+type protocolState map[string]protocolPackageState
+
+type protocolPackageState struct {
+	// Inputs is the hash of everything the generated code depends on.
+	Inputs string `json:"inputs"`
+	// Outputs maps the generated files relative to the output directory to their SHA-256.
+	Outputs map[string]string `json:"outputs"`
+}
+
+func protocolStatePath() string {
+	return filepath.Join(Paths.OutputTmp, protocolStateFile)
+}
+
+func loadProtocolState() (protocolState, error) {
+	content, err := os.ReadFile(protocolStatePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return protocolState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := protocolState{}
+	if err := json.Unmarshal(content, &state); err != nil {
+		PrintYellow(fmt.Sprintf("Ignoring invalid %s, regenerating every package: %v", protocolStatePath(), err))
+		return protocolState{}, nil
+	}
+	return state, nil
+}
+
+func (state protocolState) save() error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(Paths.OutputTmp, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", Paths.OutputTmp, err)
+	}
+	if err := os.WriteFile(protocolStatePath(), content, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", protocolStatePath(), err)
+	}
+	return nil
+}
+
+// upToDate reports whether the inputs are unchanged and the generated files were not modified or removed.
+func (s protocolPackageState) upToDate(inputs, outputDir string) bool {
+	if s.Inputs != inputs || len(s.Outputs) == 0 {
+		return false
+	}
+	for name, sum := range s.Outputs {
+		current, err := fileSHA256(filepath.Join(outputDir, filepath.FromSlash(name)))
+		if err != nil || current != sum {
+			return false
+		}
+	}
+	return true
+}
+
+// inputHash hashes the protoc version, the options, the plugins and the content of the protos of a
+// package with everything they import from the roots and includes.
+func (run *protocolRun) inputHash(pkg *protoPackage, plugins []ProtocPlugin) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "protoc %s\nmodule %s\noutput %s\npost %s\n", run.protocVersion, run.module, run.opt.GetOutputDir(), protoPostProcessingNames())
+	for _, mapping := range run.mappings {
+		fmt.Fprintf(h, "mapping %s\n", mapping)
+	}
+	for _, plugin := range plugins {
+		fmt.Fprintf(h, "plugin %s %s@%s %s\n", plugin.Name, plugin.Package, plugin.Version, strings.Join(plugin.Opts, ","))
+	}
+
+	files, err := run.importClosure(pkg)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		fmt.Fprintf(h, "file %s %s\n", name, files[name])
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// importClosure returns the SHA-256 of the files of a package and of the files they import, by
+// import name. Imports outside of the roots and includes, such as the well-known types, are
+// covered by the protoc version.
+func (run *protocolRun) importClosure(pkg *protoPackage) (map[string]string, error) {
+	importPaths := append(slices.Clone(run.opt.GetRoots()), run.opt.GetIncludes()...)
+	sums := make(map[string]string)
+	queue := make([]string, 0, len(pkg.files))
+	paths := make(map[string]string)
+	for _, file := range pkg.files {
+		queue = append(queue, file.name)
+		paths[file.name] = file.path()
+	}
+
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if _, ok := sums[name]; ok {
+			continue
+		}
+		content, err := os.ReadFile(paths[name])
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(content)
+		sums[name] = hex.EncodeToString(sum[:])
+
+		for _, match := range protoImportPattern.FindAllSubmatch(content, -1) {
+			imported := string(match[1])
+			if _, ok := paths[imported]; ok {
+				queue = append(queue, imported)
+				continue
+			}
+			for _, importPath := range importPaths {
+				candidate := filepath.Join(importPath, filepath.FromSlash(imported))
+				if _, err := os.Stat(candidate); err == nil {
+					paths[imported] = candidate
+					queue = append(queue, imported)
+					break
+				}
+			}
+		}
+	}
+	return sums, nil
+}
+
+// writeGeneratedFiles writes the generated files that changed into the output directory, removes
+// the previously generated ones that are no longer generated and returns the SHA-256 of the files.
+func writeGeneratedFiles(outputDir string, generated map[string][]byte, previous map[string]string) (map[string]string, error) {
+	outputs := make(map[string]string, len(generated))
+	for _, name := range slices.Sorted(maps.Keys(generated)) {
+		content := generated[name]
+		sum := sha256.Sum256(content)
+		outputs[name] = hex.EncodeToString(sum[:])
+
+		target := filepath.Join(outputDir, filepath.FromSlash(name))
+		if current, err := os.ReadFile(target); err == nil && bytes.Equal(current, content) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory %s: %v", filepath.Dir(target), err)
+		}
+		if err := os.WriteFile(target, content, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %v", target, err)
+		}
+		PrintGreen(fmt.Sprintf("Generated %s", target))
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(previous)) {
+		if _, ok := generated[name]; ok {
+			continue
+		}
+		target := filepath.Join(outputDir, filepath.FromSlash(name))
+		if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove %s: %v", target, err)
+		}
+		PrintYellow(fmt.Sprintf("Removed %s, it is no longer generated", target))
+	}
+	return outputs, nil
+}
@@ -0,0 +1,331 @@
+package mageutil
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/openimsdk/gomake/internal/util"
+)
+
+const defaultImagePath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+type ImageOptions struct {
+	ProjectName   *string
+	ImageRegistry *string
+	ImageTag      *string
+	// BaseImage is an OCI image layout tarball used as the base of every image.
+	BaseImage *string
+	// Bundle builds one image holding all binaries with the standalone launcher as entrypoint,
+	// instead of one image per service.
+	Bundle   *bool
+	BuildOpt *BuildOptions
+}
+
+func (opt *ImageOptions) GetBaseImage() string {
+	return strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).BaseImage))
+}
+
+func (opt *ImageOptions) GetBundle() bool {
+	return util.NilAsZero(util.NilAsZero(opt).Bundle)
+}
+
+func (opt *ImageOptions) GetBuildOpt() *BuildOptions {
+	return util.NilAsZero(opt).BuildOpt
+}
+
+// GetK8sOptions returns the naming options shared with the generated Kubernetes manifests.
+func (opt *ImageOptions) GetK8sOptions() *K8sOptions {
+	o := util.NilAsZero(opt)
+	return &K8sOptions{ProjectName: o.ProjectName, ImageRegistry: o.ImageRegistry, ImageTag: o.ImageTag}
+}
+
+// ResolveImageOptions fills the options not set in code from IMAGE_REGISTRY, IMAGE_TAG, BASE_IMAGE and IMAGE_BUNDLE.
+func ResolveImageOptions(codeOpt *ImageOptions) *ImageOptions {
+	fromCode := util.NilAsZero(codeOpt)
+	return &ImageOptions{
+		ProjectName:   fromCode.ProjectName,
+		ImageRegistry: util.CoalescePtr(fromCode.ImageRegistry, util.ResolveEnvOption[string]("IMAGE_REGISTRY")),
+		ImageTag:      util.CoalescePtr(fromCode.ImageTag, util.ResolveEnvOption[string]("IMAGE_TAG")),
+		BaseImage:     util.CoalescePtr(fromCode.BaseImage, util.ResolveEnvOption[string]("BASE_IMAGE")),
+		Bundle:        util.CoalescePtr(fromCode.Bundle, util.ResolveEnvOption[bool]("IMAGE_BUNDLE")),
+		BuildOpt:      fromCode.BuildOpt,
+	}
+}
+
+// imageSpec describes one image to build for a single platform.
+type imageSpec struct {
+	layers []map[string]string
+	config ociContainerCfg
+}
+
+// BuildImages builds OCI image layout tarballs without a container daemon. Every image
+// contains one manifest per platform of the build options, bundled in an image index.
+func BuildImages(imageOpt *ImageOptions) error {
+	return BuildImagesContext(context.Background(), imageOpt)
+}
+
+// BuildImagesContext is BuildImages, the compilers are killed when ctx is done.
+func BuildImagesContext(ctx context.Context, imageOpt *ImageOptions) error {
+	opt := ResolveImageOptions(imageOpt)
+
+	PrintBlue("Building binaries before creating images...")
+	BuildContext(ctx, nil, nil, withTrimPath(opt.GetBuildOpt()))
+
+	config, err := loadValidStartConfig()
+	if err != nil {
+		return err
+	}
+
+	resolvedPlatforms := resolvePlatforms(resolveBuildOptionsFromEnv(opt.GetBuildOpt()))
+	if err := validatePlatforms(ctx, resolvedPlatforms); err != nil {
+		return err
+	}
+	var platforms []string
+	for _, platform := range resolvedPlatforms {
+		if strings.HasPrefix(platform, "windows_") {
+			PrintYellow(fmt.Sprintf("Skipping %s, images are only built for Linux and other Unix platforms", platform))
+			continue
+		}
+		platforms = append(platforms, platform)
+	}
+	if len(platforms) == 0 {
+		return fmt.Errorf("no platforms to build images for")
+	}
+
+	var base *ociLayout
+	if baseImage := opt.GetBaseImage(); baseImage != "" {
+		PrintBlue(fmt.Sprintf("Using base image %s", baseImage))
+		if base, err = openOCIArchive(baseImage, filepath.Join(Paths.OutputTmp, "oci-base")); err != nil {
+			return err
+		}
+	}
+
+	imagesDir := filepath.Join(Paths.Output, ImagesDir)
+	if err := os.MkdirAll(imagesDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", imagesDir, err)
+	}
+
+	k8sOpt := opt.GetK8sOptions()
+	if opt.GetBundle() {
+		name := k8sOpt.GetProjectName()
+		if name == "" {
+			name = "bundle"
+		}
+		return buildImage(name, k8sOpt.ImageName(name), base, platforms, func(platform string) (imageSpec, error) {
+			return bundleImageSpec(ctx, platform, name, config)
+		})
+	}
+
+	services := make([]string, 0, len(config.ServiceBinaries))
+	for name := range config.ServiceBinaries {
+		services = append(services, name)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		cfg := config.ServiceBinaries[service]
+		err := buildImage(k8sName(service), cfg.Kubernetes.imageOr(k8sOpt.ImageName(service)), base, platforms, func(platform string) (imageSpec, error) {
+			return serviceImageSpec(platform, service, cfg)
+		})
+		if err != nil {
+			return fmt.Errorf("service %s: %v", service, err)
+		}
+	}
+	return nil
+}
+
+func serviceImageSpec(platform, service string, cfg ServiceConfig) (imageSpec, error) {
+	targetOS, targetArch, _ := strings.Cut(platform, "_")
+	binary := filepath.Join(Paths.OutputBinPath, targetOS, targetArch, service)
+	if err := util.CheckExist(binary); err != nil {
+		return imageSpec{}, err
+	}
+
+	bindings, err := cfg.ResolvePorts(0)
+	if err != nil {
+		return imageSpec{}, err
+	}
+
+	var layers []map[string]string
+	if _, err := os.Stat(Paths.Config); err == nil {
+		layers = append(layers, map[string]string{Paths.Config: "config"})
+	}
+	layers = append(layers, map[string]string{binary: "app/" + service})
+
+	return imageSpec{
+		layers: layers,
+		config: ociContainerCfg{
+			ExposedPorts: exposedPorts(bindings),
+			Entrypoint:   []string{"/app/" + service},
+			Cmd:          []string{"-i", "0", "-c", k8sConfigMountPath},
+			WorkingDir:   "/app",
+		},
+	}, nil
+}
+
+func bundleImageSpec(ctx context.Context, platform, name string, config *Config) (imageSpec, error) {
+	targetOS, targetArch, _ := strings.Cut(platform, "_")
+
+	launcherPath, err := buildStandaloneLauncher(ctx, platform, LauncherInfo{Project: name, Version: gitDescribe(ctx)})
+	if err != nil {
+		return imageSpec{}, err
+	}
+
+	paths := []string{
+		filepath.Join(Paths.OutputBinPath, targetOS, targetArch),
+		filepath.Join(Paths.OutputBinToolPath, targetOS, targetArch),
+		filepath.Join(Paths.Root, StartConfigFile),
+	}
+	if _, err := os.Stat(Paths.Config); err == nil {
+		paths = append(paths, Paths.Config)
+	}
+	relPaths, err := EnsureRootRelPaths(paths...)
+	if err != nil {
+		return imageSpec{}, err
+	}
+	files := make(map[string]string, len(relPaths))
+	for src, rel := range relPaths {
+		files[src] = "app/" + rel
+	}
+
+	var bindings []PortBinding
+	for name, service := range config.ServiceBinaries {
+		for i := 0; i < service.Count; i++ {
+			ports, err := service.ResolvePorts(i)
+			if err != nil {
+				return imageSpec{}, fmt.Errorf("service %s: %v", name, err)
+			}
+			bindings = append(bindings, ports...)
+		}
+	}
+
+	return imageSpec{
+		layers: []map[string]string{files, {launcherPath: "app/mage"}},
+		config: ociContainerCfg{
+			ExposedPorts: exposedPorts(bindings),
+			Env:          []string{ForegroundEnv + "=true"},
+			Entrypoint:   []string{"/app/mage"},
+			Cmd:          []string{"start"},
+			WorkingDir:   "/app",
+		},
+	}, nil
+}
+
+func exposedPorts(bindings []PortBinding) map[string]struct{} {
+	if len(bindings) == 0 {
+		return nil
+	}
+	ports := make(map[string]struct{}, len(bindings))
+	for _, binding := range bindings {
+		ports[fmt.Sprintf("%d/%s", binding.Port, binding.Protocol)] = struct{}{}
+	}
+	return ports
+}
+
+// buildImage writes _output/images/<name>.oci.tar holding an image index for reference.
+func buildImage(name, reference string, base *ociLayout, platforms []string, spec func(platform string) (imageSpec, error)) error {
+	PrintBlue(fmt.Sprintf("Building image %s for %s", reference, strings.Join(platforms, ", ")))
+	layout, err := newOCILayout(filepath.Join(Paths.OutputTmp, "oci-"+name))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(layout.dir)
+
+	var manifests []ociDescriptor
+	for _, platform := range platforms {
+		s, err := spec(platform)
+		if err != nil {
+			return err
+		}
+		desc, err := buildPlatformManifest(layout, base, platform, s)
+		if err != nil {
+			return fmt.Errorf("%s: %v", platform, err)
+		}
+		manifests = append(manifests, desc)
+	}
+
+	indexDesc, err := layout.writeJSON(ociMediaTypeIndex, ociIndex{SchemaVersion: 2, MediaType: ociMediaTypeIndex, Manifests: manifests})
+	if err != nil {
+		return err
+	}
+	indexDesc.Annotations = map[string]string{ociAnnotationRefName: reference}
+	if err := layout.finish(ociIndex{SchemaVersion: 2, MediaType: ociMediaTypeIndex, Manifests: []ociDescriptor{indexDesc}}); err != nil {
+		return err
+	}
+
+	archivePath := filepath.Join(Paths.Output, ImagesDir, name+".oci.tar")
+	if err := layout.archiveTo(archivePath); err != nil {
+		return err
+	}
+	PrintGreen(fmt.Sprintf("Image %s written to %s", reference, archivePath))
+	return nil
+}
+
+func buildPlatformManifest(layout, base *ociLayout, platform string, s imageSpec) (ociDescriptor, error) {
+	targetOS, targetArch, _ := strings.Cut(platform, "_")
+
+	config := ociImageConfig{
+		Architecture: targetArch,
+		OS:           targetOS,
+		Config:       ociContainerCfg{Env: []string{defaultImagePath}},
+		RootFS:       ociRootFS{Type: "layers"},
+	}
+	manifest := ociManifest{SchemaVersion: 2, MediaType: ociMediaTypeManifest}
+
+	if base != nil {
+		_, baseManifest, err := base.resolveManifest(targetOS, targetArch)
+		if err != nil {
+			return ociDescriptor{}, fmt.Errorf("base image: %v", err)
+		}
+		var baseConfig ociImageConfig
+		if err := base.readJSON(baseManifest.Config, &baseConfig); err != nil {
+			return ociDescriptor{}, fmt.Errorf("base image: %v", err)
+		}
+		for _, layer := range baseManifest.Layers {
+			if err := layout.copyBlob(base, layer); err != nil {
+				return ociDescriptor{}, fmt.Errorf("base image: %v", err)
+			}
+		}
+		manifest.Layers = append(manifest.Layers, baseManifest.Layers...)
+		config.Variant = baseConfig.Variant
+		config.Config.User = baseConfig.Config.User
+		config.Config.Labels = baseConfig.Config.Labels
+		if len(baseConfig.Config.Env) > 0 {
+			config.Config.Env = baseConfig.Config.Env
+		}
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, baseConfig.RootFS.DiffIDs...)
+		config.History = append(config.History, baseConfig.History...)
+	}
+
+	for _, files := range s.layers {
+		desc, diffID, err := layout.writeLayer(files)
+		if err != nil {
+			return ociDescriptor{}, err
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+		config.History = append(config.History, ociHistory{CreatedBy: "gomake image"})
+	}
+
+	config.Config.Env = append(config.Config.Env, s.config.Env...)
+	config.Config.ExposedPorts = s.config.ExposedPorts
+	config.Config.Entrypoint = s.config.Entrypoint
+	config.Config.Cmd = s.config.Cmd
+	config.Config.WorkingDir = s.config.WorkingDir
+
+	configDesc, err := layout.writeJSON(ociMediaTypeConfig, config)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	manifest.Config = configDesc
+
+	manifestDesc, err := layout.writeJSON(ociMediaTypeManifest, manifest)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	manifestDesc.Platform = &ociPlatform{Architecture: targetArch, OS: targetOS, Variant: config.Variant}
+	return manifestDesc, nil
+}
@@ -0,0 +1,628 @@
+package mageutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/openimsdk/gomake/internal/util"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	k8sConfigMountPath = "/config"
+
+	// k8sGeneratedHeader marks the manifests written by mage k8s, only these are removed when their
+	// service is gone.
+	k8sGeneratedHeader = "# Code generated by mage k8s. DO NOT EDIT.\n"
+	// k8sKustomizationHeader is written to kustomization.yaml, whose resources not generated by
+	// mage k8s are kept.
+	k8sKustomizationHeader = "# Code generated by mage k8s. Resources added here are kept when it is regenerated.\n"
+)
+
+type K8sOptions struct {
+	ProjectName   *string
+	Namespace     *string
+	ImageRegistry *string
+	ImageTag      *string
+	OutputDir     *string
+}
+
+func (opt *K8sOptions) GetProjectName() string {
+	return k8sName(util.NilAsZero(util.NilAsZero(opt).ProjectName))
+}
+
+func (opt *K8sOptions) GetNamespace() string {
+	return strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).Namespace))
+}
+
+func (opt *K8sOptions) GetImageRegistry() string {
+	return strings.TrimSuffix(strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).ImageRegistry)), "/")
+}
+
+func (opt *K8sOptions) GetImageTag() string {
+	if tag := strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).ImageTag)); tag != "" {
+		return tag
+	}
+	return "latest"
+}
+
+// GetOutputDir returns the manifest directory, _output/k8s by default. A relative directory such as
+// deploy/k8s is relative to the root, so the manifests can be committed.
+func (opt *K8sOptions) GetOutputDir() string {
+	if dir := strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).OutputDir)); dir != "" {
+		if filepath.IsAbs(dir) {
+			return dir
+		}
+		return filepath.Join(Paths.Root, dir)
+	}
+	return filepath.Join(Paths.Output, K8sDir)
+}
+
+// ResolveK8sOptions fills the options not set in code from K8S_NAMESPACE, IMAGE_REGISTRY, IMAGE_TAG
+// and K8S_OUTPUT_DIR.
+func ResolveK8sOptions(codeOpt *K8sOptions) *K8sOptions {
+	fromCode := util.NilAsZero(codeOpt)
+	return &K8sOptions{
+		ProjectName:   fromCode.ProjectName,
+		Namespace:     util.CoalescePtr(fromCode.Namespace, util.ResolveEnvOption[string]("K8S_NAMESPACE")),
+		ImageRegistry: util.CoalescePtr(fromCode.ImageRegistry, util.ResolveEnvOption[string]("IMAGE_REGISTRY")),
+		ImageTag:      util.CoalescePtr(fromCode.ImageTag, util.ResolveEnvOption[string]("IMAGE_TAG")),
+		OutputDir:     util.CoalescePtr(fromCode.OutputDir, util.ResolveEnvOption[string]("K8S_OUTPUT_DIR")),
+	}
+}
+
+// ImageName returns the default image of a service, <registry>/[<project>-]<service>:<tag>.
+func (opt *K8sOptions) ImageName(service string) string {
+	name := k8sName(service)
+	if project := opt.GetProjectName(); project != "" {
+		name = project + "-" + name
+	}
+	if registry := opt.GetImageRegistry(); registry != "" {
+		name = registry + "/" + name
+	}
+	return name + ":" + opt.GetImageTag()
+}
+
+type k8sObjectMeta struct {
+	Name      string            `yaml:"name,omitempty"`
+	Namespace string            `yaml:"namespace,omitempty"`
+	Labels    map[string]string `yaml:"labels,omitempty"`
+}
+
+type k8sConfigMap struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   k8sObjectMeta     `yaml:"metadata"`
+	Data       map[string]string `yaml:"data,omitempty"`
+	BinaryData map[string]string `yaml:"binaryData,omitempty"`
+}
+
+type k8sDeployment struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   k8sObjectMeta     `yaml:"metadata"`
+	Spec       k8sDeploymentSpec `yaml:"spec"`
+}
+
+type k8sDeploymentSpec struct {
+	Replicas int            `yaml:"replicas"`
+	Selector k8sSelector    `yaml:"selector"`
+	Template k8sPodTemplate `yaml:"template"`
+}
+
+type k8sSelector struct {
+	MatchLabels map[string]string `yaml:"matchLabels"`
+}
+
+type k8sPodTemplate struct {
+	Metadata k8sObjectMeta `yaml:"metadata"`
+	Spec     k8sPodSpec    `yaml:"spec"`
+}
+
+type k8sPodSpec struct {
+	Containers []k8sContainer `yaml:"containers"`
+	Volumes    []k8sVolume    `yaml:"volumes,omitempty"`
+}
+
+type k8sContainer struct {
+	Name           string             `yaml:"name"`
+	Image          string             `yaml:"image"`
+	Args           []string           `yaml:"args,omitempty"`
+	Env            []k8sEnvVar        `yaml:"env,omitempty"`
+	Ports          []k8sContainerPort `yaml:"ports,omitempty"`
+	VolumeMounts   []k8sVolumeMount   `yaml:"volumeMounts,omitempty"`
+	ReadinessProbe *k8sProbe          `yaml:"readinessProbe,omitempty"`
+	LivenessProbe  *k8sProbe          `yaml:"livenessProbe,omitempty"`
+	Resources      *k8sResources      `yaml:"resources,omitempty"`
+}
+
+type k8sEnvVar struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+type k8sContainerPort struct {
+	Name          string `yaml:"name"`
+	ContainerPort int    `yaml:"containerPort"`
+	Protocol      string `yaml:"protocol"`
+}
+
+type k8sVolumeMount struct {
+	Name      string `yaml:"name"`
+	MountPath string `yaml:"mountPath"`
+	ReadOnly  bool   `yaml:"readOnly,omitempty"`
+}
+
+type k8sVolume struct {
+	Name      string             `yaml:"name"`
+	ConfigMap k8sConfigMapVolume `yaml:"configMap"`
+}
+
+type k8sConfigMapVolume struct {
+	Name  string         `yaml:"name"`
+	Items []k8sKeyToPath `yaml:"items,omitempty"`
+}
+
+type k8sKeyToPath struct {
+	Key  string `yaml:"key"`
+	Path string `yaml:"path"`
+}
+
+type k8sProbe struct {
+	TCPSocket           *k8sPortAction `yaml:"tcpSocket,omitempty"`
+	HTTPGet             *k8sPortAction `yaml:"httpGet,omitempty"`
+	GRPC                *k8sPortAction `yaml:"grpc,omitempty"`
+	InitialDelaySeconds int            `yaml:"initialDelaySeconds,omitempty"`
+	PeriodSeconds       int            `yaml:"periodSeconds,omitempty"`
+}
+
+type k8sPortAction struct {
+	Path string `yaml:"path,omitempty"`
+	Port int    `yaml:"port"`
+}
+
+type k8sResources struct {
+	Requests map[string]string `yaml:"requests,omitempty"`
+	Limits   map[string]string `yaml:"limits,omitempty"`
+}
+
+type k8sService struct {
+	APIVersion string         `yaml:"apiVersion"`
+	Kind       string         `yaml:"kind"`
+	Metadata   k8sObjectMeta  `yaml:"metadata"`
+	Spec       k8sServiceSpec `yaml:"spec"`
+}
+
+type k8sServiceSpec struct {
+	Selector map[string]string `yaml:"selector"`
+	Ports    []k8sServicePort  `yaml:"ports"`
+}
+
+type k8sServicePort struct {
+	Name       string `yaml:"name"`
+	Port       int    `yaml:"port"`
+	TargetPort int    `yaml:"targetPort"`
+	Protocol   string `yaml:"protocol"`
+}
+
+type k8sKustomization struct {
+	APIVersion string   `yaml:"apiVersion"`
+	Kind       string   `yaml:"kind"`
+	Resources  []string `yaml:"resources"`
+}
+
+// GenerateK8sManifests writes a Deployment and Service for every entry in serviceBinaries,
+// and a ConfigMap with the config directory mounted at /config. The output contains no
+// timestamps and is sorted, so regenerating unchanged input produces identical files.
+func GenerateK8sManifests(k8sOpt *K8sOptions) error {
+	opt := ResolveK8sOptions(k8sOpt)
+
+	config, err := loadValidStartConfig()
+	if err != nil {
+		return err
+	}
+
+	outputDir := opt.GetOutputDir()
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", outputDir, err)
+	}
+	previousResources, err := readK8sResources(filepath.Join(outputDir, "kustomization.yaml"))
+	if err != nil {
+		return err
+	}
+
+	configMap, items, err := buildK8sConfigMap(opt)
+	if err != nil {
+		return err
+	}
+	files := []string{"configmap.yaml"}
+	if err := writeK8sManifest(filepath.Join(outputDir, "configmap.yaml"), k8sGeneratedHeader, configMap); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(config.ServiceBinaries))
+	for name := range config.ServiceBinaries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		docs, err := buildK8sServiceManifests(opt, name, config.ServiceBinaries[name], configMap.Metadata.Name, items)
+		if err != nil {
+			return fmt.Errorf("service %s: %v", name, err)
+		}
+		file := k8sName(name) + ".yaml"
+		if err := writeK8sManifest(filepath.Join(outputDir, file), k8sGeneratedHeader, docs...); err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+
+	// The manifests of services removed from start-config.yml are removed as well. Only files carrying
+	// k8sGeneratedHeader are touched, other resources of the previous kustomization.yaml are kept.
+	resources := slices.Clone(files)
+	var removed []string
+	for _, resource := range previousResources {
+		if slices.Contains(resources, resource) {
+			continue
+		}
+		generated, err := isK8sGenerated(outputDir, resource)
+		if err != nil {
+			return err
+		}
+		if generated {
+			removed = append(removed, resource)
+		} else {
+			resources = append(resources, resource)
+		}
+	}
+
+	sort.Strings(resources)
+	kustomization := k8sKustomization{
+		APIVersion: "kustomize.config.k8s.io/v1beta1",
+		Kind:       "Kustomization",
+		Resources:  resources,
+	}
+	if err := writeK8sManifest(filepath.Join(outputDir, "kustomization.yaml"), k8sKustomizationHeader, kustomization); err != nil {
+		return err
+	}
+
+	for _, resource := range removed {
+		path := filepath.Join(outputDir, resource)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %v", path, err)
+		}
+		PrintYellow(fmt.Sprintf("Removed %s, it is no longer generated", path))
+	}
+
+	PrintGreen(fmt.Sprintf("Kubernetes manifests generated in %s", outputDir))
+	return nil
+}
+
+func k8sLabels(opt *K8sOptions, name string) map[string]string {
+	labels := map[string]string{"app.kubernetes.io/name": name}
+	if project := opt.GetProjectName(); project != "" {
+		labels["app.kubernetes.io/part-of"] = project
+	}
+	return labels
+}
+
+func buildK8sConfigMap(opt *K8sOptions) (k8sConfigMap, []k8sKeyToPath, error) {
+	name := "config"
+	if project := opt.GetProjectName(); project != "" {
+		name = project + "-config"
+	}
+	configMap := k8sConfigMap{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Metadata:   k8sObjectMeta{Name: name, Namespace: opt.GetNamespace(), Labels: k8sLabels(opt, name)},
+	}
+
+	var items []k8sKeyToPath
+	err := filepath.WalkDir(Paths.Config, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(Paths.Config, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		// ConfigMap keys cannot contain "/", nested files are mapped back through items.
+		key := strings.ReplaceAll(relPath, "/", "__")
+		if utf8.Valid(content) {
+			if configMap.Data == nil {
+				configMap.Data = make(map[string]string)
+			}
+			configMap.Data[key] = string(content)
+		} else {
+			if configMap.BinaryData == nil {
+				configMap.BinaryData = make(map[string]string)
+			}
+			configMap.BinaryData[key] = base64.StdEncoding.EncodeToString(content)
+		}
+		items = append(items, k8sKeyToPath{Key: key, Path: relPath})
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return configMap, nil, fmt.Errorf("failed to read config directory %s: %v", Paths.Config, err)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	return configMap, items, nil
+}
+
+func buildK8sServiceManifests(opt *K8sOptions, service string, cfg ServiceConfig, configMapName string, items []k8sKeyToPath) ([]any, error) {
+	name := k8sName(service)
+	labels := k8sLabels(opt, name)
+	selector := map[string]string{"app.kubernetes.io/name": name}
+
+	// Every replica has its own pod IP, so all of them run as instance 0.
+	bindings, err := cfg.ResolvePorts(0)
+	if err != nil {
+		return nil, err
+	}
+
+	container := k8sContainer{
+		Name:         name,
+		Image:        cfg.Kubernetes.imageOr(opt.ImageName(service)),
+		Args:         []string{"-i", "0", "-c", k8sConfigMountPath},
+		Env:          []k8sEnvVar{{Name: DeploymentType, Value: KUBERNETES}},
+		VolumeMounts: []k8sVolumeMount{{Name: "config", MountPath: k8sConfigMountPath, ReadOnly: true}},
+	}
+
+	var servicePorts []k8sServicePort
+	for _, binding := range bindings {
+		portName := fmt.Sprintf("%s-%d", binding.Protocol, binding.Port)
+		protocol := strings.ToUpper(binding.Protocol)
+		container.Ports = append(container.Ports, k8sContainerPort{Name: portName, ContainerPort: binding.Port, Protocol: protocol})
+		servicePorts = append(servicePorts, k8sServicePort{Name: portName, Port: binding.Port, TargetPort: binding.Port, Protocol: protocol})
+	}
+
+	probe, err := buildK8sProbe(cfg.Kubernetes.Probe, bindings)
+	if err != nil {
+		return nil, err
+	}
+	container.ReadinessProbe = probe
+	container.LivenessProbe = probe
+
+	resources, err := buildK8sResources(cfg)
+	if err != nil {
+		return nil, err
+	}
+	container.Resources = resources
+
+	deployment := k8sDeployment{
+		APIVersion: "apps/v1",
+		Kind:       "Deployment",
+		Metadata:   k8sObjectMeta{Name: name, Namespace: opt.GetNamespace(), Labels: labels},
+		Spec: k8sDeploymentSpec{
+			Replicas: cfg.Count,
+			Selector: k8sSelector{MatchLabels: selector},
+			Template: k8sPodTemplate{
+				Metadata: k8sObjectMeta{Labels: labels},
+				Spec: k8sPodSpec{
+					Containers: []k8sContainer{container},
+					Volumes: []k8sVolume{{
+						Name:      "config",
+						ConfigMap: k8sConfigMapVolume{Name: configMapName, Items: items},
+					}},
+				},
+			},
+		},
+	}
+	docs := []any{deployment}
+
+	if len(servicePorts) > 0 {
+		docs = append(docs, k8sService{
+			APIVersion: "v1",
+			Kind:       "Service",
+			Metadata:   k8sObjectMeta{Name: name, Namespace: opt.GetNamespace(), Labels: labels},
+			Spec:       k8sServiceSpec{Selector: selector, Ports: servicePorts},
+		})
+	}
+	return docs, nil
+}
+
+func buildK8sProbe(cfg *ProbeConfig, bindings []PortBinding) (*k8sProbe, error) {
+	var probeCfg ProbeConfig
+	if cfg != nil {
+		probeCfg = *cfg
+	}
+
+	port := probeCfg.Port
+	if port == 0 {
+		for _, binding := range bindings {
+			if binding.Protocol == ProtocolTCP {
+				port = binding.Port
+				break
+			}
+		}
+	}
+	if port == 0 {
+		if cfg != nil {
+			return nil, fmt.Errorf("probe needs a port, none is set and no tcp port is declared")
+		}
+		return nil, nil
+	}
+
+	probe := &k8sProbe{InitialDelaySeconds: probeCfg.InitialDelaySeconds, PeriodSeconds: probeCfg.PeriodSeconds}
+	switch strings.ToLower(probeCfg.Type) {
+	case "", "tcp":
+		probe.TCPSocket = &k8sPortAction{Port: port}
+	case "http":
+		path := probeCfg.Path
+		if path == "" {
+			path = "/"
+		}
+		probe.HTTPGet = &k8sPortAction{Path: path, Port: port}
+	case "grpc":
+		probe.GRPC = &k8sPortAction{Port: port}
+	default:
+		return nil, fmt.Errorf("invalid probe type %q: expected tcp, http or grpc", probeCfg.Type)
+	}
+	return probe, nil
+}
+
+// buildK8sResources uses the explicit kubernetes resources and falls back to the cgroup limits.
+func buildK8sResources(cfg ServiceConfig) (*k8sResources, error) {
+	resources := &k8sResources{
+		Requests: copyStringMap(cfg.Kubernetes.Resources.Requests),
+		Limits:   copyStringMap(cfg.Kubernetes.Resources.Limits),
+	}
+
+	if _, ok := resources.Limits["memory"]; !ok {
+		memory, err := cgroupMemoryToQuantity(cfg.Limits.MemoryMax)
+		if err != nil {
+			return nil, err
+		}
+		if memory != "" {
+			resources.setLimit("memory", memory)
+		}
+	}
+	if _, ok := resources.Limits["cpu"]; !ok {
+		cpu, err := cgroupCPUToQuantity(cfg.Limits.CPUMax)
+		if err != nil {
+			return nil, err
+		}
+		if cpu != "" {
+			resources.setLimit("cpu", cpu)
+		}
+	}
+
+	if len(resources.Requests) == 0 && len(resources.Limits) == 0 {
+		return nil, nil
+	}
+	return resources, nil
+}
+
+func (r *k8sResources) setLimit(name, value string) {
+	if r.Limits == nil {
+		r.Limits = make(map[string]string)
+	}
+	r.Limits[name] = value
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	copied := make(map[string]string, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
+}
+
+// cgroupMemoryToQuantity converts a memory.max value such as "512M" to "512Mi".
+func cgroupMemoryToQuantity(memoryMax string) (string, error) {
+	memoryMax = strings.TrimSpace(memoryMax)
+	if memoryMax == "" || memoryMax == "max" {
+		return "", nil
+	}
+	number, suffix := memoryMax, ""
+	if last := memoryMax[len(memoryMax)-1]; strings.ContainsRune("KMGTkmgt", rune(last)) {
+		number, suffix = memoryMax[:len(memoryMax)-1], strings.ToUpper(string(last))+"i"
+	}
+	if _, err := strconv.ParseUint(number, 10, 64); err != nil {
+		return "", fmt.Errorf("invalid memoryMax %q", memoryMax)
+	}
+	return number + suffix, nil
+}
+
+// cgroupCPUToQuantity converts a cpu.max value such as "50000 100000" to "500m".
+func cgroupCPUToQuantity(cpuMax string) (string, error) {
+	quota, period, err := parseCgroupCPUMax(cpuMax)
+	if err != nil || quota == 0 {
+		return "", err
+	}
+	return fmt.Sprintf("%dm", quota*1000/period), nil
+}
+
+var k8sInvalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// k8sName converts a binary name into a DNS-1123 compatible object name.
+func k8sName(name string) string {
+	name = strings.TrimSuffix(strings.TrimSpace(name), ".exe")
+	name = k8sInvalidNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	return strings.Trim(name, "-")
+}
+
+// readK8sResources returns the resources of a kustomization.yaml written before, if any.
+func readK8sResources(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	var kustomization k8sKustomization
+	if err := yaml.Unmarshal(content, &kustomization); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return kustomization.Resources, nil
+}
+
+// isK8sGenerated reports whether a resource of kustomization.yaml is a manifest written by mage k8s.
+// Remote resources, directories and missing files are not.
+func isK8sGenerated(outputDir, resource string) (bool, error) {
+	if filepath.Base(resource) != resource || filepath.Ext(resource) != ".yaml" {
+		return false, nil
+	}
+	path := filepath.Join(outputDir, resource)
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return bytes.HasPrefix(content, []byte(k8sGeneratedHeader)), nil
+}
+
+func writeK8sManifest(path, header string, docs ...any) error {
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	for _, doc := range docs {
+		if err := encoder.Encode(doc); err != nil {
+			return fmt.Errorf("failed to encode %s: %v", path, err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("failed to encode %s: %v", path, err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	PrintBlue(fmt.Sprintf("Generated %s", path))
+	return nil
+}
+
+// imageOr returns the configured image, falling back to image.
+func (k KubernetesConfig) imageOr(image string) string {
+	if k.Image != "" {
+		return k.Image
+	}
+	return image
+}
@@ -0,0 +1,451 @@
+package mageutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// LauncherStandalone is the launcher built from RunLauncher.
+	LauncherStandalone = "standalone"
+	// LauncherMage is the magefile compiled with `mage -compile`.
+	LauncherMage = "mage"
+)
+
+// LauncherInfo identifies the project and build of a standalone launcher.
+type LauncherInfo struct {
+	Project string
+	Version string
+}
+
+type launcherCommand struct {
+	name    string
+	args    string
+	summary string
+	// noRoot commands do not work on a project directory.
+	noRoot bool
+	run    func(fs *flag.FlagSet, info LauncherInfo) func() error
+}
+
+// launcherCommands are the subcommands of the standalone launcher. Each one declares its flags
+// on the flag set and returns the function running it with the parsed flags.
+var launcherCommands = []launcherCommand{
+	{name: "start", args: "[flags] [name...]", summary: "Run the tools, then start all or the named services", run: launcherStart},
+	{name: "stop", args: "[flags]", summary: "Stop the services and wait until they exited", run: launcherStop},
+	{name: "check", args: "[flags]", summary: "Check that every service instance runs and listens on its ports", run: launcherCheck},
+	{name: "status", args: "[flags]", summary: "Show the running instances and PIDs of every service", run: launcherStatus},
+	{name: "logs", args: "[flags] [name...]", summary: "Print the end of the log files, all or those starting with a name", run: launcherLogs},
+	{name: "install", args: "[flags] <archive>", summary: "Verify an exported archive and install it as the current release", noRoot: true, run: launcherInstall},
+	{name: "upgrade", args: "[flags] <archive>", summary: "Verify an exported archive, switch to it and restart, rolling back if the check fails", run: launcherUpgrade},
+	{name: "rollback", args: "", summary: "Switch back to the previously active release and restart", run: launcherRollback},
+	{name: "version", args: "", summary: "Print the launcher version", noRoot: true, run: launcherVersion},
+}
+
+// RunLauncher runs the standalone launcher exported with the project binaries and returns its
+// exit code. It works on the directory holding start-config.yml: the working directory when it
+// has one, otherwise the directory of the launcher executable, unless --root is given.
+func RunLauncher(info LauncherInfo, args []string) int {
+	program := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	global := flag.NewFlagSet(program, flag.ContinueOnError)
+	root := global.String("root", "", "project directory holding "+StartConfigFile)
+	global.Usage = func() { printLauncherUsage(global, info) }
+	if err := global.Parse(args); err != nil {
+		return launcherExitCode(err)
+	}
+	if global.NArg() == 0 {
+		global.Usage()
+		return 2
+	}
+
+	name, args := global.Arg(0), global.Args()[1:]
+	if name == "help" {
+		if len(args) == 0 {
+			global.Usage()
+			return 0
+		}
+		name, args = args[0], []string{"--help"}
+	}
+	index := slices.IndexFunc(launcherCommands, func(c launcherCommand) bool { return c.name == name })
+	if index < 0 {
+		PrintRedToStdErr(fmt.Sprintf("unknown command %q\n", name))
+		global.Usage()
+		return 2
+	}
+	command := launcherCommands[index]
+
+	fs := flag.NewFlagSet(program+" "+command.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "%s\n\nUsage: %s %s %s\n", command.summary, program, command.name, command.args)
+		if hasFlags(fs) {
+			fmt.Fprintln(fs.Output(), "\nFlags:")
+			fs.PrintDefaults()
+		}
+	}
+	run := command.run(fs, info)
+	if err := fs.Parse(args); err != nil {
+		return launcherExitCode(err)
+	}
+
+	if !command.noRoot {
+		if err := enterLauncherRoot(*root); err != nil {
+			PrintRed(err.Error())
+			return 1
+		}
+	}
+	if err := run(); err != nil {
+		PrintRed(command.name + " failed " + err.Error())
+		return 1
+	}
+	return 0
+}
+
+func printLauncherUsage(global *flag.FlagSet, info LauncherInfo) {
+	w := global.Output()
+	fmt.Fprintf(w, "%s launcher %s\n\nUsage: %s [--root <dir>] <command> [flags] [args]\n\nCommands:\n", info.Project, info.Version, global.Name())
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, command := range launcherCommands {
+		fmt.Fprintf(tw, "  %s\t%s\n", command.name, command.summary)
+	}
+	fmt.Fprintf(tw, "  help\tShow the help of a command\n")
+	_ = tw.Flush()
+	fmt.Fprintln(w, "\nFlags:")
+	global.PrintDefaults()
+	fmt.Fprintf(w, "\nRun '%s help <command>' for the flags of a command.\n", global.Name())
+}
+
+func hasFlags(fs *flag.FlagSet) bool {
+	found := false
+	fs.VisitAll(func(*flag.Flag) { found = true })
+	return found
+}
+
+func launcherExitCode(err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	return 2
+}
+
+// enterLauncherRoot changes to the project directory and points Paths at it. Symlinks are
+// resolved, as processes are matched by the real path of their executable.
+func enterLauncherRoot(root string) error {
+	if root == "" {
+		root = "."
+		if _, err := os.Stat(StartConfigFile); err != nil {
+			executable, err := os.Executable()
+			if err != nil {
+				return fmt.Errorf("failed to locate the launcher: %v", err)
+			}
+			root = filepath.Dir(executable)
+		}
+	}
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", root, err)
+	}
+	if err := os.Chdir(root); err != nil {
+		return fmt.Errorf("failed to enter %s: %v", root, err)
+	}
+	paths, err := NewPathConfig(&PathOptions{RootDir: &root})
+	if err != nil {
+		return err
+	}
+	Paths = paths
+	return nil
+}
+
+func profileFlag(fs *flag.FlagSet) *string {
+	return fs.String("profile", "", "start config profile overlaying start-config.<profile>.yml, default is $"+ProfileEnv)
+}
+
+func applyProfileFlag(profile *string) {
+	if *profile != "" {
+		Profile = *profile
+	}
+}
+
+func launcherStart(fs *flag.FlagSet, _ LauncherInfo) func() error {
+	profile := profileFlag(fs)
+	foreground := fs.Bool("foreground", false, "keep running and stop the services on SIGINT or SIGTERM, same as "+ForegroundEnv+"=true")
+	return func() error {
+		applyProfileFlag(profile)
+		if *foreground {
+			if err := os.Setenv(ForegroundEnv, "true"); err != nil {
+				return err
+			}
+		}
+		InitForSSC()
+		if err := SetMaxOpenFiles(); err != nil {
+			return fmt.Errorf("failed to raise the open file limit: %v", err)
+		}
+		// Ctrl-C kills the running tool instead of leaving it behind, a second one exits as before.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		context.AfterFunc(ctx, stop)
+		WithSpinner("Starting tools and services...", func() {
+			StartToolsAndServicesContext(ctx, fs.Args(), nil)
+		})
+		return nil
+	}
+}
+
+func launcherStop(fs *flag.FlagSet, _ LauncherInfo) func() error {
+	profile := profileFlag(fs)
+	return func() error {
+		applyProfileFlag(profile)
+		return WithSpinnerE("Stopping services...", StopAndCheckBinariesE)
+	}
+}
+
+func launcherCheck(fs *flag.FlagSet, _ LauncherInfo) func() error {
+	profile := profileFlag(fs)
+	return func() error {
+		applyProfileFlag(profile)
+		WithSpinner("Checking service status...", CheckAndReportBinariesStatus)
+		return nil
+	}
+}
+
+// serviceStatus is one line of the status command.
+type serviceStatus struct {
+	Service  string `json:"service"`
+	State    string `json:"state"`
+	Expected int    `json:"expected"`
+	Running  int    `json:"running"`
+	PIDs     []int  `json:"pids"`
+}
+
+func launcherStatus(fs *flag.FlagSet, _ LauncherInfo) func() error {
+	profile := profileFlag(fs)
+	asJSON := fs.Bool("json", false, "print the status as JSON")
+	return func() error {
+		applyProfileFlag(profile)
+		InitForSSC()
+		pidMap, err := FindPIDsByBinaryPath()
+		if err != nil {
+			return err
+		}
+
+		statuses := make([]serviceStatus, 0, len(serviceBinaries))
+		for _, binary := range slices.Sorted(maps.Keys(serviceBinaries)) {
+			pids := slices.Sorted(slices.Values(pidMap[GetBinFullPath(binary)]))
+			status := serviceStatus{Service: binary, Expected: serviceBinaries[binary], Running: len(pids), PIDs: pids}
+			switch {
+			case status.Running == 0:
+				status.State = "stopped"
+			case status.Running == status.Expected:
+				status.State = "running"
+			default:
+				status.State = "degraded"
+			}
+			if status.PIDs == nil {
+				status.PIDs = []int{}
+			}
+			statuses = append(statuses, status)
+		}
+
+		if *asJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(statuses)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "SERVICE\tSTATE\tRUNNING\tPIDS")
+		for _, status := range statuses {
+			pids := make([]string, len(status.PIDs))
+			for i, pid := range status.PIDs {
+				pids[i] = fmt.Sprint(pid)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d/%d\t%s\n", status.Service, status.State, status.Running, status.Expected, strings.Join(pids, ","))
+		}
+		return tw.Flush()
+	}
+}
+
+func launcherLogs(fs *flag.FlagSet, _ LauncherInfo) func() error {
+	follow := fs.Bool("f", false, "keep printing lines appended to the log files")
+	lines := fs.Int("n", 100, "number of lines to print from the end of each file")
+	return func() error {
+		files, err := findLogFiles(fs.Args())
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 && !*follow {
+			PrintYellow(fmt.Sprintf("No log files found in %s", Paths.OutputLogs))
+			return nil
+		}
+
+		offsets := make(map[string]int64, len(files))
+		current := ""
+		for _, file := range files {
+			content, offset, err := tailFile(file, *lines)
+			if err != nil {
+				return err
+			}
+			if len(files) > 1 {
+				printLogHeader(file, &current)
+			}
+			_, _ = os.Stdout.Write(content)
+			offsets[file] = offset
+		}
+		if !*follow {
+			return nil
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+			// New files show up when services start or logs rotate.
+			files, err := findLogFiles(fs.Args())
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				offset, err := copyLogTail(file, offsets[file], &current)
+				if err != nil {
+					return err
+				}
+				offsets[file] = offset
+			}
+		}
+	}
+}
+
+// findLogFiles returns the files under the logs directory whose name starts with one of the
+// prefixes, or all of them without prefixes.
+func findLogFiles(prefixes []string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(Paths.OutputLogs, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if len(prefixes) == 0 || slices.ContainsFunc(prefixes, func(prefix string) bool { return strings.HasPrefix(d.Name(), prefix) }) {
+			files = append(files, filePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", Paths.OutputLogs, err)
+	}
+	return files, nil
+}
+
+// tailFile returns the last lines of a file and its size.
+func tailFile(filePath string, lines int) ([]byte, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	size := info.Size()
+	if lines <= 0 {
+		return nil, size, nil
+	}
+
+	const chunkSize = 64 * 1024
+	var content []byte
+	start := size
+	for start > 0 && bytes.Count(bytes.TrimSuffix(content, []byte("\n")), []byte("\n")) < lines {
+		readSize := min(int64(chunkSize), start)
+		start -= readSize
+		chunk := make([]byte, readSize)
+		if _, err := file.ReadAt(chunk, start); err != nil {
+			return nil, 0, err
+		}
+		content = append(chunk, content...)
+	}
+	trimmed := bytes.TrimSuffix(content, []byte("\n"))
+	if count := bytes.Count(trimmed, []byte("\n")); count >= lines {
+		cut := len(trimmed)
+		for i := 0; i < lines; i++ {
+			cut = bytes.LastIndexByte(trimmed[:cut], '\n')
+		}
+		content = content[cut+1:]
+	}
+	return content, size, nil
+}
+
+// copyLogTail prints what was appended to a file since offset and returns the new offset. A file
+// smaller than offset was truncated or replaced, and is printed from the start.
+func copyLogTail(filePath string, offset int64, current *string) (int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return offset, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return offset, err
+	}
+	if info.Size() < offset {
+		offset = 0
+	}
+	if info.Size() == offset {
+		return offset, nil
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	printLogHeader(filePath, current)
+	written, err := io.CopyN(os.Stdout, file, info.Size()-offset)
+	return offset + written, err
+}
+
+// printLogHeader prints the name of a log file before its lines, when they follow another file.
+func printLogHeader(filePath string, current *string) {
+	if *current == filePath {
+		return
+	}
+	name := filePath
+	if rel, err := filepath.Rel(Paths.OutputLogs, filePath); err == nil {
+		name = rel
+	}
+	if *current != "" {
+		fmt.Println()
+	}
+	fmt.Printf("==> %s <==\n", name)
+	*current = filePath
+}
+
+func launcherVersion(_ *flag.FlagSet, info LauncherInfo) func() error {
+	return func() error {
+		fmt.Printf("%s %s %s/%s %s\n", info.Project, info.Version, runtime.GOOS, runtime.GOARCH, runtime.Version())
+		return nil
+	}
+}
@@ -0,0 +1,423 @@
+package mageutil
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/openimsdk/gomake/internal/util"
+)
+
+const (
+	// ReleasesDir holds one directory per installed archive, next to the CurrentRelease symlink.
+	ReleasesDir    = "releases"
+	CurrentRelease = "current"
+
+	defaultKeepReleases = 3
+	// releaseHistoryFile lists the activated releases in releases/, the last activated last.
+	releaseHistoryFile = ".history"
+)
+
+// releaseLayout is an install directory with releases/<name> for every installed archive and a
+// current symlink to the active one. A release is activated by replacing the symlink, so it
+// changes atomically, and is then appended to the activation history.
+type releaseLayout struct {
+	base string
+}
+
+// releaseLayoutOf returns the layout a project directory was installed in.
+func releaseLayoutOf(root string) (releaseLayout, error) {
+	root = filepath.Clean(root)
+	if filepath.Base(filepath.Dir(root)) != ReleasesDir {
+		return releaseLayout{}, fmt.Errorf("%s is not an installed release, install the archive with `mage install --dir <dir> <archive>` first", root)
+	}
+	return releaseLayout{base: filepath.Dir(filepath.Dir(root))}, nil
+}
+
+func (l releaseLayout) releaseDir(name string) string {
+	return filepath.Join(l.base, ReleasesDir, name)
+}
+
+// current returns the name of the active release, or "" before the first install.
+func (l releaseLayout) current() (string, error) {
+	target, err := os.Readlink(filepath.Join(l.base, CurrentRelease))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read the current release: %v", err)
+	}
+	return filepath.Base(target), nil
+}
+
+func (l releaseLayout) historyPath() string {
+	return filepath.Join(l.base, ReleasesDir, releaseHistoryFile)
+}
+
+// history returns the activated releases, the last activated last.
+func (l releaseLayout) history() ([]string, error) {
+	content, err := os.ReadFile(l.historyPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the release history: %v", err)
+	}
+	return strings.Fields(string(content)), nil
+}
+
+// recordActivation moves a release to the end of the history.
+func (l releaseLayout) recordActivation(name string) error {
+	history, err := l.history()
+	if err != nil {
+		return err
+	}
+	return l.writeHistory(append(slices.DeleteFunc(history, func(n string) bool { return n == name }), name))
+}
+
+// writeHistory replaces the history atomically.
+func (l releaseLayout) writeHistory(history []string) error {
+	tmpPath := l.historyPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(strings.Join(history, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write the release history: %v", err)
+	}
+	if err := os.Rename(tmpPath, l.historyPath()); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to write the release history: %v", err)
+	}
+	return nil
+}
+
+// releases returns the installed releases that were activated, the last activated first.
+// Releases that were staged but never activated are left out.
+func (l releaseLayout) releases() ([]string, error) {
+	history, err := l.history()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range slices.Backward(history) {
+		if info, err := os.Stat(l.releaseDir(name)); err == nil && info.IsDir() {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// previous returns the last activated release other than the current one.
+func (l releaseLayout) previous() (string, error) {
+	current, err := l.current()
+	if err != nil {
+		return "", err
+	}
+	names, err := l.releases()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if name != current {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no previous release in %s", filepath.Join(l.base, ReleasesDir))
+}
+
+// stage verifies an archive and extracts it into a new release directory, named after the version
+// of its launcher and the archive digest. Unless insecure is set, the archive must have a checksum
+// or a signature.
+func (l releaseLayout) stage(archivePath string, insecure bool) (string, error) {
+	if err := verifyArchive(archivePath, !insecure); err != nil {
+		if !insecure {
+			return "", fmt.Errorf("%v, pass --insecure to install it anyway", err)
+		}
+		return "", err
+	}
+	releasesDir := filepath.Join(l.base, ReleasesDir)
+	if err := os.MkdirAll(releasesDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory %s: %v", releasesDir, err)
+	}
+	stagingDir, err := os.MkdirTemp(releasesDir, ".staging-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(stagingDir)
+	if err := os.Chmod(stagingDir, 0755); err != nil {
+		return "", err
+	}
+
+	PrintBlue(fmt.Sprintf("Extracting %s", archivePath))
+	if err := util.ExtractArchive(archivePath, stagingDir); err != nil {
+		return "", fmt.Errorf("failed to extract %s: %v", archivePath, err)
+	}
+	launcher := releaseLauncher(stagingDir)
+	if _, err := os.Stat(launcher); err != nil {
+		return "", fmt.Errorf("%s has no launcher: %v", archivePath, err)
+	}
+
+	sum, err := fileSHA256(archivePath)
+	if err != nil {
+		return "", err
+	}
+	name := sum[:12]
+	if output, err := exec.Command(launcher, "version").Output(); err == nil {
+		// The output is "<project> <version> <os>/<arch> <go version>".
+		if fields := strings.Fields(string(output)); len(fields) >= 2 {
+			name = strings.NewReplacer("/", "_", "\\", "_").Replace(fields[1]) + "-" + sum[:8]
+		}
+	}
+
+	releaseDir := l.releaseDir(name)
+	if current, err := l.current(); err != nil {
+		return "", err
+	} else if current == name {
+		return "", fmt.Errorf("%s is already the current release %s", archivePath, name)
+	}
+	if err := os.RemoveAll(releaseDir); err != nil {
+		return "", err
+	}
+	if err := os.Rename(stagingDir, releaseDir); err != nil {
+		return "", fmt.Errorf("failed to move the release to %s: %v", releaseDir, err)
+	}
+	PrintGreen(fmt.Sprintf("Release %s staged in %s", name, releaseDir))
+	return name, nil
+}
+
+// unstage removes a staged release that was never activated, after a failed install or upgrade.
+func (l releaseLayout) unstage(name string) {
+	if current, err := l.current(); err != nil || current == name {
+		return
+	}
+	if err := os.RemoveAll(l.releaseDir(name)); err != nil {
+		PrintYellow(fmt.Sprintf("Failed to remove release %s: %v", name, err))
+	}
+}
+
+// activate points the current symlink at a release and records it in the history. A failure to
+// record it is only reported, the switch already happened.
+func (l releaseLayout) activate(name string) error {
+	link := filepath.Join(l.base, CurrentRelease)
+	tmpLink := link + ".tmp"
+	_ = os.Remove(tmpLink)
+	if err := os.Symlink(filepath.Join(ReleasesDir, name), tmpLink); err != nil {
+		return fmt.Errorf("failed to link release %s: %v", name, err)
+	}
+	if err := os.Rename(tmpLink, link); err != nil {
+		_ = os.Remove(tmpLink)
+		return fmt.Errorf("failed to switch %s to release %s: %v", link, name, err)
+	}
+	if err := l.recordActivation(name); err != nil {
+		PrintYellow(err.Error())
+	}
+	PrintGreen(fmt.Sprintf("%s now points to release %s", link, name))
+	return nil
+}
+
+// run runs a command of the launcher of a release in its directory.
+func (l releaseLayout) run(name string, args ...string) error {
+	releaseDir := l.releaseDir(name)
+	cmd := exec.Command(releaseLauncher(releaseDir), args...)
+	cmd.Dir = releaseDir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s of release %s failed: %v", strings.Join(args, " "), name, err)
+	}
+	return nil
+}
+
+// startAndCheck starts the services of a release and checks they are healthy.
+func (l releaseLayout) startAndCheck(name string) error {
+	if err := l.run(name, "start"); err != nil {
+		return err
+	}
+	return l.run(name, "check")
+}
+
+// prune removes the releases beyond the keep last activated ones besides the current one, and the
+// releases that were never activated.
+func (l releaseLayout) prune(keep int) error {
+	current, err := l.current()
+	if err != nil {
+		return err
+	}
+	names, err := l.releases()
+	if err != nil {
+		return err
+	}
+	kept := make(map[string]bool, keep+1)
+	kept[current] = true
+	for _, name := range names {
+		if len(kept) > keep {
+			break
+		}
+		kept[name] = true
+	}
+
+	entries, err := os.ReadDir(filepath.Join(l.base, ReleasesDir))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || strings.HasPrefix(name, ".") || kept[name] {
+			continue
+		}
+		PrintBlue(fmt.Sprintf("Removing old release %s", name))
+		if err := os.RemoveAll(l.releaseDir(name)); err != nil {
+			return fmt.Errorf("failed to remove release %s: %v", name, err)
+		}
+	}
+	// The history only lists the releases that are still installed.
+	history, err := l.history()
+	if err != nil {
+		return err
+	}
+	var remaining []string
+	for _, name := range history {
+		if kept[name] {
+			remaining = append(remaining, name)
+		}
+	}
+	if len(remaining) == len(history) {
+		return nil
+	}
+	return l.writeHistory(remaining)
+}
+
+func releaseLauncher(releaseDir string) string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(releaseDir, "mage.exe")
+	}
+	return filepath.Join(releaseDir, "mage")
+}
+
+func archiveArg(fs *flag.FlagSet) (string, error) {
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("expected one archive, usage: %s <archive>", fs.Name())
+	}
+	return filepath.Abs(fs.Arg(0))
+}
+
+func launcherInstall(fs *flag.FlagSet, _ LauncherInfo) func() error {
+	dir := fs.String("dir", ".", "install directory holding "+ReleasesDir+"/ and the "+CurrentRelease+" symlink")
+	start := fs.Bool("start", false, "start the services after installing")
+	insecure := fs.Bool("insecure", false, "install an archive without a checksum or a signature")
+	return func() error {
+		archivePath, err := archiveArg(fs)
+		if err != nil {
+			return err
+		}
+		base, err := filepath.Abs(*dir)
+		if err != nil {
+			return err
+		}
+		layout := releaseLayout{base: base}
+		if current, err := layout.current(); err != nil {
+			return err
+		} else if current != "" {
+			return fmt.Errorf("%s already has release %s, run `%s upgrade` instead", base, current, filepath.Join(base, CurrentRelease, "mage"))
+		}
+
+		name, err := layout.stage(archivePath, *insecure)
+		if err != nil {
+			return err
+		}
+		if err := layout.activate(name); err != nil {
+			layout.unstage(name)
+			return err
+		}
+		if *start {
+			return layout.startAndCheck(name)
+		}
+		PrintGreen(fmt.Sprintf("Installed release %s, start it with `%s start`", name, filepath.Join(base, CurrentRelease, "mage")))
+		return nil
+	}
+}
+
+func launcherUpgrade(fs *flag.FlagSet, _ LauncherInfo) func() error {
+	keep := fs.Int("keep", defaultKeepReleases, "number of previous releases kept for rollback")
+	insecure := fs.Bool("insecure", false, "upgrade to an archive without a checksum or a signature")
+	return func() error {
+		archivePath, err := archiveArg(fs)
+		if err != nil {
+			return err
+		}
+		layout, err := releaseLayoutOf(Paths.Root)
+		if err != nil {
+			return err
+		}
+		previous, err := layout.current()
+		if err != nil {
+			return err
+		}
+		if previous == "" {
+			return fmt.Errorf("%s has no current release", layout.base)
+		}
+
+		name, err := layout.stage(archivePath, *insecure)
+		if err != nil {
+			return err
+		}
+		if err := layout.run(previous, "stop"); err != nil {
+			layout.unstage(name)
+			return err
+		}
+		if err := layout.activate(name); err != nil {
+			layout.unstage(name)
+			return err
+		}
+		if err := layout.startAndCheck(name); err != nil {
+			PrintRed(fmt.Sprintf("Release %s is unhealthy, rolling back to %s: %v", name, previous, err))
+			if rollbackErr := switchRelease(layout, name, previous); rollbackErr != nil {
+				return fmt.Errorf("release %s failed: %v, and rolling back to %s failed: %v", name, err, previous, rollbackErr)
+			}
+			// A failed release must not be the target of a later rollback.
+			if removeErr := os.RemoveAll(layout.releaseDir(name)); removeErr != nil {
+				PrintYellow(fmt.Sprintf("Failed to remove release %s: %v", name, removeErr))
+			}
+			return fmt.Errorf("release %s failed and was rolled back to %s: %v", name, previous, err)
+		}
+		PrintGreen(fmt.Sprintf("Upgraded from %s to %s", previous, name))
+		return layout.prune(*keep)
+	}
+}
+
+func launcherRollback(_ *flag.FlagSet, _ LauncherInfo) func() error {
+	return func() error {
+		layout, err := releaseLayoutOf(Paths.Root)
+		if err != nil {
+			return err
+		}
+		current, err := layout.current()
+		if err != nil {
+			return err
+		}
+		previous, err := layout.previous()
+		if err != nil {
+			return err
+		}
+		if err := switchRelease(layout, current, previous); err != nil {
+			return err
+		}
+		PrintGreen(fmt.Sprintf("Rolled back from %s to %s", current, previous))
+		return nil
+	}
+}
+
+// switchRelease stops the services of one release and starts those of another.
+func switchRelease(layout releaseLayout, from, to string) error {
+	if err := layout.run(from, "stop"); err != nil {
+		return err
+	}
+	if err := layout.activate(to); err != nil {
+		return err
+	}
+	return layout.startAndCheck(to)
+}
@@ -0,0 +1,83 @@
+package mageutil
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/openimsdk/gomake/internal/limits"
+	"github.com/openimsdk/gomake/internal/util"
+)
+
+const (
+	CgroupRootEnv     = "GOMAKE_CGROUP_ROOT"
+	defaultCgroupRoot = "/sys/fs/cgroup/gomake"
+)
+
+// Parse converts the configured values into limits.Limits.
+func (r ResourceLimits) Parse() (limits.Limits, error) {
+	var (
+		parsed limits.Limits
+		err    error
+	)
+	if parsed.NoFile, err = limits.ParseRlimit(r.NoFile); err != nil {
+		return parsed, fmt.Errorf("nofile: %w", err)
+	}
+	if parsed.NProc, err = limits.ParseRlimit(r.NProc); err != nil {
+		return parsed, fmt.Errorf("nproc: %w", err)
+	}
+	if parsed.Core, err = limits.ParseRlimit(r.Core); err != nil {
+		return parsed, fmt.Errorf("core: %w", err)
+	}
+	parsed.MemoryMax = strings.TrimSpace(r.MemoryMax)
+	parsed.CPUMax = strings.TrimSpace(r.CPUMax)
+	return parsed, nil
+}
+
+// parseCgroupCPUMax parses a cpu.max value into its quota and period. The quota is 0 when unlimited.
+func parseCgroupCPUMax(cpuMax string) (quota, period uint64, err error) {
+	fields := strings.Fields(cpuMax)
+	if len(fields) == 0 || fields[0] == "max" {
+		return 0, 0, nil
+	}
+	if quota, err = strconv.ParseUint(fields[0], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid cpuMax %q", cpuMax)
+	}
+	period = 100000
+	if len(fields) > 1 {
+		if period, err = strconv.ParseUint(fields[1], 10, 64); err != nil || period == 0 {
+			return 0, 0, fmt.Errorf("invalid cpuMax %q", cpuMax)
+		}
+	}
+	return quota, period, nil
+}
+
+// serviceCgroupDir returns the cgroup an instance is moved into when cgroup limits are set.
+func serviceCgroupDir(binary string, index int) string {
+	root := defaultCgroupRoot
+	if env := util.ResolveEnvOption[string](CgroupRootEnv); env != nil {
+		root = *env
+	}
+	name := strings.TrimSuffix(binary, ".exe") + "-" + strconv.Itoa(index)
+	return filepath.Join(root, name)
+}
+
+// applyServiceLimits makes cmd start a service instance with its configured resource limits.
+// Limits are only applied on Linux, other platforms start the instance without them.
+func applyServiceLimits(cmd *Cmd, binary string, index int) error {
+	parsed, err := serviceConfigs[binary].Limits.Parse()
+	if err != nil {
+		return err
+	}
+	if parsed.IsZero() {
+		return nil
+	}
+	if !limits.Supported {
+		PrintYellow(fmt.Sprintf("Resource limits of %s are not supported on %s, starting instance %d without them", binary, runtime.GOOS, index))
+		return nil
+	}
+	cmd.WithLimits(serviceCgroupDir(binary, index), parsed)
+	return nil
+}
@@ -0,0 +1,463 @@
+package mageutil
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openimsdk/gomake/internal/util"
+)
+
+const (
+	ociLayoutVersion     = "1.0.0"
+	ociMediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	ociMediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	ociMediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	ociMediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociAnnotationRefName = "org.opencontainers.image.ref.name"
+
+	dockerMediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociImageConfig struct {
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Variant      string          `json:"variant,omitempty"`
+	Config       ociContainerCfg `json:"config"`
+	RootFS       ociRootFS       `json:"rootfs"`
+	History      []ociHistory    `json:"history,omitempty"`
+}
+
+type ociContainerCfg struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+}
+
+type ociRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type ociHistory struct {
+	CreatedBy  string `json:"created_by,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
+}
+
+// ociLayout is an OCI image layout directory that blobs are written into.
+type ociLayout struct {
+	dir string
+}
+
+func newOCILayout(dir string) (*ociLayout, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to clean %s: %v", dir, err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	return &ociLayout{dir: dir}, nil
+}
+
+func (l *ociLayout) blobPath(digest string) string {
+	return filepath.Join(l.dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+func (l *ociLayout) writeBlob(mediaType string, content []byte) (ociDescriptor, error) {
+	sum := sha256.Sum256(content)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if err := os.WriteFile(l.blobPath(digest), content, 0644); err != nil {
+		return ociDescriptor{}, fmt.Errorf("failed to write blob %s: %v", digest, err)
+	}
+	return ociDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(content))}, nil
+}
+
+func (l *ociLayout) writeJSON(mediaType string, v any) (ociDescriptor, error) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	return l.writeBlob(mediaType, content)
+}
+
+// copyBlob copies a blob of another layout into this one, failing when it does not match desc.
+func (l *ociLayout) copyBlob(from *ociLayout, desc ociDescriptor) error {
+	if !strings.HasPrefix(desc.Digest, "sha256:") {
+		return fmt.Errorf("unsupported digest %s", desc.Digest)
+	}
+	src, err := os.Open(from.blobPath(desc.Digest))
+	if err != nil {
+		return fmt.Errorf("failed to open blob %s: %v", desc.Digest, err)
+	}
+	defer src.Close()
+
+	target := l.blobPath(desc.Digest)
+	dst, err := os.Create(target)
+	if err != nil {
+		return fmt.Errorf("failed to create blob %s: %v", desc.Digest, err)
+	}
+	defer dst.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, h), src)
+	if err != nil {
+		return fmt.Errorf("failed to copy blob %s: %v", desc.Digest, err)
+	}
+	if err := checkBlob(desc, size, h.Sum(nil)); err != nil {
+		dst.Close()
+		os.Remove(target)
+		return err
+	}
+	return nil
+}
+
+func (l *ociLayout) readJSON(desc ociDescriptor, v any) error {
+	if !strings.HasPrefix(desc.Digest, "sha256:") {
+		return fmt.Errorf("unsupported digest %s", desc.Digest)
+	}
+	content, err := os.ReadFile(l.blobPath(desc.Digest))
+	if err != nil {
+		return fmt.Errorf("failed to read blob %s: %v", desc.Digest, err)
+	}
+	sum := sha256.Sum256(content)
+	if err := checkBlob(desc, int64(len(content)), sum[:]); err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// checkBlob compares the size and SHA-256 of a blob with its descriptor, so a corrupted or
+// tampered base image is rejected instead of being copied into the built images.
+func checkBlob(desc ociDescriptor, size int64, sum []byte) error {
+	if digest := "sha256:" + hex.EncodeToString(sum); digest != desc.Digest {
+		return fmt.Errorf("blob %s is corrupted: its digest is %s", desc.Digest, digest)
+	}
+	if desc.Size > 0 && size != desc.Size {
+		return fmt.Errorf("blob %s is corrupted: its size is %d, expected %d", desc.Digest, size, desc.Size)
+	}
+	return nil
+}
+
+// writeLayer writes a gzip compressed layer with the files of mapping (source path to
+// path inside the image). Entries are sorted and carry fixed timestamps and ownership,
+// so identical input produces an identical digest. It returns the layer descriptor
+// and the digest of the uncompressed tar.
+func (l *ociLayout) writeLayer(mapping map[string]string) (ociDescriptor, string, error) {
+	tmp, err := os.CreateTemp(l.dir, "layer-*")
+	if err != nil {
+		return ociDescriptor{}, "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	compressedHash := sha256.New()
+	gzipWriter, err := gzip.NewWriterLevel(io.MultiWriter(tmp, compressedHash), gzip.BestCompression)
+	if err != nil {
+		return ociDescriptor{}, "", err
+	}
+	diffHash := sha256.New()
+	tarWriter := tar.NewWriter(io.MultiWriter(gzipWriter, diffHash))
+
+	entries, err := collectLayerEntries(mapping)
+	if err != nil {
+		return ociDescriptor{}, "", err
+	}
+	for _, entry := range entries {
+		if err := entry.write(tarWriter); err != nil {
+			return ociDescriptor{}, "", fmt.Errorf("failed to add %s to layer: %v", entry.src, err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return ociDescriptor{}, "", err
+	}
+
+	digest := "sha256:" + hex.EncodeToString(compressedHash.Sum(nil))
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return ociDescriptor{}, "", err
+	}
+	if err := os.Rename(tmp.Name(), l.blobPath(digest)); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	desc := ociDescriptor{MediaType: ociMediaTypeLayer, Digest: digest, Size: info.Size()}
+	return desc, "sha256:" + hex.EncodeToString(diffHash.Sum(nil)), nil
+}
+
+type layerEntry struct {
+	name string
+	src  string
+	dir  bool
+	mode int64
+}
+
+func (e layerEntry) write(tw *tar.Writer) error {
+	header := &tar.Header{
+		Name:    e.name,
+		Mode:    e.mode,
+		ModTime: time.Unix(0, 0),
+		Format:  tar.FormatPAX,
+	}
+	if e.dir {
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+		return tw.WriteHeader(header)
+	}
+
+	file, err := os.Open(e.src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header.Typeflag = tar.TypeReg
+	header.Size = info.Size()
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// collectLayerEntries expands the mapping into sorted tar entries including parent directories.
+func collectLayerEntries(mapping map[string]string) ([]layerEntry, error) {
+	entries := make(map[string]layerEntry)
+	addParents := func(name string) {
+		for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			entries[dir] = layerEntry{name: dir, dir: true, mode: 0755}
+		}
+	}
+
+	for src, dst := range mapping {
+		if err := util.CheckExist(src); err != nil {
+			return nil, err
+		}
+		base := strings.Trim(path.Clean(filepath.ToSlash(dst)), "/")
+		err := filepath.Walk(src, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			relPath, err := filepath.Rel(src, filePath)
+			if err != nil {
+				return err
+			}
+			name := path.Join(base, filepath.ToSlash(relPath))
+			addParents(name)
+			if info.IsDir() {
+				entries[name] = layerEntry{name: name, dir: true, mode: 0755}
+				return nil
+			}
+			mode := int64(0644)
+			if info.Mode()&0111 != 0 {
+				mode = 0755
+			}
+			entries[name] = layerEntry{name: name, src: filePath, mode: mode}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sorted := make([]layerEntry, 0, len(entries))
+	for _, entry := range entries {
+		sorted = append(sorted, entry)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	return sorted, nil
+}
+
+// finish writes oci-layout and index.json.
+func (l *ociLayout) finish(index ociIndex) error {
+	layout := []byte(fmt.Sprintf(`{"imageLayoutVersion":"%s"}`, ociLayoutVersion))
+	if err := os.WriteFile(filepath.Join(l.dir, "oci-layout"), layout, 0644); err != nil {
+		return err
+	}
+	content, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(l.dir, "index.json"), content, 0644)
+}
+
+// archiveTo writes the layout as a tar file with sorted entries.
+func (l *ociLayout) archiveTo(archivePath string) error {
+	var files []string
+	err := filepath.Walk(l.dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, filePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	out, err := os.Create(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", archivePath, err)
+	}
+	defer out.Close()
+	tw := tar.NewWriter(out)
+	for _, file := range files {
+		relPath, err := filepath.Rel(l.dir, file)
+		if err != nil {
+			return err
+		}
+		entry := layerEntry{name: filepath.ToSlash(relPath), src: file, mode: 0644}
+		if err := entry.write(tw); err != nil {
+			return fmt.Errorf("failed to add %s to %s: %v", relPath, archivePath, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// openOCIArchive extracts an OCI image layout tarball, such as the output of
+// `skopeo copy ... oci-archive:`, into dir. Archives without index.json, like the Docker
+// format of `docker save` before Docker 25, are rejected. The blobs are verified when read.
+func openOCIArchive(archivePath, dir string) (*ociLayout, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(file)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", archivePath, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		if name == ".." || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+			return nil, fmt.Errorf("invalid path %q in %s", header.Name, archivePath)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); err != nil {
+		return nil, fmt.Errorf("%s is not an OCI image layout archive (index.json missing)", archivePath)
+	}
+	return &ociLayout{dir: dir}, nil
+}
+
+// resolveManifest finds the image manifest for a platform, following nested indexes.
+func (l *ociLayout) resolveManifest(targetOS, targetArch string) (ociDescriptor, ociManifest, error) {
+	var index ociIndex
+	content, err := os.ReadFile(filepath.Join(l.dir, "index.json"))
+	if err != nil {
+		return ociDescriptor{}, ociManifest{}, err
+	}
+	if err := json.Unmarshal(content, &index); err != nil {
+		return ociDescriptor{}, ociManifest{}, err
+	}
+	return l.findManifest(index.Manifests, targetOS, targetArch)
+}
+
+func (l *ociLayout) findManifest(descs []ociDescriptor, targetOS, targetArch string) (ociDescriptor, ociManifest, error) {
+	for _, desc := range descs {
+		if desc.Platform != nil && (desc.Platform.OS != targetOS || desc.Platform.Architecture != targetArch) {
+			continue
+		}
+		switch desc.MediaType {
+		case ociMediaTypeIndex, dockerMediaTypeManifestList:
+			var nested ociIndex
+			if err := l.readJSON(desc, &nested); err != nil {
+				return ociDescriptor{}, ociManifest{}, err
+			}
+			if found, manifest, err := l.findManifest(nested.Manifests, targetOS, targetArch); err == nil {
+				return found, manifest, nil
+			}
+		default:
+			var manifest ociManifest
+			if err := l.readJSON(desc, &manifest); err != nil {
+				return ociDescriptor{}, ociManifest{}, err
+			}
+			var config ociImageConfig
+			if err := l.readJSON(manifest.Config, &config); err != nil {
+				return ociDescriptor{}, ociManifest{}, err
+			}
+			if config.OS == targetOS && config.Architecture == targetArch {
+				return desc, manifest, nil
+			}
+		}
+	}
+	return ociDescriptor{}, ociManifest{}, fmt.Errorf("no image for %s/%s found", targetOS, targetArch)
+}
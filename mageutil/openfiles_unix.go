@@ -0,0 +1,29 @@
+//go:build !windows
+
+package mageutil
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// SetMaxOpenFiles raises the soft open file limit inherited by the services to MaxFileDescriptors,
+// capped by the hard limit. It never lowers the limit and leaves the hard limit untouched.
+func SetMaxOpenFiles() error {
+	if MaxFileDescriptors <= 0 {
+		return nil
+	}
+	var rLimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
+		return err
+	}
+	target := min(uint64(MaxFileDescriptors), rLimit.Max)
+	if rLimit.Cur >= target {
+		return nil
+	}
+	if target < uint64(MaxFileDescriptors) {
+		PrintYellow(fmt.Sprintf("maxFileDescriptors %d exceeds the hard open file limit, using %d", MaxFileDescriptors, target))
+	}
+	rLimit.Cur = target
+	return syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rLimit)
+}
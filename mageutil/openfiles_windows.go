@@ -0,0 +1,8 @@
+//go:build windows
+
+package mageutil
+
+// SetMaxOpenFiles does nothing, Windows has no open file limit to raise.
+func SetMaxOpenFiles() error {
+	return nil
+}
@@ -19,6 +19,9 @@ const (
 	ToolsDir     = "tools"
 	TmpDir       = "tmp"
 	ExportDir    = "export"
+	K8sDir       = "k8s"
+	ImagesDir    = "images"
+	SystemdDir   = "systemd"
 	LogsDir      = "logs"
 	BinDir       = "bin"
 	PlatformsDir = "platforms"
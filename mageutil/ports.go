@@ -0,0 +1,360 @@
+package mageutil
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+
+	"github.com/shirou/gopsutil/v4/net"
+	"github.com/shirou/gopsutil/v4/process"
+)
+
+var portTemplateFuncs = template.FuncMap{
+	"add": func(a, b int) int { return a + b },
+	"mul": func(a, b int) int { return a * b },
+}
+
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// PortBinding is a single port a service instance listens on.
+type PortBinding struct {
+	Protocol string
+	Port     int
+}
+
+func (b PortBinding) String() string {
+	return fmt.Sprintf("%s/%d", b.Protocol, b.Port)
+}
+
+// ResolvePorts renders the declared ports of the service for the given instance index.
+// Entries have the form "[tcp|udp/]port" and default to tcp.
+func (s ServiceConfig) ResolvePorts(index int) ([]PortBinding, error) {
+	bindings := make([]PortBinding, 0, len(s.Ports))
+	for _, raw := range s.Ports {
+		binding, err := resolvePort(raw, index)
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, binding)
+	}
+	return bindings, nil
+}
+
+func resolvePort(raw string, index int) (PortBinding, error) {
+	text := strings.TrimSpace(raw)
+	protocol := ProtocolTCP
+	if proto, rest, found := strings.Cut(text, "/"); found {
+		protocol = strings.ToLower(strings.TrimSpace(proto))
+		text = strings.TrimSpace(rest)
+	}
+	if protocol != ProtocolTCP && protocol != ProtocolUDP {
+		return PortBinding{}, fmt.Errorf("invalid port %q: unsupported protocol %s", raw, protocol)
+	}
+
+	if strings.Contains(text, "{{") {
+		tmpl, err := template.New("port").Funcs(portTemplateFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return PortBinding{}, fmt.Errorf("invalid port template %q: %v", raw, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, struct{ Index int }{Index: index}); err != nil {
+			return PortBinding{}, fmt.Errorf("failed to render port template %q: %v", raw, err)
+		}
+		text = strings.TrimSpace(buf.String())
+	}
+
+	port, err := strconv.Atoi(text)
+	if err != nil {
+		return PortBinding{}, fmt.Errorf("invalid port %q: %v", raw, err)
+	}
+	if port <= 0 || port > 65535 {
+		return PortBinding{}, fmt.Errorf("port %q out of range: %d", raw, port)
+	}
+	return PortBinding{Protocol: protocol, Port: port}, nil
+}
+
+// listenBinding reports the port a connection is bound for receiving on, if any.
+// TCP sockets count when listening, UDP sockets when they are not connected to a peer.
+// Clients such as DNS resolvers also hold unconnected UDP sockets, so callers only
+// treat a UDP binding as a listener when the port is declared.
+func listenBinding(conn net.ConnectionStat) (PortBinding, bool) {
+	switch conn.Type {
+	case syscall.SOCK_STREAM:
+		if conn.Status == "LISTEN" {
+			return PortBinding{Protocol: ProtocolTCP, Port: int(conn.Laddr.Port)}, true
+		}
+	case syscall.SOCK_DGRAM:
+		if conn.Laddr.Port != 0 && conn.Raddr.Port == 0 {
+			return PortBinding{Protocol: ProtocolUDP, Port: int(conn.Laddr.Port)}, true
+		}
+	}
+	return PortBinding{}, false
+}
+
+// portOwner identifies the service instance that declared a port.
+type portOwner struct {
+	binary string
+	index  int
+}
+
+func (o portOwner) String() string {
+	return fmt.Sprintf("%s instance %d", o.binary, o.index)
+}
+
+// expectedServicePorts resolves the declared ports of every instance of the given binaries.
+func expectedServicePorts(binaries map[string]int) (map[PortBinding]portOwner, error) {
+	var errorMessages []string
+	expected := make(map[PortBinding]portOwner)
+
+	names := make([]string, 0, len(binaries))
+	for binary := range binaries {
+		names = append(names, binary)
+	}
+	sort.Strings(names)
+
+	for _, binary := range names {
+		service := serviceConfigs[binary]
+		for i := 0; i < binaries[binary]; i++ {
+			ports, err := service.ResolvePorts(i)
+			if err != nil {
+				errorMessages = append(errorMessages, fmt.Sprintf("%s instance %d: %v", binary, i, err))
+				continue
+			}
+			owner := portOwner{binary: binary, index: i}
+			for _, port := range ports {
+				if prev, exists := expected[port]; exists {
+					errorMessages = append(errorMessages, fmt.Sprintf("port %s is declared by both %s and %s", port, prev, owner))
+					continue
+				}
+				expected[port] = owner
+			}
+		}
+	}
+
+	if len(errorMessages) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errorMessages, "\n"))
+	}
+	return expected, nil
+}
+
+// CheckPortsAvailable verifies that no other process is listening on the ports declared
+// for the given binaries. The map has the same shape as serviceBinaries.
+func CheckPortsAvailable(binaries map[string]int) error {
+	expected, err := expectedServicePorts(binaries)
+	if err != nil {
+		return err
+	}
+	if len(expected) == 0 {
+		return nil
+	}
+
+	connections, err := net.Connections("all")
+	if err != nil {
+		return fmt.Errorf("failed to get connections: %v", err)
+	}
+
+	var errorMessages []string
+	reported := make(map[PortBinding]struct{})
+	for _, conn := range connections {
+		port, ok := listenBinding(conn)
+		if !ok {
+			continue
+		}
+		owner, exists := expected[port]
+		if !exists {
+			continue
+		}
+		if _, done := reported[port]; done {
+			continue
+		}
+		reported[port] = struct{}{}
+		errorMessages = append(errorMessages, fmt.Sprintf("port %s required by %s is in use by %s", port, owner, describePID(conn.Pid)))
+	}
+
+	if len(errorMessages) > 0 {
+		sort.Strings(errorMessages)
+		return fmt.Errorf("%s", strings.Join(errorMessages, "\n"))
+	}
+	return nil
+}
+
+func describePID(pid int32) string {
+	if pid <= 0 {
+		return "an unknown process (insufficient permissions?)"
+	}
+	proc, err := process.NewProcess(pid)
+	if err != nil {
+		return fmt.Sprintf("PID %d", pid)
+	}
+	exePath, err := proc.Exe()
+	if err != nil {
+		return fmt.Sprintf("PID %d", pid)
+	}
+	return fmt.Sprintf("PID %d (%s)", pid, exePath)
+}
+
+// CheckBinariesPorts verifies that every running service instance listens on exactly the
+// ports declared for its instance index. Services without declared ports are not checked.
+func CheckBinariesPorts() error {
+	pidMap, err := FindPIDsByBinaryPath()
+	if err != nil {
+		return err
+	}
+
+	connections, err := net.Connections("all")
+	if err != nil {
+		return fmt.Errorf("failed to get connections: %v", err)
+	}
+	listening := make(map[int32]map[PortBinding]struct{})
+	for _, conn := range connections {
+		binding, ok := listenBinding(conn)
+		if !ok || conn.Pid <= 0 {
+			continue
+		}
+		if listening[conn.Pid] == nil {
+			listening[conn.Pid] = make(map[PortBinding]struct{})
+		}
+		listening[conn.Pid][binding] = struct{}{}
+	}
+
+	names := make([]string, 0, len(serviceBinaries))
+	for binary := range serviceBinaries {
+		names = append(names, binary)
+	}
+	sort.Strings(names)
+
+	var errorMessages []string
+	for _, binary := range names {
+		service := serviceConfigs[binary]
+		if len(service.Ports) == 0 {
+			continue
+		}
+
+		instances := make(map[int]int32)
+		for _, pid := range pidMap[GetBinFullPath(binary)] {
+			index, err := instanceIndex(int32(pid))
+			if err != nil {
+				errorMessages = append(errorMessages, fmt.Sprintf("%s PID %d: %v", binary, pid, err))
+				continue
+			}
+			if other, exists := instances[index]; exists {
+				errorMessages = append(errorMessages, fmt.Sprintf("%s instance %d is running twice: PID %d and PID %d", binary, index, other, pid))
+				continue
+			}
+			instances[index] = int32(pid)
+		}
+
+		expected := make(map[int]map[PortBinding]struct{})
+		declaredBy := make(map[PortBinding]int)
+		for index := range instances {
+			ports, err := service.ResolvePorts(index)
+			if err != nil {
+				errorMessages = append(errorMessages, fmt.Sprintf("%s instance %d: %v", binary, index, err))
+				continue
+			}
+			expected[index] = make(map[PortBinding]struct{}, len(ports))
+			for _, port := range ports {
+				expected[index][port] = struct{}{}
+				declaredBy[port] = index
+			}
+		}
+
+		indexes := make([]int, 0, len(instances))
+		for index := range instances {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+
+		for _, index := range indexes {
+			pid := instances[index]
+			for _, port := range sortedBindings(expected[index]) {
+				if _, ok := listening[pid][port]; ok {
+					continue
+				}
+				if other, ok := findInstanceListening(instances, listening, port); ok {
+					errorMessages = append(errorMessages, fmt.Sprintf("%s instance %d: port %s is bound by instance %d instead", binary, index, port, other))
+					continue
+				}
+				errorMessages = append(errorMessages, fmt.Sprintf("%s instance %d (PID %d): expected port %s is not listening", binary, index, pid, port))
+			}
+			for _, port := range sortedBindings(listening[pid]) {
+				if _, ok := expected[index][port]; ok {
+					continue
+				}
+				if _, declared := declaredBy[port]; declared {
+					// Reported above as bound by the wrong instance.
+					continue
+				}
+				if port.Protocol == ProtocolUDP {
+					// An undeclared UDP socket is most likely a client socket.
+					continue
+				}
+				errorMessages = append(errorMessages, fmt.Sprintf("%s instance %d (PID %d): unexpected port %s is open", binary, index, pid, port))
+			}
+		}
+	}
+
+	if len(errorMessages) > 0 {
+		return fmt.Errorf("%s", strings.Join(errorMessages, "\n"))
+	}
+	return nil
+}
+
+func findInstanceListening(instances map[int]int32, listening map[int32]map[PortBinding]struct{}, port PortBinding) (int, bool) {
+	for index, pid := range instances {
+		if _, ok := listening[pid][port]; ok {
+			return index, true
+		}
+	}
+	return 0, false
+}
+
+func sortedBindings(bindings map[PortBinding]struct{}) []PortBinding {
+	sorted := make([]PortBinding, 0, len(bindings))
+	for binding := range bindings {
+		sorted = append(sorted, binding)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Port != sorted[j].Port {
+			return sorted[i].Port < sorted[j].Port
+		}
+		return sorted[i].Protocol < sorted[j].Protocol
+	})
+	return sorted
+}
+
+// instanceIndex reads the "-i" argument StartBinaries passes to every instance.
+func instanceIndex(pid int32) (int, error) {
+	proc, err := process.NewProcess(pid)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create process object: %v", err)
+	}
+	args, err := proc.CmdlineSlice()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get command line: %v", err)
+	}
+	for i, arg := range args {
+		var value string
+		switch {
+		case arg == "-i" && i+1 < len(args):
+			value = args[i+1]
+		case strings.HasPrefix(arg, "-i="):
+			value = strings.TrimPrefix(arg, "-i=")
+		default:
+			continue
+		}
+		index, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid instance index %q", value)
+		}
+		return index, nil
+	}
+	return 0, nil
+}
@@ -1,13 +1,15 @@
 package mageutil
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
+
+	"github.com/openimsdk/gomake/internal/priority"
 )
 
 // StopBinaries iterates over all binary files and terminates their corresponding processes.
@@ -18,23 +20,36 @@ func StopBinaries() {
 	}
 }
 
+// resolveBinariesToStart returns the instance count of every binary that StartBinaries would start.
+func resolveBinariesToStart(specificBinaries ...string) map[string]int {
+	if len(specificBinaries) == 0 {
+		return serviceBinaries
+	}
+	binariesToStart := make(map[string]int)
+	for _, binary := range specificBinaries {
+		if count, exists := serviceBinaries[binary]; exists {
+			binariesToStart[binary] = count
+		} else {
+			binariesToStart[binary] = 1
+			// PrintYellow(fmt.Sprintf("Binary %s not found in config, starting with default count 1", binary))
+		}
+	}
+	return binariesToStart
+}
+
 // StartBinaries Start all binary services or specified ones.
 func StartBinaries(specificBinaries ...string) error {
-	var binariesToStart map[string]int
-	if len(specificBinaries) > 0 {
-		binariesToStart = make(map[string]int)
-		for _, binary := range specificBinaries {
-			if count, exists := serviceBinaries[binary]; exists {
-				binariesToStart[binary] = count
-			} else {
-				binariesToStart[binary] = 1
-				// PrintYellow(fmt.Sprintf("Binary %s not found in config, starting with default count 1", binary))
-			}
+	binariesToStart := resolveBinariesToStart(specificBinaries...)
+
+	// On failure the instances started so far are stopped, so that nothing half started keeps running.
+	var started []*os.Process
+	fail := func(err error) error {
+		for _, process := range started {
+			_ = process.Kill()
+			_, _ = process.Wait()
 		}
-	} else {
-		binariesToStart = serviceBinaries
+		return err
 	}
-
 	for binary, count := range binariesToStart {
 		binFullPath := filepath.Join(Paths.OutputHostBin, binary)
 
@@ -49,14 +64,19 @@ func StartBinaries(specificBinaries ...string) error {
 				configPath = Paths.K8sConfig
 			}
 			args := []string{"-i", strconv.Itoa(i), "-c", configPath}
-			cmd := exec.Command(binFullPath, args...)
+			cmd := NewCmd(binFullPath).WithArgs(args...).WithDir(Paths.OutputHostBin)
+			if err := serviceConfigs[binary].SchedulingConfig.apply(cmd); err != nil {
+				return fail(fmt.Errorf("invalid scheduling settings for %s: %v", binary, err))
+			}
+			if err := applyServiceLimits(cmd, binary, i); err != nil {
+				return fail(fmt.Errorf("invalid resource limits for %s: %v", binary, err))
+			}
 			PrintBlue(fmt.Sprintf("Starting %s", cmd.String()))
-			cmd.Dir = Paths.OutputHostBin
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			if err := cmd.Start(); err != nil {
-				return fmt.Errorf("failed to start %s with args %v: %v", binFullPath, args, err)
+			execCmd, err := cmd.Start()
+			if err != nil {
+				return fail(fmt.Errorf("failed to start %s with args %v: %v", binFullPath, args, err))
 			}
+			started = append(started, execCmd.Process)
 		}
 	}
 	return nil
@@ -64,6 +84,11 @@ func StartBinaries(specificBinaries ...string) error {
 
 // StartTools starts all tool binaries or specified ones.
 func StartTools(specificTools ...string) error {
+	return StartToolsContext(context.Background(), specificTools...)
+}
+
+// StartToolsContext runs the tools one after another, the running tool is killed when ctx is done.
+func StartToolsContext(ctx context.Context, specificTools ...string) error {
 	var toolsToStart []string
 	if len(specificTools) > 0 {
 		for _, tool := range specificTools {
@@ -90,20 +115,62 @@ func StartTools(specificTools ...string) error {
 			configPath = Paths.K8sConfig
 		}
 
-		cmd := exec.Command(toolFullPath, "-c", configPath)
+		cmd := NewCmd(toolFullPath).WithArgs("-c", configPath).WithDir(Paths.OutputHostBinTools)
+		if err := toolConfigs[tool].SchedulingConfig.apply(cmd); err != nil {
+			return fmt.Errorf("invalid scheduling settings for %s: %v", tool, err)
+		}
 		PrintBlue(fmt.Sprintf("Starting %s", cmd.String()))
-		cmd.Dir = Paths.OutputHostBinTools
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
 
-		if err := cmd.Start(); err != nil {
-			return fmt.Errorf("failed to start %s with error: %v", toolFullPath, err)
+		if err := cmd.RunContext(ctx); err != nil {
+			return fmt.Errorf("failed to execute %s: %v", toolFullPath, err)
+		}
+		PrintGreen(fmt.Sprintf("Starting %s successfully", cmd.String()))
+	}
+	return nil
+}
+
+// apply configures cmd with the scheduling settings.
+func (s SchedulingConfig) apply(cmd *Cmd) error {
+	if s.Priority != "" {
+		level, err := priority.ParseLevel(s.Priority)
+		if err != nil {
+			return err
+		}
+		cmd.WithPriority(level)
+	}
+	if s.IOPriority != "" {
+		ioPriority, err := priority.ParseIOPriority(s.IOPriority)
+		if err != nil {
+			return err
+		}
+		cmd.WithIOPriority(ioPriority)
+	}
+	if s.CPUAffinity != "" {
+		cpus, err := priority.ParseCPUList(s.CPUAffinity)
+		if err != nil {
+			return err
 		}
+		cmd.WithCPUAffinity(cpus)
+	}
+	return nil
+}
 
-		if err := cmd.Wait(); err != nil {
-			return fmt.Errorf("failed to execute %s with exit code: %v", toolFullPath, err)
+// validate checks the scheduling settings without applying them.
+func (s SchedulingConfig) validate() error {
+	if s.Priority != "" {
+		if _, err := priority.ParseLevel(s.Priority); err != nil {
+			return err
+		}
+	}
+	if s.IOPriority != "" {
+		if _, err := priority.ParseIOPriority(s.IOPriority); err != nil {
+			return err
+		}
+	}
+	if s.CPUAffinity != "" {
+		if _, err := priority.ParseCPUList(s.CPUAffinity); err != nil {
+			return err
 		}
-		PrintGreen(fmt.Sprintf("Starting %s successfully", cmd.String()))
 	}
 	return nil
 }
@@ -0,0 +1,245 @@
+package mageutil
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	// ProtocVersion is the protoc release installed under _output/tools/protoc/<version>.
+	ProtocVersion = "26.1"
+	// ProtocArchiveEnv names a protoc release zip, a directory holding release zips or an
+	// http(s) mirror of the GitHub release downloads, used instead of downloading from GitHub.
+	ProtocArchiveEnv = "GOMAKE_PROTOC_ARCHIVE"
+	// ProtocSHA256Env overrides the expected SHA-256 of the protoc release zip, e.g. for a zip
+	// of another version given with GOMAKE_PROTOC_ARCHIVE.
+	ProtocSHA256Env = "GOMAKE_PROTOC_SHA256"
+
+	protocReleaseURL = "https://github.com/protocolbuffers/protobuf/releases/download"
+)
+
+// protocAssets maps GOOS/GOARCH to the platform suffix of the protoc release zips.
+var protocAssets = map[string]string{
+	"linux/amd64":   "linux-x86_64",
+	"linux/arm64":   "linux-aarch_64",
+	"linux/386":     "linux-x86_32",
+	"linux/ppc64le": "linux-ppcle_64",
+	"linux/s390x":   "linux-s390_64",
+	"darwin/amd64":  "osx-x86_64",
+	"darwin/arm64":  "osx-aarch_64",
+	"windows/amd64": "win64",
+	"windows/386":   "win32",
+}
+
+// protocSHA256 holds the SHA-256 of the protoc release zips of ProtocVersion, as published on
+// the GitHub release page. Update it together with ProtocVersion: TestProtocSHA256 fails until
+// every entry of protocAssets has a digest. A zip without a digest is only installed with
+// GOMAKE_PROTOC_SHA256.
+var protocSHA256 = map[string]string{}
+
+// protocAssetName returns the name of the protoc release zip for the host platform.
+func protocAssetName(version string) (string, error) {
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	suffix, ok := protocAssets[platform]
+	if !ok {
+		return "", fmt.Errorf("no protoc release for %s, set %s to a protoc zip", platform, ProtocArchiveEnv)
+	}
+	return fmt.Sprintf("protoc-%s-%s.zip", version, suffix), nil
+}
+
+// ensureProtoc installs protoc into _output/tools/protoc/<version> and returns the path of its executable.
+// An installed toolchain is reused without network access.
+func ensureProtoc(ctx context.Context) (string, error) {
+	installDir := filepath.Join(Paths.OutputTools, "protoc", ProtocVersion)
+	protocPath := filepath.Join(installDir, "bin", "protoc")
+	if runtime.GOOS == "windows" {
+		protocPath += ".exe"
+	}
+	if isExecutableFile(protocPath) {
+		return protocPath, nil
+	}
+
+	name, err := protocAssetName(ProtocVersion)
+	if err != nil {
+		return "", err
+	}
+	// Without a trusted digest nothing is downloaded.
+	expected, source, err := expectedProtocSHA256(name)
+	if err != nil {
+		return "", err
+	}
+	archivePath, cleanup, err := fetchProtocArchive(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	if err := verifyProtocArchive(name, archivePath, expected, source); err != nil {
+		return "", err
+	}
+
+	// Extract next to the final directory so a partial install is never picked up.
+	stagingDir := installDir + ".tmp"
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(stagingDir)
+	if err := unzip(archivePath, stagingDir); err != nil {
+		return "", fmt.Errorf("failed to extract %s: %v", name, err)
+	}
+	if !isExecutableFile(filepath.Join(stagingDir, "bin", filepath.Base(protocPath))) {
+		return "", fmt.Errorf("%s has no bin/%s", name, filepath.Base(protocPath))
+	}
+	if err := os.RemoveAll(installDir); err != nil {
+		return "", err
+	}
+	if err := os.Rename(stagingDir, installDir); err != nil {
+		return "", fmt.Errorf("failed to install protoc to %s: %v", installDir, err)
+	}
+	PrintGreen(fmt.Sprintf("protoc %s installed to %s", ProtocVersion, installDir))
+	return protocPath, nil
+}
+
+// fetchProtocArchive returns a local path of the release zip, from GOMAKE_PROTOC_ARCHIVE or downloaded.
+// cleanup removes the file when it was downloaded.
+func fetchProtocArchive(ctx context.Context, name string) (archivePath string, cleanup func(), err error) {
+	source := os.Getenv(ProtocArchiveEnv)
+	if source == "" {
+		source = protocReleaseURL + "/v" + ProtocVersion
+	}
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		if !strings.HasSuffix(source, ".zip") {
+			source = strings.TrimSuffix(source, "/") + "/" + name
+		}
+		archivePath = filepath.Join(Paths.OutputTmp, name+".download")
+		if err := downloadFile(ctx, source, archivePath); err != nil {
+			_ = os.Remove(archivePath)
+			return "", nil, err
+		}
+		return archivePath, func() { _ = os.Remove(archivePath) }, nil
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", ProtocArchiveEnv, err)
+	}
+	if info.IsDir() {
+		source = filepath.Join(source, name)
+		if _, err := os.Stat(source); err != nil {
+			return "", nil, fmt.Errorf("%s: %v", ProtocArchiveEnv, err)
+		}
+	}
+	PrintBlue(fmt.Sprintf("Using protoc archive %s", source))
+	return source, func() {}, nil
+}
+
+// downloadFile saves url to dest, failing on any non-200 response.
+func downloadFile(ctx context.Context, url, dest string) error {
+	PrintBlue(fmt.Sprintf("Downloading %s...", url))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", filepath.Dir(dest), err)
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	return out.Close()
+}
+
+// expectedProtocSHA256 returns the SHA-256 a protoc release zip must have, from GOMAKE_PROTOC_SHA256
+// or the digest shipped in protocSHA256, and fails when neither is known.
+func expectedProtocSHA256(name string) (expected, source string, err error) {
+	if expected := strings.TrimSpace(os.Getenv(ProtocSHA256Env)); expected != "" {
+		return expected, ProtocSHA256Env, nil
+	}
+	if expected, ok := protocSHA256[name]; ok {
+		return expected, "the published checksum", nil
+	}
+	return "", "", fmt.Errorf("no published checksum of %s is known, set %s to the SHA-256 shown for it on %s/v%s",
+		name, ProtocSHA256Env, strings.Replace(protocReleaseURL, "/download", "/tag", 1), ProtocVersion)
+}
+
+// verifyProtocArchive checks the SHA-256 of a protoc release zip against the expected digest.
+func verifyProtocArchive(name, archivePath, expected, source string) error {
+	sum, err := fileSHA256(archivePath)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(expected, sum) {
+		return fmt.Errorf("checksum mismatch for %s: %s is %s, got %s", name, source, expected, sum)
+	}
+	return nil
+}
+
+// unzip extracts a zip archive into dest, rejecting entries that would land outside of it.
+func unzip(src, dest string) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if !filepath.IsLocal(filepath.FromSlash(f.Name)) {
+			return fmt.Errorf("illegal file path %q in %s", f.Name, src)
+		}
+		target := filepath.Join(dest, filepath.FromSlash(f.Name))
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			return fmt.Errorf("unsupported file %q of mode %s in %s", f.Name, f.Mode(), src)
+		}
+		if err := unzipFile(f, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unzipFile(f *zip.File, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode().Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, rc); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,29 @@
+package mageutil
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// TestProtocSHA256 fails when a protoc release zip of ProtocVersion ships without its digest.
+func TestProtocSHA256(t *testing.T) {
+	names := make(map[string]bool, len(protocAssets))
+	for platform, suffix := range protocAssets {
+		name := fmt.Sprintf("protoc-%s-%s.zip", ProtocVersion, suffix)
+		names[name] = true
+		digest, ok := protocSHA256[name]
+		if !ok {
+			t.Errorf("%s (%s) has no digest in protocSHA256", name, platform)
+			continue
+		}
+		if sum, err := hex.DecodeString(digest); err != nil || len(sum) != 32 {
+			t.Errorf("digest of %s is not a SHA-256: %q", name, digest)
+		}
+	}
+	for name := range protocSHA256 {
+		if !names[name] {
+			t.Errorf("protocSHA256 has %s, which is no protoc %s release zip of protocAssets", name, ProtocVersion)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package mageutil
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/openimsdk/gomake/internal/limits"
+	"github.com/openimsdk/gomake/internal/priority"
+	"github.com/openimsdk/gomake/internal/util"
+)
+
+const (
+	defaultSystemdUnitDir = "/etc/systemd/system"
+	defaultSystemdTarget  = "gomake"
+	defaultSystemdRestart = "on-failure"
+)
+
+var systemdRestartPolicies = []string{"no", "always", "on-success", "on-failure", "on-abnormal", "on-abort", "on-watchdog"}
+
+type SystemdOptions struct {
+	ProjectName *string
+	// RootDir is the project root on the target host, default is the current root.
+	RootDir *string
+	// User runs the units as this user instead of root.
+	User *string
+	// Restart is the systemd restart policy of the services, default is on-failure.
+	Restart *string
+	// OutputDir is where the units are generated, default is _output/systemd.
+	OutputDir *string
+	// UnitDir is where `install` copies the units, default is /etc/systemd/system.
+	UnitDir *string
+}
+
+func (opt *SystemdOptions) GetTargetName() string {
+	if name := k8sName(util.NilAsZero(util.NilAsZero(opt).ProjectName)); name != "" {
+		return name
+	}
+	return defaultSystemdTarget
+}
+
+func (opt *SystemdOptions) GetRootDir() string {
+	if dir := strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).RootDir)); dir != "" {
+		return filepath.ToSlash(dir)
+	}
+	return filepath.ToSlash(Paths.Root)
+}
+
+func (opt *SystemdOptions) GetUser() string {
+	return strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).User))
+}
+
+func (opt *SystemdOptions) GetRestart() string {
+	if restart := strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).Restart)); restart != "" {
+		return restart
+	}
+	return defaultSystemdRestart
+}
+
+func (opt *SystemdOptions) GetOutputDir() string {
+	if dir := strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).OutputDir)); dir != "" {
+		return dir
+	}
+	return filepath.Join(Paths.Output, SystemdDir)
+}
+
+func (opt *SystemdOptions) GetUnitDir() string {
+	if dir := strings.TrimSpace(util.NilAsZero(util.NilAsZero(opt).UnitDir)); dir != "" {
+		return dir
+	}
+	return defaultSystemdUnitDir
+}
+
+// ResolveSystemdOptions fills the options not set in code from SYSTEMD_ROOT_DIR, SYSTEMD_USER,
+// SYSTEMD_RESTART and SYSTEMD_UNIT_DIR.
+func ResolveSystemdOptions(codeOpt *SystemdOptions) *SystemdOptions {
+	fromCode := util.NilAsZero(codeOpt)
+	return &SystemdOptions{
+		ProjectName: fromCode.ProjectName,
+		RootDir:     util.CoalescePtr(fromCode.RootDir, util.ResolveEnvOption[string]("SYSTEMD_ROOT_DIR")),
+		User:        util.CoalescePtr(fromCode.User, util.ResolveEnvOption[string]("SYSTEMD_USER")),
+		Restart:     util.CoalescePtr(fromCode.Restart, util.ResolveEnvOption[string]("SYSTEMD_RESTART")),
+		OutputDir:   fromCode.OutputDir,
+		UnitDir:     util.CoalescePtr(fromCode.UnitDir, util.ResolveEnvOption[string]("SYSTEMD_UNIT_DIR")),
+	}
+}
+
+// systemdUnits lists the units generated from start-config.yml.
+type systemdUnits struct {
+	target    string
+	tools     []string
+	templates []string
+	// instances are the enabled instances of the templates, e.g. api@0.service, api@1.service.
+	instances []string
+	files     map[string]string
+}
+
+// all returns the target, the tool units and the service instances.
+func (u *systemdUnits) all() []string {
+	units := append([]string{u.target}, u.tools...)
+	return append(units, u.instances...)
+}
+
+// GenerateSystemdUnits writes a templated <service>@.service unit for every service, a oneshot
+// <tool>.service for every tool and a target grouping them to _output/systemd.
+func GenerateSystemdUnits(systemdOpt *SystemdOptions) error {
+	opt := ResolveSystemdOptions(systemdOpt)
+	units, err := buildSystemdUnits(opt)
+	if err != nil {
+		return err
+	}
+	if err := units.writeTo(opt.GetOutputDir(), "Generated"); err != nil {
+		return err
+	}
+	PrintGreen(fmt.Sprintf("systemd units generated in %s", opt.GetOutputDir()))
+	return nil
+}
+
+func (u *systemdUnits) writeTo(dir, verb string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(u.files)) {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(u.files[name]), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", file, err)
+		}
+		PrintBlue(fmt.Sprintf("%s %s", verb, file))
+	}
+	return nil
+}
+
+// SystemdCommand runs generate, install, enable, disable, start, stop, restart or status.
+// Except for generate and install, the action is passed to systemctl with the target, the tool
+// units and one instance of every service unit per configured count.
+func SystemdCommand(action string, systemdOpt *SystemdOptions) error {
+	return SystemdCommandContext(context.Background(), action, systemdOpt)
+}
+
+// SystemdCommandContext is SystemdCommand, systemctl is killed when ctx is done.
+func SystemdCommandContext(ctx context.Context, action string, systemdOpt *SystemdOptions) error {
+	opt := ResolveSystemdOptions(systemdOpt)
+	switch action {
+	case "generate":
+		return GenerateSystemdUnits(opt)
+	case "install":
+		return installSystemdUnits(ctx, opt)
+	case "enable", "disable", "start", "stop", "restart", "status":
+	default:
+		return fmt.Errorf("unknown systemd command %s", action)
+	}
+
+	units, err := buildSystemdUnits(opt)
+	if err != nil {
+		return err
+	}
+	args := append([]string{action}, units.all()...)
+	if action == "stop" {
+		// Also stop instances left over from a higher count.
+		for _, template := range units.templates {
+			args = append(args, strings.Replace(template, "@.", "@*.", 1))
+		}
+	}
+	cmd := NewCmd("systemctl").WithArgs(args...)
+	PrintBlue(fmt.Sprintf("Running %s", cmd.String()))
+	if err := cmd.RunContext(ctx); err != nil {
+		return fmt.Errorf("systemctl %s failed: %v", action, err)
+	}
+	return nil
+}
+
+func installSystemdUnits(ctx context.Context, opt *SystemdOptions) error {
+	units, err := buildSystemdUnits(opt)
+	if err != nil {
+		return err
+	}
+	if err := units.writeTo(opt.GetOutputDir(), "Generated"); err != nil {
+		return err
+	}
+	if err := units.writeTo(opt.GetUnitDir(), "Installed"); err != nil {
+		return err
+	}
+	if err := NewCmd("systemctl").WithArgs("daemon-reload").RunContext(ctx); err != nil {
+		return fmt.Errorf("systemctl daemon-reload failed: %v", err)
+	}
+	PrintGreen(fmt.Sprintf("systemd units installed in %s, run `mage systemd enable` and `mage systemd start`", opt.GetUnitDir()))
+	return nil
+}
+
+func buildSystemdUnits(opt *SystemdOptions) (*systemdUnits, error) {
+	restart := opt.GetRestart()
+	if !slices.Contains(systemdRestartPolicies, restart) {
+		return nil, fmt.Errorf("invalid restart policy %q: expected one of %s", restart, strings.Join(systemdRestartPolicies, ", "))
+	}
+
+	config, err := loadValidStartConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	units := &systemdUnits{
+		target: opt.GetTargetName() + ".target",
+		files:  make(map[string]string),
+	}
+
+	toolsDir, err := opt.hostPath(Paths.OutputHostBinTools)
+	if err != nil {
+		return nil, err
+	}
+	for _, tool := range config.ToolBinaries {
+		name := systemdUnitName(tool.Name) + ".service"
+		unit, err := buildSystemdToolUnit(opt, tool, toolsDir, units.target)
+		if err != nil {
+			return nil, fmt.Errorf("tool %s: %v", tool.Name, err)
+		}
+		units.tools = append(units.tools, name)
+		units.files[name] = unit
+	}
+
+	binDir, err := opt.hostPath(Paths.OutputHostBin)
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range slices.Sorted(maps.Keys(config.ServiceBinaries)) {
+		cfg := config.ServiceBinaries[service]
+		name := systemdUnitName(service)
+		unit, err := buildSystemdServiceUnit(opt, service, cfg, binDir, config.MaxFileDescriptors, units)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %v", service, err)
+		}
+		units.templates = append(units.templates, name+"@.service")
+		units.files[name+"@.service"] = unit
+		for i := 0; i < cfg.Count; i++ {
+			units.instances = append(units.instances, name+"@"+strconv.Itoa(i)+".service")
+		}
+	}
+
+	units.files[units.target] = buildSystemdTarget(opt, units)
+	return units, nil
+}
+
+func buildSystemdTarget(opt *SystemdOptions, units *systemdUnits) string {
+	var b strings.Builder
+	b.WriteString("[Unit]\n")
+	fmt.Fprintf(&b, "Description=%s services\n", opt.GetTargetName())
+	if wants := append(append([]string(nil), units.tools...), units.instances...); len(wants) > 0 {
+		fmt.Fprintf(&b, "Wants=%s\n", strings.Join(wants, " "))
+	}
+	b.WriteString("\n[Install]\n")
+	b.WriteString("WantedBy=multi-user.target\n")
+	return b.String()
+}
+
+func buildSystemdToolUnit(opt *SystemdOptions, tool ToolConfig, toolsDir, target string) (string, error) {
+	var b strings.Builder
+	b.WriteString("[Unit]\n")
+	fmt.Fprintf(&b, "Description=%s\n", tool.Name)
+	b.WriteString("After=network-online.target\n")
+	b.WriteString("Wants=network-online.target\n")
+	fmt.Fprintf(&b, "PartOf=%s\n", target)
+
+	b.WriteString("\n[Service]\n")
+	b.WriteString("Type=oneshot\n")
+	b.WriteString("RemainAfterExit=yes\n")
+	opt.writeServiceCommon(&b, toolsDir)
+	fmt.Fprintf(&b, "ExecStart=%s -c %s\n", systemdQuote(path.Join(toolsDir, tool.Name)), systemdQuote(opt.configDir()))
+	if err := writeSystemdScheduling(&b, tool.SchedulingConfig); err != nil {
+		return "", err
+	}
+
+	b.WriteString("\n[Install]\n")
+	fmt.Fprintf(&b, "WantedBy=%s\n", target)
+	return b.String(), nil
+}
+
+func buildSystemdServiceUnit(opt *SystemdOptions, service string, cfg ServiceConfig, binDir string, maxFileDescriptors int, units *systemdUnits) (string, error) {
+	var b strings.Builder
+	b.WriteString("[Unit]\n")
+	fmt.Fprintf(&b, "Description=%s instance %%i\n", service)
+	b.WriteString("After=network-online.target\n")
+	b.WriteString("Wants=network-online.target\n")
+	if len(units.tools) > 0 {
+		// Tools run to completion before the services, like `mage start`.
+		fmt.Fprintf(&b, "Requires=%s\n", strings.Join(units.tools, " "))
+		fmt.Fprintf(&b, "After=%s\n", strings.Join(units.tools, " "))
+	}
+	fmt.Fprintf(&b, "PartOf=%s\n", units.target)
+
+	b.WriteString("\n[Service]\n")
+	b.WriteString("Type=simple\n")
+	opt.writeServiceCommon(&b, binDir)
+	fmt.Fprintf(&b, "ExecStart=%s -i %%i -c %s\n", systemdQuote(path.Join(binDir, service)), systemdQuote(opt.configDir()))
+	fmt.Fprintf(&b, "Restart=%s\n", opt.GetRestart())
+	b.WriteString("RestartSec=5\n")
+	if err := writeSystemdLimits(&b, cfg.Limits, maxFileDescriptors); err != nil {
+		return "", err
+	}
+	if err := writeSystemdScheduling(&b, cfg.SchedulingConfig); err != nil {
+		return "", err
+	}
+
+	b.WriteString("\n[Install]\n")
+	fmt.Fprintf(&b, "WantedBy=%s\n", units.target)
+	return b.String(), nil
+}
+
+func (opt *SystemdOptions) writeServiceCommon(b *strings.Builder, workingDir string) {
+	// WorkingDirectory takes the path verbatim, only specifiers need escaping.
+	fmt.Fprintf(b, "WorkingDirectory=%s\n", strings.ReplaceAll(workingDir, "%", "%%"))
+	if user := opt.GetUser(); user != "" {
+		fmt.Fprintf(b, "User=%s\n", user)
+	}
+}
+
+// writeSystemdLimits translates the resource limits into systemd directives. LimitNOFILE
+// defaults to maxFileDescriptors.
+func writeSystemdLimits(b *strings.Builder, resourceLimits ResourceLimits, maxFileDescriptors int) error {
+	parsed, err := resourceLimits.Parse()
+	if err != nil {
+		return err
+	}
+	if parsed.NoFile != nil {
+		fmt.Fprintf(b, "LimitNOFILE=%s\n", systemdRlimit(*parsed.NoFile))
+	} else if maxFileDescriptors > 0 {
+		fmt.Fprintf(b, "LimitNOFILE=%d\n", maxFileDescriptors)
+	}
+	if parsed.NProc != nil {
+		fmt.Fprintf(b, "LimitNPROC=%s\n", systemdRlimit(*parsed.NProc))
+	}
+	if parsed.Core != nil {
+		fmt.Fprintf(b, "LimitCORE=%s\n", systemdRlimit(*parsed.Core))
+	}
+	if parsed.MemoryMax != "" {
+		memoryMax := parsed.MemoryMax
+		if memoryMax == "max" {
+			memoryMax = "infinity"
+		}
+		fmt.Fprintf(b, "MemoryMax=%s\n", memoryMax)
+	}
+	quota, period, err := parseCgroupCPUMax(parsed.CPUMax)
+	if err != nil {
+		return err
+	}
+	if quota > 0 {
+		fmt.Fprintf(b, "CPUQuota=%d%%\n", quota*100/period)
+		if period != 100000 {
+			fmt.Fprintf(b, "CPUQuotaPeriodSec=%dus\n", period)
+		}
+	}
+	return nil
+}
+
+func systemdRlimit(value uint64) string {
+	if value == limits.Unlimited {
+		return "infinity"
+	}
+	return limits.FormatRlimit(value)
+}
+
+func writeSystemdScheduling(b *strings.Builder, s SchedulingConfig) error {
+	if s.Priority != "" {
+		level, err := priority.ParseLevel(s.Priority)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(b, "Nice=%d\n", priority.Nice(level))
+	}
+	if s.IOPriority != "" {
+		ioPriority, err := priority.ParseIOPriority(s.IOPriority)
+		if err != nil {
+			return err
+		}
+		switch ioPriority.Class {
+		case priority.IOClassRealtime:
+			b.WriteString("IOSchedulingClass=realtime\n")
+		case priority.IOClassBestEffort:
+			b.WriteString("IOSchedulingClass=best-effort\n")
+		case priority.IOClassIdle:
+			b.WriteString("IOSchedulingClass=idle\n")
+		}
+		if ioPriority.Class != priority.IOClassIdle {
+			fmt.Fprintf(b, "IOSchedulingPriority=%d\n", ioPriority.Level)
+		}
+	}
+	if s.CPUAffinity != "" {
+		cpus, err := priority.ParseCPUList(s.CPUAffinity)
+		if err != nil {
+			return err
+		}
+		list := make([]string, 0, len(cpus))
+		for _, cpu := range cpus {
+			list = append(list, strconv.Itoa(cpu))
+		}
+		fmt.Fprintf(b, "CPUAffinity=%s\n", strings.Join(list, " "))
+	}
+	return nil
+}
+
+// hostPath maps a local path under the project root to the root on the target host.
+func (opt *SystemdOptions) hostPath(localPath string) (string, error) {
+	rel, err := filepath.Rel(Paths.Root, localPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s relative to %s: %v", localPath, Paths.Root, err)
+	}
+	return path.Join(opt.GetRootDir(), filepath.ToSlash(rel)), nil
+}
+
+func (opt *SystemdOptions) configDir() string {
+	dir, err := opt.hostPath(Paths.Config)
+	if err != nil {
+		return filepath.ToSlash(Paths.Config)
+	}
+	return dir
+}
+
+// systemdUnitName strips the .exe suffix and characters systemd does not accept in unit names.
+func systemdUnitName(binary string) string {
+	name := strings.TrimSuffix(strings.TrimSpace(binary), ".exe")
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune(":_.-", r):
+			return r
+		default:
+			return '-'
+		}
+	}, name)
+}
+
+// systemdQuote escapes specifiers and quotes a path containing whitespace.
+func systemdQuote(value string) string {
+	value = strings.ReplaceAll(value, "%", "%%")
+	if !strings.ContainsAny(value, " \t\"'\\") {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}